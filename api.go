@@ -4,25 +4,54 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 )
 
 type API struct {
-	c      *Client
-	secret string
+	c        *Client
+	secret   string
+	provider SecretProvider
+	app      *App
 }
 
+// WithSecret changes the secret of api and returns it. It is not safe while
+// other goroutines use the same API; use the handles of Client.App to call
+// several apps concurrently.
 func (api *API) WithSecret(secret string) *API {
 	api.secret = secret
+	api.app = nil
 	return api
 }
 
-func (api *API) getSecret() string {
+// getSecret returns the secret of the next call, and the provider it came
+// from if any.
+func (api *API) getSecret(ctx context.Context) (string, SecretProvider, error) {
 	if api.secret != "" {
-		return api.secret
+		return api.secret, nil, nil
 	}
-	return api.c.getAPISecret()
+	provider := api.provider
+	if provider == nil {
+		provider = api.c.secrets
+	}
+	if provider == nil {
+		return api.c.getAPISecret(), nil, nil
+	}
+	secret, err := provider.Secret(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("dify: getting API secret: %w", err)
+	}
+	return secret, provider, nil
+}
+
+// streamOptions applies opts on top of the client defaults.
+func (api *API) streamOptions(opts []StreamOption) streamOptions {
+	options := api.c.streamDefaults
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
 }
 
 func (api *API) createBaseRequest(ctx context.Context, method, apiUrl string, body interface{}) (*http.Request, error) {
@@ -36,11 +65,21 @@ func (api *API) createBaseRequest(ctx context.Context, method, apiUrl string, bo
 	} else {
 		b = http.NoBody
 	}
+	secret, provider, err := api.getSecret(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if provider != nil {
+		ctx = withSecretProvider(ctx, provider)
+	}
+	if api.app != nil {
+		ctx = withApp(ctx, api.app)
+	}
 	req, err := http.NewRequestWithContext(ctx, method, api.c.getHost()+apiUrl, b)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", "Bearer "+api.getSecret())
+	req.Header.Set("Authorization", "Bearer "+secret)
 	req.Header.Set("Cache-Control", "no-cache")
 	req.Header.Set("Content-Type", "application/json; charset=utf-8")
 	return req, nil
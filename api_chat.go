@@ -14,10 +14,29 @@ type ChatMessageRequest struct {
 }
 
 type ChatMessageResponse struct {
-	ID             string `json:"id"`
-	Answer         string `json:"answer"`
-	ConversationID string `json:"conversation_id"`
-	CreatedAt      int    `json:"created_at"`
+	ID             string          `json:"id"`
+	Answer         string          `json:"answer"`
+	ConversationID string          `json:"conversation_id"`
+	CreatedAt      int             `json:"created_at"`
+	Metadata       MessageMetadata `json:"metadata"`
+}
+
+type MessageMetadata struct {
+	Usage Usage `json:"usage"`
+}
+
+// Usage is the model usage Dify reports for a message.
+type Usage struct {
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	TotalPrice       string  `json:"total_price"`
+	Currency         string  `json:"currency"`
+	Latency          float64 `json:"latency"`
+}
+
+func (r *ChatMessageResponse) tokenUsage() (Usage, bool) {
+	return r.Metadata.Usage, r.Metadata.Usage.TotalTokens > 0
 }
 
 /* Create chat message
@@ -1,22 +1,32 @@
 package dify
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
 )
 
 type ChatMessageStreamResponse struct {
-	Event          string `json:"event"`
-	TaskID         string `json:"task_id"`
-	ID             string `json:"id"`
-	Answer         string `json:"answer"`
-	CreatedAt      int64  `json:"created_at"`
-	ConversationID string `json:"conversation_id"`
+	Event          string           `json:"event"`
+	TaskID         string           `json:"task_id"`
+	ID             string           `json:"id"`
+	Answer         string           `json:"answer"`
+	CreatedAt      int64            `json:"created_at"`
+	ConversationID string           `json:"conversation_id"`
+	MessageID      string           `json:"message_id,omitempty"`
+	Audio          string           `json:"audio,omitempty"`
+	Metadata       *MessageMetadata `json:"metadata,omitempty"`
+}
+
+type StopRequest struct {
+	TaskID string `json:"-"`
+	User   string `json:"user"`
+}
+
+type StopResponse struct {
+	Result string `json:"result"`
 }
 
 type ChatMessageStreamChannelResponse struct {
@@ -24,6 +34,9 @@ type ChatMessageStreamChannelResponse struct {
 	Err error `json:"-"`
 }
 
+/* Create chat message in streaming mode, returning the raw response
+ * A non-2xx response is returned as an *APIError and its body is closed.
+ */
 func (api *API) ChatMessagesStreamRaw(ctx context.Context, req *ChatMessageRequest) (*http.Response, error) {
 	req.ResponseMode = "streaming"
 
@@ -31,54 +44,108 @@ func (api *API) ChatMessagesStreamRaw(ctx context.Context, req *ChatMessageReque
 	if err != nil {
 		return nil, err
 	}
-	return api.c.sendRequest(httpReq)
+	return api.c.sendStreamRequest(httpReq)
 }
 
-func (api *API) ChatMessagesStream(ctx context.Context, req *ChatMessageRequest) (chan ChatMessageStreamChannelResponse, error) {
-	httpResp, err := api.ChatMessagesStreamRaw(ctx, req)
+/* Create chat message in streaming mode
+ * Returns a Stream over the message events; the caller must Close it or drain it.
+ */
+func (api *API) StreamChatMessages(ctx context.Context, req *ChatMessageRequest, opts ...StreamOption) (*Stream[ChatMessageStreamResponse], error) {
+	options := api.streamOptions(opts)
+	httpResp, err := api.ChatMessagesStreamRaw(options.watch(ctx), req)
 	if err != nil {
-		return nil, err
+		return nil, options.watchdog.fail(err)
 	}
+	decode := observeDecode(decodeChatMessageEvent, chatStreamTracer(responseTrace(httpResp)))
+	options.observe = streamObserver(httpResp)
+	return newStream(httpResp.Body, decode, options), nil
+}
 
+/* Create chat message in streaming mode, delivering events on a channel
+ * The channel is closed when the stream ends. Cancel ctx to stop reading early.
+ * Malformed events are delivered with Err set and skipped, unless strict decoding is enabled.
+ */
+func (api *API) ChatMessagesStream(ctx context.Context, req *ChatMessageRequest, opts ...StreamOption) (chan ChatMessageStreamChannelResponse, error) {
 	streamChannel := make(chan ChatMessageStreamChannelResponse)
-	go api.chatMessagesStreamHandle(ctx, httpResp, streamChannel)
+	opts = append([]StreamOption{WithStreamErrorHandler(channelErrorHandler(ctx, streamChannel))}, opts...)
+
+	stream, err := api.StreamChatMessages(ctx, req, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	go api.chatMessagesStreamHandle(ctx, stream, streamChannel)
 	return streamChannel, nil
 }
 
-func (api *API) chatMessagesStreamHandle(ctx context.Context, resp *http.Response, streamChannel chan ChatMessageStreamChannelResponse) {
-	defer resp.Body.Close()
+// channelErrorHandler reports malformed events on the stream channel.
+func channelErrorHandler(ctx context.Context, streamChannel chan ChatMessageStreamChannelResponse) func(error) {
+	return func(err error) {
+		select {
+		case streamChannel <- ChatMessageStreamChannelResponse{Err: err}:
+		case <-ctx.Done():
+		}
+	}
+}
+
+func decodeChatMessageEvent(event sseEvent) (resp ChatMessageStreamResponse, ok bool, err error) {
+	eventType := peekEventType(event.Data)
+	if eventType == EventError {
+		return resp, false, decodeStreamError(event)
+	}
+	if err = json.Unmarshal(event.Data, &resp); err != nil {
+		return resp, false, newStreamDecodeError(event, eventType, err)
+	}
+	if resp.Event == "" {
+		return resp, false, newStreamProtocolError(event, "event has no type")
+	}
+	return resp, true, nil
+}
+
+// chatMessagesStreamHandle forwards stream events to streamChannel until the
+// stream ends or ctx is done. Every send also watches ctx, so a consumer that
+// stops reading can cancel ctx to release the goroutine and the connection.
+func (api *API) chatMessagesStreamHandle(ctx context.Context, stream *Stream[ChatMessageStreamResponse], streamChannel chan ChatMessageStreamChannelResponse) {
+	defer stream.Close()
 	defer close(streamChannel)
 
-	reader := bufio.NewReader(resp.Body)
-	for {
+	send := func(resp ChatMessageStreamChannelResponse) bool {
 		select {
+		case streamChannel <- resp:
+			return true
 		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for stream.Next() {
+		if !send(ChatMessageStreamChannelResponse{ChatMessageStreamResponse: stream.Current()}) {
 			return
-		default:
-			line, err := reader.ReadBytes('\n')
-			if err != nil {
-				if err == io.EOF {
-					return
-				}
-				streamChannel <- ChatMessageStreamChannelResponse{
-					Err: fmt.Errorf("error reading line: %w", err),
-				}
-				return
-			}
-
-			if !bytes.HasPrefix(line, []byte("data:")) {
-				continue
-			}
-			line = bytes.TrimPrefix(line, []byte("data:"))
-
-			var resp ChatMessageStreamChannelResponse
-			if err = json.Unmarshal(line, &resp); err != nil {
-				streamChannel <- ChatMessageStreamChannelResponse{
-					Err: fmt.Errorf("error unmarshalling event: %w", err),
-				}
-				return
-			}
-			streamChannel <- resp
 		}
 	}
+	if err := stream.Err(); err != nil && ctx.Err() == nil {
+		send(ChatMessageStreamChannelResponse{Err: err})
+	}
+}
+
+/* Stop a chat message stream
+ * Only supported in streaming mode. The request goes to the host that runs the task.
+ */
+func (api *API) StopChatMessages(ctx context.Context, req *StopRequest) (resp *StopResponse, err error) {
+	return api.stopTask(ctx, "/v1/chat-messages/%s/stop", req)
+}
+
+// stopTask sends a stop request for req.TaskID to the endpoint running it.
+func (api *API) stopTask(ctx context.Context, urlFormat string, req *StopRequest) (resp *StopResponse, err error) {
+	if req.TaskID == "" {
+		err = errors.New("StopRequest.TaskID Illegal")
+		return
+	}
+
+	httpReq, err := api.createBaseRequest(api.c.taskContext(ctx, req.TaskID), http.MethodPost, fmt.Sprintf(urlFormat, req.TaskID), req)
+	if err != nil {
+		return
+	}
+	err = api.c.sendJSONRequest(httpReq, &resp)
+	return
 }
@@ -0,0 +1,84 @@
+package dify
+
+import (
+	"context"
+	"net/http"
+)
+
+type CompletionMessageRequest struct {
+	Inputs       map[string]interface{} `json:"inputs"`
+	ResponseMode string                 `json:"response_mode"`
+	User         string                 `json:"user"`
+	Files        []FileInput            `json:"files,omitempty"`
+}
+
+type CompletionMessageResponse struct {
+	ID        string          `json:"id"`
+	MessageID string          `json:"message_id"`
+	Mode      string          `json:"mode"`
+	Answer    string          `json:"answer"`
+	CreatedAt int64           `json:"created_at"`
+	Metadata  MessageMetadata `json:"metadata"`
+}
+
+func (r *CompletionMessageResponse) tokenUsage() (Usage, bool) {
+	return r.Metadata.Usage, r.Metadata.Usage.TotalTokens > 0
+}
+
+/* Create completion message
+ * Send a request to the text generation application.
+ */
+func (api *API) CompletionMessages(ctx context.Context, req *CompletionMessageRequest) (resp *CompletionMessageResponse, err error) {
+	req.ResponseMode = "blocking"
+
+	httpReq, err := api.createBaseRequest(ctx, http.MethodPost, "/v1/completion-messages", req)
+	if err != nil {
+		return
+	}
+	err = api.c.sendJSONRequest(httpReq, &resp)
+	return
+}
+
+/* Stop a completion message stream
+ * Only supported in streaming mode. The request goes to the host that runs the task.
+ */
+func (api *API) StopCompletionMessages(ctx context.Context, req *StopRequest) (resp *StopResponse, err error) {
+	return api.stopTask(ctx, "/v1/completion-messages/%s/stop", req)
+}
+
+func (api *API) CompletionMessagesStreamRaw(ctx context.Context, req *CompletionMessageRequest) (*http.Response, error) {
+	req.ResponseMode = "streaming"
+
+	httpReq, err := api.createBaseRequest(ctx, http.MethodPost, "/v1/completion-messages", req)
+	if err != nil {
+		return nil, err
+	}
+	return api.c.sendStreamRequest(httpReq)
+}
+
+/* Create completion message in streaming mode
+ * Completion streams carry the same message events as chat streams, without a conversation.
+ */
+func (api *API) StreamCompletionMessages(ctx context.Context, req *CompletionMessageRequest, opts ...StreamOption) (*Stream[ChatMessageStreamResponse], error) {
+	options := api.streamOptions(opts)
+	httpResp, err := api.CompletionMessagesStreamRaw(options.watch(ctx), req)
+	if err != nil {
+		return nil, options.watchdog.fail(err)
+	}
+	decode := observeDecode(decodeChatMessageEvent, chatStreamTracer(responseTrace(httpResp)))
+	options.observe = streamObserver(httpResp)
+	return newStream(httpResp.Body, decode, options), nil
+}
+
+func (api *API) CompletionMessagesStream(ctx context.Context, req *CompletionMessageRequest, opts ...StreamOption) (chan ChatMessageStreamChannelResponse, error) {
+	streamChannel := make(chan ChatMessageStreamChannelResponse)
+	opts = append([]StreamOption{WithStreamErrorHandler(channelErrorHandler(ctx, streamChannel))}, opts...)
+
+	stream, err := api.StreamCompletionMessages(ctx, req, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	go api.chatMessagesStreamHandle(ctx, stream, streamChannel)
+	return streamChannel, nil
+}
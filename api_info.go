@@ -0,0 +1,37 @@
+package dify
+
+import (
+	"context"
+	"net/http"
+)
+
+// AppMode is the type of a Dify app, as reported by /v1/info.
+type AppMode string
+
+const (
+	AppModeChat         AppMode = "chat"
+	AppModeAgentChat    AppMode = "agent-chat"
+	AppModeAdvancedChat AppMode = "advanced-chat"
+	AppModeCompletion   AppMode = "completion"
+	AppModeWorkflow     AppMode = "workflow"
+)
+
+type InfoResponse struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+	Mode        AppMode  `json:"mode"`
+	AuthorName  string   `json:"author_name"`
+}
+
+/* Get application basic information
+ * Returns the name, description, tags and mode of the app the API secret belongs to.
+ */
+func (api *API) Info(ctx context.Context) (resp *InfoResponse, err error) {
+	httpReq, err := api.createBaseRequest(ctx, http.MethodGet, "/v1/info", nil)
+	if err != nil {
+		return
+	}
+	err = api.c.sendCachedJSONRequest(httpReq, &resp)
+	return
+}
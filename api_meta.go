@@ -0,0 +1,24 @@
+package dify
+
+import (
+	"context"
+	"net/http"
+)
+
+type MetaResponse struct {
+	// ToolIcons maps tool names to an icon URL, or to an object with the
+	// background and content of an emoji icon.
+	ToolIcons map[string]interface{} `json:"tool_icons"`
+}
+
+/* Get application meta information
+ * Returns the icons of the tools used by the app.
+ */
+func (api *API) Meta(ctx context.Context) (resp *MetaResponse, err error) {
+	httpReq, err := api.createBaseRequest(ctx, http.MethodGet, "/v1/meta", nil)
+	if err != nil {
+		return
+	}
+	err = api.c.sendCachedJSONRequest(httpReq, &resp)
+	return
+}
@@ -52,6 +52,6 @@ func (api *API) Parameters(ctx context.Context, req *ParametersRequest) (resp *P
 	query.Set("user", req.User)
 	httpReq.URL.RawQuery = query.Encode()
 
-	err = api.c.sendJSONRequest(httpReq, &resp)
+	err = api.c.sendCachedJSONRequest(httpReq, &resp)
 	return
 }
@@ -0,0 +1,35 @@
+package dify
+
+import (
+	"context"
+	"net/http"
+)
+
+type SiteResponse struct {
+	Title                  string `json:"title"`
+	ChatColorTheme         string `json:"chat_color_theme"`
+	ChatColorThemeInverted bool   `json:"chat_color_theme_inverted"`
+	IconType               string `json:"icon_type"`
+	Icon                   string `json:"icon"`
+	IconBackground         string `json:"icon_background"`
+	IconURL                string `json:"icon_url"`
+	Description            string `json:"description"`
+	Copyright              string `json:"copyright"`
+	PrivacyPolicy          string `json:"privacy_policy"`
+	CustomDisclaimer       string `json:"custom_disclaimer"`
+	DefaultLanguage        string `json:"default_language"`
+	ShowWorkflowSteps      bool   `json:"show_workflow_steps"`
+	UseIconAsAnswerIcon    bool   `json:"use_icon_as_answer_icon"`
+}
+
+/* Get application WebApp settings
+ * Returns the title, icon, theme and texts shown by the WebApp of the app.
+ */
+func (api *API) Site(ctx context.Context) (resp *SiteResponse, err error) {
+	httpReq, err := api.createBaseRequest(ctx, http.MethodGet, "/v1/site", nil)
+	if err != nil {
+		return
+	}
+	err = api.c.sendCachedJSONRequest(httpReq, &resp)
+	return
+}
@@ -1,9 +1,9 @@
 package dify
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -17,6 +17,23 @@ const (
 	EventWorkflowFinished = "workflow_finished"
 	EventTTSMessage       = "tts_message"
 	EventTTSMessageEnd    = "tts_message_end"
+
+	EventTextChunk              = "text_chunk"
+	EventIterationStarted       = "iteration_started"
+	EventIterationNext          = "iteration_next"
+	EventIterationCompleted     = "iteration_completed"
+	EventLoopStarted            = "loop_started"
+	EventLoopNext               = "loop_next"
+	EventLoopCompleted          = "loop_completed"
+	EventParallelBranchStarted  = "parallel_branch_started"
+	EventParallelBranchFinished = "parallel_branch_finished"
+	EventNodeRetry              = "node_retry"
+	EventAgentLog               = "agent_log"
+	EventMessage                = "message"
+	EventAgentMessage           = "agent_message"
+	EventMessageEnd             = "message_end"
+	EventError                  = "error"
+	EventPing                   = "ping"
 )
 
 // FileInput 结构体
@@ -67,18 +84,25 @@ type StreamingResponse struct {
 		Title             string                 `json:"title,omitempty"`
 		Index             int                    `json:"index"`
 		Predecessor       string                 `json:"predecessor_node_id,omitempty"`
-		Inputs            []interface{}          `json:"inputs,omitempty"`
+		Inputs            map[string]interface{} `json:"inputs,omitempty"`
 		Outputs           map[string]interface{} `json:"outputs,omitempty"`
 		Status            string                 `json:"status,omitempty"`
 		Error             string                 `json:"error,omitempty"`
 		ElapsedTime       float64                `json:"elapsed_time,omitempty"`
-		ExecutionMetadata struct {
-			TotalTokens int     `json:"total_tokens,omitempty"`
-			TotalPrice  float64 `json:"total_price,omitempty"`
-			Currency    string  `json:"currency,omitempty"`
-		} `json:"execution_metadata,omitempty"`
-		CreatedAt  int64 `json:"created_at"`
-		FinishedAt int64 `json:"finished_at,omitempty"`
+		ExecutionMetadata ExecutionMetadata      `json:"execution_metadata,omitempty"`
+		TotalTokens       int                    `json:"total_tokens,omitempty"`
+		TotalSteps        int                    `json:"total_steps,omitempty"`
+		CreatedAt         int64                  `json:"created_at"`
+		FinishedAt        int64                  `json:"finished_at,omitempty"`
+
+		// 节点位于迭代、循环或并行分支内时由 Dify 填充
+		IterationID               string `json:"iteration_id,omitempty"`
+		LoopID                    string `json:"loop_id,omitempty"`
+		ParallelID                string `json:"parallel_id,omitempty"`
+		ParallelStartNodeID       string `json:"parallel_start_node_id,omitempty"`
+		ParentParallelID          string `json:"parent_parallel_id,omitempty"`
+		ParentParallelStartNodeID string `json:"parent_parallel_start_node_id,omitempty"`
+		ParallelRunID             string `json:"parallel_run_id,omitempty"`
 	} `json:"data"`
 }
 
@@ -91,7 +115,37 @@ type TTSMessage struct {
 	CreatedAt int64  `json:"created_at"`
 }
 
+// ExecutionMetadata 节点、迭代和循环的执行元数据
+type ExecutionMetadata struct {
+	TotalTokens    int     `json:"total_tokens,omitempty"`
+	TotalPrice     float64 `json:"total_price,omitempty"`
+	Currency       string  `json:"currency,omitempty"`
+	IterationID    string  `json:"iteration_id,omitempty"`
+	IterationIndex int     `json:"iteration_index,omitempty"`
+	LoopID         string  `json:"loop_id,omitempty"`
+	LoopIndex      int     `json:"loop_index,omitempty"`
+	ParallelID     string  `json:"parallel_id,omitempty"`
+}
+
+// WorkflowStreamEvent 工作流流式事件，根据 Event 只设置其中一个载荷：
+// TTS 用于 tts_message(_end)，有类型载荷的事件设置对应字段，其余事件设置 Response
+type WorkflowStreamEvent struct {
+	Event    string
+	Response *StreamingResponse
+	TTS      *TTSMessage
+
+	TextChunk      *TextChunkEvent
+	Iteration      *IterationEvent
+	Loop           *LoopEvent
+	ParallelBranch *ParallelBranchEvent
+	NodeRetry      *NodeRetryEvent
+	AgentLog       *AgentLogEvent
+	Message        *MessageEvent
+}
+
 // EventHandler 接口
+// 处理器可以额外实现 TextChunkHandler、IterationHandler 等接口来接收有类型的事件，
+// 未实现对应接口的事件仍以 StreamingResponse 交给 HandleStreamingResponse
 type EventHandler interface {
 	HandleStreamingResponse(StreamingResponse)
 	HandleTTSMessage(TTSMessage)
@@ -100,6 +154,8 @@ type EventHandler interface {
 // DefaultEventHandler 结构体
 type DefaultEventHandler struct {
 	StreamHandler func(StreamingResponse)
+	// TTSHandler 可选，例如 TTSSink.HandleTTSMessage
+	TTSHandler func(TTSMessage)
 }
 
 func (h *DefaultEventHandler) HandleStreamingResponse(resp StreamingResponse) {
@@ -109,7 +165,10 @@ func (h *DefaultEventHandler) HandleStreamingResponse(resp StreamingResponse) {
 }
 
 func (h *DefaultEventHandler) HandleTTSMessage(msg TTSMessage) {
-	// 默认实现为空，如果用户不关心 TTS 消息可以忽略
+	// 未设置 TTSHandler 时忽略，如果用户不关心 TTS 消息可以忽略
+	if h.TTSHandler != nil {
+		h.TTSHandler(msg)
+	}
 }
 
 // RunWorkflow 方法
@@ -119,92 +178,106 @@ func (api *API) RunWorkflow(ctx context.Context, request WorkflowRequest) (*Work
 		return nil, fmt.Errorf("failed to create base request: %w", err)
 	}
 
-	resp, err := api.c.sendRequest(req)
+	// 工作流运行不是幂等的，只在连接失败时重试
+	resp, err := api.c.sendRequest(req, retryConnectionOnly)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API request failed with status %s: %s", resp.Status, readResponseBody(resp.Body))
+	if err := checkResponse(req, resp); err != nil {
+		return nil, err
 	}
 
 	var workflowResp WorkflowResponse
 	if err := json.NewDecoder(resp.Body).Decode(&workflowResp); err != nil {
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
+	if ct := responseTrace(resp); ct != nil {
+		ct.recordUsage(Usage{TotalTokens: workflowResp.Data.TotalTokens})
+	}
 
 	return &workflowResp, nil
 }
 
+// StopWorkflow 停止流式运行中的工作流任务，请求发往运行该任务的 host
+func (api *API) StopWorkflow(ctx context.Context, req *StopRequest) (*StopResponse, error) {
+	return api.stopTask(ctx, "/v1/workflows/tasks/%s/stop", req)
+}
+
 // RunStreamWorkflow 方法
-func (api *API) RunStreamWorkflow(ctx context.Context, request WorkflowRequest, handler func(StreamingResponse)) error {
-	return api.RunStreamWorkflowWithHandler(ctx, request, &DefaultEventHandler{StreamHandler: handler})
+func (api *API) RunStreamWorkflow(ctx context.Context, request WorkflowRequest, handler func(StreamingResponse), opts ...StreamOption) error {
+	return api.RunStreamWorkflowWithHandler(ctx, request, &DefaultEventHandler{StreamHandler: handler}, opts...)
+}
+
+// StreamWorkflow 以流式模式运行工作流，返回的 Stream 需要调用方读完或 Close
+// 服务端的 error 事件会结束 Stream，Err 返回 *StreamError
+func (api *API) StreamWorkflow(ctx context.Context, request WorkflowRequest, opts ...StreamOption) (*Stream[WorkflowStreamEvent], error) {
+	return api.streamWorkflow(ctx, request, decodeAllTyped, api.streamOptions(opts))
 }
 
 // RunStreamWorkflowWithHandler 方法
-func (api *API) RunStreamWorkflowWithHandler(ctx context.Context, request WorkflowRequest, handler EventHandler) error {
-	req, err := api.createBaseRequest(ctx, http.MethodPost, "/v1/workflows/run", request)
+// 服务端的 error 事件以 *StreamError 返回；格式错误的事件会被跳过，handler 实现 ErrorHandler 时会收到它们
+func (api *API) RunStreamWorkflowWithHandler(ctx context.Context, request WorkflowRequest, handler EventHandler, opts ...StreamOption) error {
+	if h, ok := handler.(ErrorHandler); ok {
+		opts = append([]StreamOption{WithStreamErrorHandler(h.HandleStreamError)}, opts...)
+	}
+	stream, err := api.streamWorkflow(ctx, request, handlerWantsTyped(handler), api.streamOptions(opts))
 	if err != nil {
 		return err
 	}
+	return handleWorkflowStream(stream, handler)
+}
 
-	resp, err := api.c.sendRequest(req)
+func (api *API) streamWorkflow(ctx context.Context, request WorkflowRequest, typed func(eventType string) bool, options streamOptions) (*Stream[WorkflowStreamEvent], error) {
+	request.ResponseMode = "streaming"
+
+	req, err := api.createBaseRequest(options.watch(ctx), http.MethodPost, "/v1/workflows/run", request)
 	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		return nil, options.watchdog.fail(err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("API request failed with status %s: %s", resp.Status, readResponseBody(resp.Body))
+	resp, err := api.c.sendStreamRequest(req)
+	if err != nil {
+		return nil, options.watchdog.fail(err)
 	}
 
-	reader := bufio.NewReader(resp.Body)
-	for {
-		line, err := reader.ReadBytes('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return fmt.Errorf("error reading streaming response: %w", err)
-		}
+	decode := observeDecode(workflowEventDecoder(typed), workflowStreamTracer(responseTrace(resp)))
+	options.observe = streamObserver(resp)
+	return newStream(resp.Body, decode, options), nil
+}
 
-		if len(line) > 6 && string(line[:6]) == "data: " {
-			var event struct {
-				Event string `json:"event"`
-			}
-			if err := json.Unmarshal(line[6:], &event); err != nil {
-				fmt.Println("Error decoding event type:", err)
-				continue
-			}
-
-			switch event.Event {
-			case EventTTSMessage, EventTTSMessageEnd:
-				var ttsMsg TTSMessage
-				if err := json.Unmarshal(line[6:], &ttsMsg); err != nil {
-					fmt.Println("Error decoding TTS message:", err)
-					continue
-				}
-				handler.HandleTTSMessage(ttsMsg)
-			default:
-				var streamResp StreamingResponse
-				if err := json.Unmarshal(line[6:], &streamResp); err != nil {
-					fmt.Println("Error decoding streaming response:", err)
-					continue
-				}
-				handler.HandleStreamingResponse(streamResp)
-			}
-		}
+// decodeWorkflowStream 逐个解析事件并交给 handler
+func decodeWorkflowStream(r io.Reader, handler EventHandler, opts ...StreamOption) error {
+	var options streamOptions
+	if h, ok := handler.(ErrorHandler); ok {
+		options.onError = h.HandleStreamError
 	}
-
-	return nil
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return handleWorkflowStream(newStream(io.NopCloser(r), workflowEventDecoder(handlerWantsTyped(handler)), options), handler)
 }
 
-// readResponseBody 辅助函数
-func readResponseBody(body io.Reader) string {
-	bodyBytes, err := io.ReadAll(body)
-	if err != nil {
-		return fmt.Sprintf("failed to read response body: %v", err)
+func handleWorkflowStream(stream *Stream[WorkflowStreamEvent], handler EventHandler) error {
+	defer stream.Close()
+
+	for stream.Next() {
+		dispatchWorkflowEvent(handler, stream.Current())
+	}
+
+	err := stream.Err()
+	var streamErr *StreamError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &streamErr):
+		if h, ok := handler.(ErrorEventHandler); ok {
+			h.HandleError(streamErr.event())
+		}
+		return err
+	case isMalformedEventError(err):
+		return err
 	}
-	return string(bodyBytes)
+	return fmt.Errorf("error reading streaming response: %w", err)
 }
@@ -0,0 +1,319 @@
+package dify
+
+import "encoding/json"
+
+// WorkflowEventHeader 工作流事件的公共字段
+type WorkflowEventHeader struct {
+	Event         string `json:"event"`
+	TaskID        string `json:"task_id"`
+	WorkflowRunID string `json:"workflow_run_id"`
+}
+
+// TextChunkEvent 文本片段事件 (text_chunk)
+type TextChunkEvent struct {
+	WorkflowEventHeader
+	Data struct {
+		Text                 string   `json:"text"`
+		FromVariableSelector []string `json:"from_variable_selector"`
+	} `json:"data"`
+}
+
+// IterationEvent 迭代事件 (iteration_started / iteration_next / iteration_completed)
+type IterationEvent struct {
+	WorkflowEventHeader
+	Data struct {
+		ID                 string                 `json:"id"`
+		NodeID             string                 `json:"node_id"`
+		NodeType           string                 `json:"node_type"`
+		Title              string                 `json:"title"`
+		Index              int                    `json:"index"`
+		Inputs             map[string]interface{} `json:"inputs,omitempty"`
+		Outputs            map[string]interface{} `json:"outputs,omitempty"`
+		Metadata           map[string]interface{} `json:"metadata,omitempty"`
+		PreIterationOutput interface{}            `json:"pre_iteration_output,omitempty"`
+		ParallelModeRunID  string                 `json:"parallel_mode_run_id,omitempty"`
+		Duration           float64                `json:"duration,omitempty"`
+		Status             string                 `json:"status,omitempty"`
+		Error              string                 `json:"error,omitempty"`
+		ElapsedTime        float64                `json:"elapsed_time,omitempty"`
+		TotalTokens        int                    `json:"total_tokens,omitempty"`
+		Steps              int                    `json:"steps,omitempty"`
+		ExecutionMetadata  ExecutionMetadata      `json:"execution_metadata,omitempty"`
+		CreatedAt          int64                  `json:"created_at"`
+		FinishedAt         int64                  `json:"finished_at,omitempty"`
+	} `json:"data"`
+}
+
+// LoopEvent 循环事件 (loop_started / loop_next / loop_completed)
+type LoopEvent struct {
+	WorkflowEventHeader
+	Data struct {
+		ID                string                 `json:"id"`
+		NodeID            string                 `json:"node_id"`
+		NodeType          string                 `json:"node_type"`
+		Title             string                 `json:"title"`
+		Index             int                    `json:"index"`
+		Inputs            map[string]interface{} `json:"inputs,omitempty"`
+		Outputs           map[string]interface{} `json:"outputs,omitempty"`
+		Metadata          map[string]interface{} `json:"metadata,omitempty"`
+		PreLoopOutput     interface{}            `json:"pre_loop_output,omitempty"`
+		ParallelModeRunID string                 `json:"parallel_mode_run_id,omitempty"`
+		Status            string                 `json:"status,omitempty"`
+		Error             string                 `json:"error,omitempty"`
+		ElapsedTime       float64                `json:"elapsed_time,omitempty"`
+		TotalTokens       int                    `json:"total_tokens,omitempty"`
+		Steps             int                    `json:"steps,omitempty"`
+		ExecutionMetadata ExecutionMetadata      `json:"execution_metadata,omitempty"`
+		CreatedAt         int64                  `json:"created_at"`
+		FinishedAt        int64                  `json:"finished_at,omitempty"`
+	} `json:"data"`
+}
+
+// ParallelBranchEvent 并行分支事件 (parallel_branch_started / parallel_branch_finished)
+type ParallelBranchEvent struct {
+	WorkflowEventHeader
+	Data struct {
+		ParallelID                string `json:"parallel_id"`
+		ParallelStartNodeID       string `json:"parallel_start_node_id"`
+		ParentParallelID          string `json:"parent_parallel_id,omitempty"`
+		ParentParallelStartNodeID string `json:"parent_parallel_start_node_id,omitempty"`
+		IterationID               string `json:"iteration_id,omitempty"`
+		LoopID                    string `json:"loop_id,omitempty"`
+		Status                    string `json:"status,omitempty"`
+		Error                     string `json:"error,omitempty"`
+		CreatedAt                 int64  `json:"created_at"`
+	} `json:"data"`
+}
+
+// NodeRetryEvent 节点重试事件 (node_retry)
+type NodeRetryEvent struct {
+	WorkflowEventHeader
+	Data struct {
+		ID                string                 `json:"id"`
+		NodeID            string                 `json:"node_id"`
+		NodeType          string                 `json:"node_type"`
+		Title             string                 `json:"title"`
+		Index             int                    `json:"index"`
+		Predecessor       string                 `json:"predecessor_node_id,omitempty"`
+		Inputs            map[string]interface{} `json:"inputs,omitempty"`
+		Outputs           map[string]interface{} `json:"outputs,omitempty"`
+		Status            string                 `json:"status,omitempty"`
+		Error             string                 `json:"error,omitempty"`
+		ElapsedTime       float64                `json:"elapsed_time,omitempty"`
+		ExecutionMetadata ExecutionMetadata      `json:"execution_metadata,omitempty"`
+		RetryIndex        int                    `json:"retry_index"`
+		IterationID       string                 `json:"iteration_id,omitempty"`
+		LoopID            string                 `json:"loop_id,omitempty"`
+		ParallelID        string                 `json:"parallel_id,omitempty"`
+		CreatedAt         int64                  `json:"created_at"`
+		FinishedAt        int64                  `json:"finished_at,omitempty"`
+	} `json:"data"`
+}
+
+// AgentLogEvent Agent 节点日志事件 (agent_log)
+type AgentLogEvent struct {
+	WorkflowEventHeader
+	Data struct {
+		ID              string                 `json:"id"`
+		NodeID          string                 `json:"node_id"`
+		NodeExecutionID string                 `json:"node_execution_id"`
+		ParentID        string                 `json:"parent_id,omitempty"`
+		Label           string                 `json:"label"`
+		Status          string                 `json:"status"`
+		Error           string                 `json:"error,omitempty"`
+		Data            map[string]interface{} `json:"data,omitempty"`
+		Metadata        map[string]interface{} `json:"metadata,omitempty"`
+	} `json:"data"`
+}
+
+// MessageEvent 消息事件 (message)，由对话型工作流输出
+type MessageEvent struct {
+	Event          string `json:"event"`
+	TaskID         string `json:"task_id"`
+	MessageID      string `json:"message_id"`
+	ConversationID string `json:"conversation_id,omitempty"`
+	Answer         string `json:"answer"`
+	CreatedAt      int64  `json:"created_at"`
+}
+
+// ErrorEvent 服务端在流中返回的错误事件 (error)
+type ErrorEvent struct {
+	Event     string `json:"event"`
+	TaskID    string `json:"task_id"`
+	MessageID string `json:"message_id,omitempty"`
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+}
+
+// TextChunkHandler 可选接口，接收 text_chunk 事件
+type TextChunkHandler interface {
+	HandleTextChunk(TextChunkEvent)
+}
+
+// IterationHandler 可选接口，接收 iteration_* 事件
+type IterationHandler interface {
+	HandleIteration(IterationEvent)
+}
+
+// LoopHandler 可选接口，接收 loop_* 事件
+type LoopHandler interface {
+	HandleLoop(LoopEvent)
+}
+
+// ParallelBranchHandler 可选接口，接收 parallel_branch_* 事件
+type ParallelBranchHandler interface {
+	HandleParallelBranch(ParallelBranchEvent)
+}
+
+// NodeRetryHandler 可选接口，接收 node_retry 事件
+type NodeRetryHandler interface {
+	HandleNodeRetry(NodeRetryEvent)
+}
+
+// AgentLogHandler 可选接口，接收 agent_log 事件
+type AgentLogHandler interface {
+	HandleAgentLog(AgentLogEvent)
+}
+
+// MessageHandler 可选接口，接收 message 事件
+type MessageHandler interface {
+	HandleMessage(MessageEvent)
+}
+
+// ErrorEventHandler 可选接口，接收 error 事件；流随后以 *StreamError 结束
+type ErrorEventHandler interface {
+	HandleError(ErrorEvent)
+}
+
+// ErrorHandler 可选接口，接收被跳过的格式错误事件 (*StreamDecodeError 或 *StreamProtocolError)；
+// 启用严格模式时这些事件会结束流，不会交给它
+type ErrorHandler interface {
+	HandleStreamError(error)
+}
+
+// typedPayload 为有类型载荷的事件分配载荷并返回其指针，其余事件返回 nil
+func typedPayload(ev *WorkflowStreamEvent) interface{} {
+	switch ev.Event {
+	case EventTextChunk:
+		ev.TextChunk = new(TextChunkEvent)
+		return ev.TextChunk
+	case EventIterationStarted, EventIterationNext, EventIterationCompleted:
+		ev.Iteration = new(IterationEvent)
+		return ev.Iteration
+	case EventLoopStarted, EventLoopNext, EventLoopCompleted:
+		ev.Loop = new(LoopEvent)
+		return ev.Loop
+	case EventParallelBranchStarted, EventParallelBranchFinished:
+		ev.ParallelBranch = new(ParallelBranchEvent)
+		return ev.ParallelBranch
+	case EventNodeRetry:
+		ev.NodeRetry = new(NodeRetryEvent)
+		return ev.NodeRetry
+	case EventAgentLog:
+		ev.AgentLog = new(AgentLogEvent)
+		return ev.AgentLog
+	case EventMessage:
+		ev.Message = new(MessageEvent)
+		return ev.Message
+	}
+	return nil
+}
+
+// decodeAllTyped 所有有类型载荷的事件都解码为对应类型
+func decodeAllTyped(string) bool {
+	return true
+}
+
+// handlerWantsTyped 只为 handler 实现了对应接口的事件解码有类型载荷
+func handlerWantsTyped(handler EventHandler) func(eventType string) bool {
+	_, textChunk := handler.(TextChunkHandler)
+	_, iteration := handler.(IterationHandler)
+	_, loop := handler.(LoopHandler)
+	_, parallelBranch := handler.(ParallelBranchHandler)
+	_, nodeRetry := handler.(NodeRetryHandler)
+	_, agentLog := handler.(AgentLogHandler)
+	_, message := handler.(MessageHandler)
+
+	return func(eventType string) bool {
+		switch eventType {
+		case EventTextChunk:
+			return textChunk
+		case EventIterationStarted, EventIterationNext, EventIterationCompleted:
+			return iteration
+		case EventLoopStarted, EventLoopNext, EventLoopCompleted:
+			return loop
+		case EventParallelBranchStarted, EventParallelBranchFinished:
+			return parallelBranch
+		case EventNodeRetry:
+			return nodeRetry
+		case EventAgentLog:
+			return agentLog
+		case EventMessage:
+			return message
+		}
+		return false
+	}
+}
+
+// workflowEventDecoder 先读取事件类型，再只反序列化一次：
+// typed 返回 true 的事件解码为有类型载荷，其余解码为 StreamingResponse，error 事件转换为 *StreamError
+func workflowEventDecoder(typed func(eventType string) bool) func(sseEvent) (WorkflowStreamEvent, bool, error) {
+	return func(event sseEvent) (WorkflowStreamEvent, bool, error) {
+		ev := WorkflowStreamEvent{Event: peekEventType(event.Data)}
+
+		switch ev.Event {
+		case EventError:
+			return WorkflowStreamEvent{}, false, decodeStreamError(event)
+		case EventTTSMessage, EventTTSMessageEnd:
+			ev.TTS = new(TTSMessage)
+			if err := json.Unmarshal(event.Data, ev.TTS); err != nil {
+				return WorkflowStreamEvent{}, false, newStreamDecodeError(event, ev.Event, err)
+			}
+			return ev, true, nil
+		}
+
+		if typed(ev.Event) {
+			if payload := typedPayload(&ev); payload != nil {
+				if err := json.Unmarshal(event.Data, payload); err != nil {
+					return WorkflowStreamEvent{}, false, newStreamDecodeError(event, ev.Event, err)
+				}
+				return ev, true, nil
+			}
+		}
+
+		ev.Response = new(StreamingResponse)
+		if err := json.Unmarshal(event.Data, ev.Response); err != nil {
+			return WorkflowStreamEvent{}, false, newStreamDecodeError(event, ev.Event, err)
+		}
+		if ev.Response.Event == "" {
+			return WorkflowStreamEvent{}, false, newStreamProtocolError(event, "event has no type")
+		}
+		ev.Event = ev.Response.Event
+		return ev, true, nil
+	}
+}
+
+// dispatchWorkflowEvent 把事件交给 handler；有类型载荷只会在 handler 实现了对应接口时出现
+func dispatchWorkflowEvent(handler EventHandler, ev WorkflowStreamEvent) {
+	switch {
+	case ev.TTS != nil:
+		handler.HandleTTSMessage(*ev.TTS)
+	case ev.Response != nil:
+		handler.HandleStreamingResponse(*ev.Response)
+	case ev.TextChunk != nil:
+		handler.(TextChunkHandler).HandleTextChunk(*ev.TextChunk)
+	case ev.Iteration != nil:
+		handler.(IterationHandler).HandleIteration(*ev.Iteration)
+	case ev.Loop != nil:
+		handler.(LoopHandler).HandleLoop(*ev.Loop)
+	case ev.ParallelBranch != nil:
+		handler.(ParallelBranchHandler).HandleParallelBranch(*ev.ParallelBranch)
+	case ev.NodeRetry != nil:
+		handler.(NodeRetryHandler).HandleNodeRetry(*ev.NodeRetry)
+	case ev.AgentLog != nil:
+		handler.(AgentLogHandler).HandleAgentLog(*ev.AgentLog)
+	case ev.Message != nil:
+		handler.(MessageHandler).HandleMessage(*ev.Message)
+	}
+}
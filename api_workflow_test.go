@@ -0,0 +1,302 @@
+package dify
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDecodeWorkflowStream(t *testing.T) {
+	var (
+		events []string
+		tts    int
+	)
+	handler := &recordingEventHandler{
+		onStreamingResponse: func(resp StreamingResponse) { events = append(events, resp.Event) },
+		onTTSMessage:        func(TTSMessage) { tts++ },
+	}
+	if err := decodeWorkflowStream(bytes.NewReader(benchmarkWorkflowStream(3)), handler); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{EventWorkflowStarted, EventNodeStarted, "text_chunk", "text_chunk", "text_chunk", EventNodeFinished, EventWorkflowFinished}
+	if strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Errorf("events = %v, want %v", events, want)
+	}
+	if tts != 2 {
+		t.Errorf("got %d tts messages, want 2", tts)
+	}
+}
+
+type typedEventHandler struct {
+	recordingEventHandler
+	chunks     []string
+	iterations []string
+	errors     []ErrorEvent
+}
+
+func (h *typedEventHandler) HandleTextChunk(ev TextChunkEvent) {
+	h.chunks = append(h.chunks, ev.Data.Text)
+}
+
+func (h *typedEventHandler) HandleIteration(ev IterationEvent) {
+	h.iterations = append(h.iterations, fmt.Sprintf("%s:%d", ev.Event, ev.Data.Index))
+}
+
+func (h *typedEventHandler) HandleError(ev ErrorEvent) {
+	h.errors = append(h.errors, ev)
+}
+
+func TestDecodeWorkflowStreamTypedHandlers(t *testing.T) {
+	stream := strings.Join([]string{
+		`data: {"event":"workflow_started","task_id":"t","workflow_run_id":"r","data":{"id":"r","inputs":{"q":"hi"}}}`,
+		`data: {"event":"iteration_started","task_id":"t","workflow_run_id":"r","data":{"id":"i","node_id":"it","node_type":"iteration","title":"Loop","inputs":{"items":[1,2]}}}`,
+		`data: {"event":"iteration_next","task_id":"t","workflow_run_id":"r","data":{"id":"i","node_id":"it","index":1,"pre_iteration_output":["a"]}}`,
+		`data: {"event":"iteration_completed","task_id":"t","workflow_run_id":"r","data":{"id":"i","node_id":"it","steps":2,"status":"succeeded"}}`,
+		`data: {"event":"text_chunk","task_id":"t","workflow_run_id":"r","data":{"text":"hello","from_variable_selector":["llm","text"]}}`,
+		`data: {"event":"loop_started","task_id":"t","workflow_run_id":"r","data":{"id":"l","node_id":"lp"}}`,
+		`data: {"event":"error","task_id":"t","status":400,"code":"invalid_param","message":"bad"}`,
+	}, "\n\n") + "\n\n"
+
+	var flat []string
+	handler := &typedEventHandler{}
+	handler.onStreamingResponse = func(resp StreamingResponse) {
+		flat = append(flat, resp.Event)
+		if resp.Event == EventWorkflowStarted && resp.Data.Inputs["q"] != "hi" {
+			t.Errorf("workflow_started inputs = %v", resp.Data.Inputs)
+		}
+	}
+	err := decodeWorkflowStream(strings.NewReader(stream), handler)
+	var streamErr *StreamError
+	if !errors.As(err, &streamErr) || streamErr.Code != "invalid_param" || streamErr.Status != 400 {
+		t.Fatalf("err = %v, want *StreamError", err)
+	}
+
+	// Events without an opted-in handler still arrive as StreamingResponse.
+	if want := "workflow_started,loop_started"; strings.Join(flat, ",") != want {
+		t.Errorf("flat events = %v, want %s", flat, want)
+	}
+	if strings.Join(handler.chunks, ",") != "hello" {
+		t.Errorf("chunks = %v", handler.chunks)
+	}
+	if want := "iteration_started:0,iteration_next:1,iteration_completed:0"; strings.Join(handler.iterations, ",") != want {
+		t.Errorf("iterations = %v, want %s", handler.iterations, want)
+	}
+	if len(handler.errors) != 1 || handler.errors[0].Code != "invalid_param" || handler.errors[0].Status != 400 {
+		t.Errorf("errors = %+v", handler.errors)
+	}
+}
+
+type streamErrorHandler struct {
+	recordingEventHandler
+	errs []error
+}
+
+func (h *streamErrorHandler) HandleStreamError(err error) {
+	h.errs = append(h.errs, err)
+}
+
+func TestDecodeWorkflowStreamMalformedEvents(t *testing.T) {
+	stream := strings.Join([]string{
+		`data: {"event":"workflow_started","data":{"id":"r"}}`,
+		`data: {"event":"node_started","data":{"index":"one"}}`,
+		`data: {"data":{"id":"n"}}`,
+		`data: {"event":"workflow_finished","data":{"id":"r"}}`,
+	}, "\n\n") + "\n\n"
+
+	t.Run("lenient", func(t *testing.T) {
+		var events []string
+		handler := &streamErrorHandler{}
+		handler.onStreamingResponse = func(resp StreamingResponse) { events = append(events, resp.Event) }
+		if err := decodeWorkflowStream(strings.NewReader(stream), handler); err != nil {
+			t.Fatal(err)
+		}
+		if want := "workflow_started,workflow_finished"; strings.Join(events, ",") != want {
+			t.Errorf("events = %v, want %s", events, want)
+		}
+		if len(handler.errs) != 2 {
+			t.Fatalf("errs = %v, want 2", handler.errs)
+		}
+		var decodeErr *StreamDecodeError
+		if !errors.As(handler.errs[0], &decodeErr) || decodeErr.Event != EventNodeStarted || !strings.Contains(string(decodeErr.Raw), `"one"`) {
+			t.Errorf("errs[0] = %#v", handler.errs[0])
+		}
+		var protocolErr *StreamProtocolError
+		if !errors.As(handler.errs[1], &protocolErr) || string(protocolErr.Raw) != `{"data":{"id":"n"}}` {
+			t.Errorf("errs[1] = %#v", handler.errs[1])
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		handler := &streamErrorHandler{}
+		err := decodeWorkflowStream(strings.NewReader(stream), handler, WithStrictDecoding(true))
+		var decodeErr *StreamDecodeError
+		if !errors.As(err, &decodeErr) {
+			t.Fatalf("err = %v, want *StreamDecodeError", err)
+		}
+		if len(handler.errs) != 0 {
+			t.Errorf("handler called in strict mode: %v", handler.errs)
+		}
+	})
+
+	t.Run("no handler", func(t *testing.T) {
+		var events []string
+		handler := &DefaultEventHandler{StreamHandler: func(resp StreamingResponse) { events = append(events, resp.Event) }}
+		if err := decodeWorkflowStream(strings.NewReader(stream), handler); err != nil {
+			t.Fatal(err)
+		}
+		if want := "workflow_started,workflow_finished"; strings.Join(events, ",") != want {
+			t.Errorf("events = %v, want %s", events, want)
+		}
+	})
+}
+
+func TestWorkflowEventDecoderAllTyped(t *testing.T) {
+	decode := workflowEventDecoder(decodeAllTyped)
+	tests := []struct {
+		data  string
+		check func(WorkflowStreamEvent) bool
+	}{
+		{`{"event":"node_started","data":{"node_id":"n"}}`, func(ev WorkflowStreamEvent) bool { return ev.Response != nil && ev.Response.Data.NodeID == "n" }},
+		{`{"event":"tts_message","audio":"AA=="}`, func(ev WorkflowStreamEvent) bool { return ev.TTS != nil && ev.TTS.Audio == "AA==" }},
+		{`{"event":"text_chunk","data":{"text":"x"}}`, func(ev WorkflowStreamEvent) bool { return ev.TextChunk != nil && ev.TextChunk.Data.Text == "x" }},
+		{`{"event":"loop_next","data":{"index":2}}`, func(ev WorkflowStreamEvent) bool { return ev.Loop != nil && ev.Loop.Data.Index == 2 }},
+		{`{"event":"parallel_branch_started","data":{"parallel_id":"p"}}`, func(ev WorkflowStreamEvent) bool {
+			return ev.ParallelBranch != nil && ev.ParallelBranch.Data.ParallelID == "p"
+		}},
+		{`{"event":"node_retry","data":{"retry_index":1}}`, func(ev WorkflowStreamEvent) bool { return ev.NodeRetry != nil && ev.NodeRetry.Data.RetryIndex == 1 }},
+		{`{"event":"agent_log","data":{"label":"think"}}`, func(ev WorkflowStreamEvent) bool { return ev.AgentLog != nil && ev.AgentLog.Data.Label == "think" }},
+		{`{"event":"message","answer":"hi"}`, func(ev WorkflowStreamEvent) bool { return ev.Message != nil && ev.Message.Answer == "hi" }},
+		{`{"event":"something_new","data":{"id":"x"}}`, func(ev WorkflowStreamEvent) bool { return ev.Response != nil && ev.Response.Data.ID == "x" }},
+	}
+	for _, tt := range tests {
+		ev, ok, err := decode(sseEvent{Data: []byte(tt.data)})
+		if err != nil || !ok || !tt.check(ev) {
+			t.Errorf("decode(%s) = %+v, %v, %v", tt.data, ev, ok, err)
+		}
+	}
+}
+
+// BenchmarkDecodeWorkflowStream compares the current decoder against the
+// previous line-based implementation, which read every line into a new buffer
+// and unmarshalled each event twice.
+func BenchmarkDecodeWorkflowStream(b *testing.B) {
+	stream := benchmarkWorkflowStream(1000)
+	handler := &DefaultEventHandler{}
+
+	b.Run("legacy", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(stream)))
+		for i := 0; i < b.N; i++ {
+			if err := legacyDecodeWorkflowStream(bytes.NewReader(stream), handler); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("single-pass", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(stream)))
+		for i := 0; i < b.N; i++ {
+			if err := decodeWorkflowStream(bytes.NewReader(stream), handler); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSSEDecoder(b *testing.B) {
+	stream := benchmarkWorkflowStream(1000)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(stream)))
+	for i := 0; i < b.N; i++ {
+		d := newSSEDecoder(bytes.NewReader(stream))
+		for {
+			if _, err := d.Next(); err != nil {
+				if err != io.EOF {
+					b.Fatal(err)
+				}
+				break
+			}
+		}
+	}
+}
+
+func legacyDecodeWorkflowStream(r io.Reader, handler EventHandler) error {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		if len(line) > 6 && string(line[:6]) == "data: " {
+			var event struct {
+				Event string `json:"event"`
+			}
+			if err := json.Unmarshal(line[6:], &event); err != nil {
+				continue
+			}
+			switch event.Event {
+			case EventTTSMessage, EventTTSMessageEnd:
+				var ttsMsg TTSMessage
+				if err := json.Unmarshal(line[6:], &ttsMsg); err != nil {
+					continue
+				}
+				handler.HandleTTSMessage(ttsMsg)
+			default:
+				var streamResp StreamingResponse
+				if err := json.Unmarshal(line[6:], &streamResp); err != nil {
+					continue
+				}
+				handler.HandleStreamingResponse(streamResp)
+			}
+		}
+	}
+	return nil
+}
+
+// benchmarkWorkflowStream builds a workflow stream dominated by text_chunk
+// events, framed the way Dify sends them.
+func benchmarkWorkflowStream(chunks int) []byte {
+	var buf bytes.Buffer
+	write := func(s string) {
+		buf.WriteString("data: ")
+		buf.WriteString(s)
+		buf.WriteString("\n\n")
+	}
+	write(`{"event":"workflow_started","task_id":"5ad4cb98","workflow_run_id":"5ad498f0","data":{"id":"5ad498f0","workflow_id":"dfjasklfjdslag","sequence_number":1,"created_at":1679586595}}`)
+	write(`{"event":"node_started","task_id":"5ad4cb98","workflow_run_id":"5ad498f0","data":{"id":"5ad498f0","node_id":"llm","node_type":"llm","title":"LLM","index":1,"predecessor_node_id":"start","created_at":1679586595}}`)
+	for i := 0; i < chunks; i++ {
+		write(fmt.Sprintf(`{"event":"text_chunk","task_id":"5ad4cb98","workflow_run_id":"5ad498f0","data":{"text":"token %d ","from_variable_selector":["llm","text"]}}`, i))
+	}
+	buf.WriteString("event: ping\n\n")
+	write(`{"event":"tts_message","task_id":"5ad4cb98","message_id":"m1","audio":"qqqq","created_at":1679586595}`)
+	write(`{"event":"tts_message_end","task_id":"5ad4cb98","message_id":"m1","audio":"","created_at":1679586595}`)
+	write(`{"event":"node_finished","task_id":"5ad4cb98","workflow_run_id":"5ad498f0","data":{"id":"5ad498f0","node_id":"llm","node_type":"llm","title":"LLM","index":1,"status":"succeeded","elapsed_time":0.32,"execution_metadata":{"total_tokens":63,"total_price":0.0001,"currency":"USD"},"created_at":1679586595}}`)
+	write(`{"event":"workflow_finished","task_id":"5ad4cb98","workflow_run_id":"5ad498f0","data":{"id":"5ad498f0","workflow_id":"dfjasklfjdslag","status":"succeeded","outputs":{"text":"done"},"elapsed_time":0.32,"created_at":1679586595,"finished_at":1679976595}}`)
+	return buf.Bytes()
+}
+
+type recordingEventHandler struct {
+	onStreamingResponse func(StreamingResponse)
+	onTTSMessage        func(TTSMessage)
+}
+
+func (h *recordingEventHandler) HandleStreamingResponse(resp StreamingResponse) {
+	if h.onStreamingResponse != nil {
+		h.onStreamingResponse(resp)
+	}
+}
+
+func (h *recordingEventHandler) HandleTTSMessage(msg TTSMessage) {
+	if h.onTTSMessage != nil {
+		h.onTTSMessage(msg)
+	}
+}
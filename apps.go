@@ -0,0 +1,198 @@
+package dify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrUnknownApp and ErrUnknownDataset are returned by Client.App and
+// Client.DatasetKey for names that were not configured.
+var (
+	ErrUnknownApp     = errors.New("dify: unknown app")
+	ErrUnknownDataset = errors.New("dify: unknown dataset")
+)
+
+// AppConfig declares an app of the registry.
+type AppConfig struct {
+	// Secret, or SecretProvider for a secret that is rotated, authenticates
+	// the calls of the app. SecretProvider is used when both are set.
+	Secret         string
+	SecretProvider SecretProvider
+	// Mode is the expected mode of the app, checked by Client.VerifyApps.
+	// Apps without a mode are not checked.
+	Mode AppMode
+}
+
+// App is a handle on a registered app. It never changes and is safe to
+// share between goroutines.
+type App struct {
+	c        *Client
+	name     string
+	secret   string
+	provider SecretProvider
+	mode     AppMode
+}
+
+func (a *App) Name() string { return a.name }
+
+// Mode is the declared mode of the app.
+func (a *App) Mode() AppMode { return a.mode }
+
+// API returns a new API using the secret of the app. Unlike a shared API
+// changed with WithSecret, it can be used by one goroutine while others
+// call other apps.
+func (a *App) API() *API {
+	return &API{c: a.c, secret: a.secret, provider: a.provider, app: a}
+}
+
+type appKey struct{}
+
+// withApp marks the calls of ctx as calls of app.
+func withApp(ctx context.Context, app *App) context.Context {
+	return context.WithValue(ctx, appKey{}, app)
+}
+
+func appFromContext(ctx context.Context) *App {
+	app, _ := ctx.Value(appKey{}).(*App)
+	return app
+}
+
+// AppModeError reports an app whose secret belongs to an app of another
+// mode than declared.
+type AppModeError struct {
+	App      string
+	Expected AppMode
+	Actual   AppMode
+}
+
+func (e *AppModeError) Error() string {
+	return fmt.Sprintf("dify: app %q is declared as %s but its secret belongs to a %s app", e.App, e.Expected, e.Actual)
+}
+
+// appRegistry maps app names to their handles.
+type appRegistry struct {
+	mu   sync.RWMutex
+	apps map[string]*App
+	// invalid holds the errors of the configured apps that could not be
+	// registered, returned for their names instead of ErrUnknownApp.
+	invalid map[string]error
+}
+
+func (r *appRegistry) register(c *Client, name string, app AppConfig) error {
+	if name == "" {
+		return errors.New("dify: app name is empty")
+	}
+	if app.Secret == "" && app.SecretProvider == nil {
+		return fmt.Errorf("dify: app %q has no secret", name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.apps[name]; ok {
+		return fmt.Errorf("dify: app %q is already registered", name)
+	}
+	if r.apps == nil {
+		r.apps = make(map[string]*App)
+	}
+	if app.SecretProvider != nil {
+		app.Secret = ""
+	}
+	r.apps[name] = &App{c: c, name: name, secret: app.Secret, provider: app.SecretProvider, mode: app.Mode}
+	delete(r.invalid, name)
+	return nil
+}
+
+// reject records the error of a configured app that could not be registered.
+func (r *appRegistry) reject(name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.invalid == nil {
+		r.invalid = make(map[string]error)
+	}
+	r.invalid[name] = err
+}
+
+// RegisterApp adds an app to the registry of the client. Names can only be
+// registered once.
+func (c *Client) RegisterApp(name string, app AppConfig) error {
+	return c.apps.register(c, name, app)
+}
+
+// App returns the handle of a registered app, the error of a configured app
+// that could not be registered, or an error matching ErrUnknownApp.
+func (c *Client) App(name string) (*App, error) {
+	c.apps.mu.RLock()
+	app, ok := c.apps.apps[name]
+	invalid := c.apps.invalid[name]
+	c.apps.mu.RUnlock()
+	if !ok && invalid != nil {
+		return nil, invalid
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownApp, name)
+	}
+	return app, nil
+}
+
+// Apps returns the handles of all registered apps, sorted by name.
+func (c *Client) Apps() []*App {
+	c.apps.mu.RLock()
+	apps := make([]*App, 0, len(c.apps.apps))
+	for _, app := range c.apps.apps {
+		apps = append(apps, app)
+	}
+	c.apps.mu.RUnlock()
+	sort.Slice(apps, func(i, j int) bool { return apps[i].name < apps[j].name })
+	return apps
+}
+
+// VerifyApps calls /v1/info for every registered app with a declared mode,
+// typically at startup, and returns the failures joined: the error of a
+// configured app that could not be registered, an *AppModeError for a secret
+// of another mode, or the error of the call.
+func (c *Client) VerifyApps(ctx context.Context) error {
+	errs := c.apps.rejected()
+	for _, app := range c.Apps() {
+		if app.mode == "" {
+			continue
+		}
+		info, err := app.API().Info(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("dify: verifying app %q: %w", app.name, err))
+			continue
+		}
+		if info.Mode != app.mode {
+			errs = append(errs, &AppModeError{App: app.name, Expected: app.mode, Actual: info.Mode})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// rejected returns the errors of the apps that could not be registered,
+// sorted by name.
+func (r *appRegistry) rejected() []error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.invalid))
+	for name := range r.invalid {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	errs := make([]error, 0, len(names))
+	for _, name := range names {
+		errs = append(errs, r.invalid[name])
+	}
+	return errs
+}
+
+// DatasetKey returns the knowledge base API key configured under name in
+// ClientConfig.Datasets, or an error matching ErrUnknownDataset.
+func (c *Client) DatasetKey(name string) (string, error) {
+	key, ok := c.datasets[name]
+	if !ok {
+		return "", fmt.Errorf("%w %q", ErrUnknownDataset, name)
+	}
+	return key, nil
+}
@@ -0,0 +1,277 @@
+package dify
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cachedPaths are the endpoints served from the ResponseCache. They describe
+// the app and do not depend on the user.
+var cachedPaths = []string{"/v1/parameters", "/v1/info", "/v1/meta", "/v1/site"}
+
+// ResponseCache serves the app configuration endpoints, Parameters, Info,
+// Meta and Site, from a cache. Answers are cached per API secret, not per
+// user, and only when successful. Concurrent misses of the same answer are
+// collapsed into one request. Cache hits do not go through the middlewares.
+type ResponseCache struct {
+	// TTL is how long an answer is served from the cache. Defaults to 5
+	// minutes.
+	TTL time.Duration
+	// Store holds the cached answers. Defaults to an LRUCache of
+	// DefaultCacheEntries entries.
+	Store CacheStore
+}
+
+// DefaultCacheEntries is the size of the default ResponseCache store.
+const DefaultCacheEntries = 1024
+
+// withDefaults fills the zero fields of c. A nil cache stays disabled.
+func (c *ResponseCache) withDefaults() *ResponseCache {
+	if c == nil {
+		return nil
+	}
+	r := *c
+	if r.TTL <= 0 {
+		r.TTL = 5 * time.Minute
+	}
+	if r.Store == nil {
+		r.Store = NewLRUCache(DefaultCacheEntries)
+	}
+	return &r
+}
+
+// CacheStore holds the answers of a ResponseCache, such as an LRUCache or a
+// store shared by several processes. Keys do not contain API secrets. A
+// store that cannot be reached should report misses.
+type CacheStore interface {
+	Get(ctx context.Context, key string) ([]byte, bool)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration)
+	Delete(ctx context.Context, key string)
+}
+
+// LRUCache is an in-memory CacheStore that evicts the least recently used
+// entries beyond its size.
+type LRUCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// NewLRUCache returns an empty LRUCache holding up to size entries.
+func NewLRUCache(size int) *LRUCache {
+	return &LRUCache{
+		size:    max(size, 1),
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *LRUCache) Get(_ context.Context, key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(el)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return entry.value, true
+}
+
+func (c *LRUCache) Set(_ context.Context, key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &lruEntry{key: key, value: value, expires: time.Now().Add(ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *LRUCache) Delete(_ context.Context, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+}
+
+// Len returns the number of entries, expired ones included.
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *LRUCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*lruEntry).key)
+}
+
+// responseCache is the ResponseCache of a client.
+type responseCache struct {
+	ttl   time.Duration
+	store CacheStore
+	// generation is part of every key, so that InvalidateCache can drop
+	// every answer without listing the store.
+	generation atomic.Uint64
+	flight     flightGroup
+}
+
+func newResponseCache(c *ResponseCache) *responseCache {
+	c = c.withDefaults()
+	if c == nil {
+		return nil
+	}
+	return &responseCache{ttl: c.TTL, store: c.Store}
+}
+
+// key identifies the answer of url, without its query, for secret. The secret
+// is hashed so that it is never written to the store.
+func (rc *responseCache) key(url, secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return "dify:" + strconv.FormatUint(rc.generation.Load(), 10) + ":" + hex.EncodeToString(sum[:8]) + ":" + url
+}
+
+func (rc *responseCache) requestKey(req *http.Request) string {
+	u := *req.URL
+	u.RawQuery = ""
+	return rc.key(u.String(), strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+}
+
+// sendCachedJSONRequest is sendJSONRequest for the endpoints of cachedPaths,
+// answered from the ResponseCache when it is enabled.
+func (c *Client) sendCachedJSONRequest(req *http.Request, res interface{}) error {
+	rc := c.cache
+	if rc == nil {
+		return c.sendJSONRequest(req, res)
+	}
+	ctx := req.Context()
+	key := rc.requestKey(req)
+	if body, ok := rc.store.Get(ctx, key); ok {
+		return json.Unmarshal(body, res)
+	}
+	for {
+		body, leader, err := rc.flight.do(ctx, key, func() ([]byte, error) {
+			return c.fetchJSON(req)
+		})
+		// A miss shared with a caller that gave up is fetched again.
+		if err != nil && !leader && ctx.Err() == nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(body, res); err != nil {
+			return err
+		}
+		if leader {
+			rc.store.Set(ctx, key, body, rc.ttl)
+		}
+		return nil
+	}
+}
+
+// fetchJSON sends req and returns the body of a successful answer.
+func (c *Client) fetchJSON(req *http.Request) ([]byte, error) {
+	resp, err := c.sendRequest(req, retryAll)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(req, resp); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// InvalidateCache drops every answer of the ResponseCache, for all secrets.
+func (c *Client) InvalidateCache() {
+	if c.cache != nil {
+		c.cache.generation.Add(1)
+	}
+}
+
+// InvalidateCache drops the cached answers of the secret of api, after its
+// app was changed in Dify.
+func (api *API) InvalidateCache(ctx context.Context) error {
+	rc := api.c.cache
+	if rc == nil {
+		return nil
+	}
+	secret, _, err := api.getSecret(ctx)
+	if err != nil {
+		return err
+	}
+	for _, path := range cachedPaths {
+		rc.store.Delete(ctx, rc.key(api.c.getHost()+path, secret))
+	}
+	return nil
+}
+
+// flightGroup collapses concurrent calls with the same key into one.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	body []byte
+	err  error
+}
+
+// do runs fn, or waits for the call of key already running, until ctx is
+// done. leader reports whether fn ran in this call.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() ([]byte, error)) (body []byte, leader bool, err error) {
+	g.mu.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.body, false, call.err
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+	call := &flightCall{done: make(chan struct{})}
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	call.body, call.err = fn()
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(call.done)
+	return call.body, true, call.err
+}
@@ -0,0 +1,75 @@
+package dify
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLRUCache(t *testing.T) {
+	ctx := context.Background()
+	c := NewLRUCache(2)
+	c.Set(ctx, "a", []byte("1"), time.Hour)
+	c.Set(ctx, "b", []byte("2"), time.Hour)
+	c.Get(ctx, "a")
+	c.Set(ctx, "c", []byte("3"), time.Hour)
+	if _, ok := c.Get(ctx, "b"); ok {
+		t.Error("the least recently used entry was not evicted")
+	}
+	if v, ok := c.Get(ctx, "a"); !ok || string(v) != "1" {
+		t.Errorf("a = %q, %v", v, ok)
+	}
+
+	c.Set(ctx, "a", []byte("4"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.Get(ctx, "a"); ok {
+		t.Error("an expired entry was returned")
+	}
+	c.Delete(ctx, "c")
+	if c.Len() != 0 {
+		t.Errorf("Len = %d", c.Len())
+	}
+}
+
+func TestFlightGroup(t *testing.T) {
+	var g flightGroup
+	var calls atomic.Int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	results := make([]string, 5)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, _, _ := g.do(context.Background(), "key", func() ([]byte, error) {
+				calls.Add(1)
+				<-release
+				return []byte("answer"), nil
+			})
+			results[i] = string(body)
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls.Load() != 1 || fmt.Sprint(results) != "[answer answer answer answer answer]" {
+		t.Errorf("calls = %d, results = %v", calls.Load(), results)
+	}
+
+	// A waiting caller gives up with its own context.
+	hold := make(chan struct{})
+	go g.do(context.Background(), "slow", func() ([]byte, error) {
+		<-hold
+		return nil, nil
+	})
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, leader, err := g.do(ctx, "slow", nil); leader || err != context.Canceled {
+		t.Errorf("leader = %v, err = %v", leader, err)
+	}
+	close(hold)
+}
@@ -0,0 +1,608 @@
+// Package cassette records the HTTP exchanges of a Dify client into fixture
+// files and replays them, so that tests run without a Dify server.
+//
+// A Recorder is an http.RoundTripper. In ModeRecord it sends requests
+// through Config.Transport and keeps every exchange, streams with the chunk
+// boundaries they arrived with, until Close writes them to Config.Path. In
+// ModeReplay it answers every request with the first unused recorded exchange
+// matching its method, path, query and body, and fails with a diff against
+// the closest recorded request when none matches.
+//
+// Secrets and user ids never reach the files: the Authorization header is
+// replaced, and the JSON fields named in Config.RedactFields are replaced at
+// any depth in bodies, query parameters and stream events. Requests are
+// matched after the same redaction.
+//
+//	rec, err := cassette.New(cassette.Config{Path: "testdata/cassettes/chat.json"})
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer rec.Close()
+//	c := dify.NewClientWithConfig(&dify.ClientConfig{Host: "https://dify.test", Transport: rec})
+package cassette
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Mode selects whether a Recorder records or replays.
+type Mode int
+
+const (
+	// ModeReplay answers requests from the cassette file.
+	ModeReplay Mode = iota
+	// ModeRecord sends requests to the server and overwrites the cassette
+	// file on Close.
+	ModeRecord
+)
+
+// Redacted replaces secrets and the values of redacted fields.
+const Redacted = "REDACTED"
+
+// DefaultRedactFields are the JSON fields redacted when Config.RedactFields
+// is nil: the user ids of requests, of the messages and conversations Dify
+// returns, and of the inputs echoed by workflow events.
+var DefaultRedactFields = []string{"user", "from_end_user_id", "from_account_id", "sys.user_id"}
+
+// ErrNoMatch is matched with errors.Is by the *MismatchError of requests
+// that were not recorded.
+var ErrNoMatch = errors.New("cassette: no recorded request matches")
+
+// Config configures a Recorder.
+type Config struct {
+	// Path is the cassette file, written as indented JSON.
+	Path string
+	Mode Mode
+	// Transport sends the requests in ModeRecord, http.DefaultTransport
+	// when nil.
+	Transport http.RoundTripper
+	// RedactFields are the JSON fields whose values are replaced, in any
+	// letter case. Defaults to DefaultRedactFields.
+	RedactFields []string
+}
+
+// Cassette is the content of a cassette file.
+type Cassette struct {
+	Version      int           `json:"version"`
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is one recorded exchange.
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+// Request is a recorded request. URL holds the path and query only, so that
+// a cassette can be replayed against any host.
+type Request struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+}
+
+// Response is a recorded response. Event streams are kept in Chunks, as they
+// were read from the connection; other bodies in Body.
+type Response struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+	Chunks []string    `json:"chunks,omitempty"`
+}
+
+const cassetteVersion = 1
+
+// Recorder records or replays the exchanges of a cassette.
+type Recorder struct {
+	path      string
+	mode      Mode
+	transport http.RoundTripper
+	redact    map[string]bool
+
+	mu           sync.Mutex
+	interactions []*Interaction
+	used         []bool
+}
+
+// New returns a Recorder for cfg. In ModeReplay the cassette file must
+// exist.
+func New(cfg Config) (*Recorder, error) {
+	r := &Recorder{
+		path:      cfg.Path,
+		mode:      cfg.Mode,
+		transport: cfg.Transport,
+		redact:    make(map[string]bool),
+	}
+	if r.transport == nil {
+		r.transport = http.DefaultTransport
+	}
+	fields := cfg.RedactFields
+	if fields == nil {
+		fields = DefaultRedactFields
+	}
+	for _, f := range fields {
+		r.redact[strings.ToLower(f)] = true
+	}
+	if r.mode == ModeReplay {
+		c, err := Load(cfg.Path)
+		if err != nil {
+			return nil, err
+		}
+		for i := range c.Interactions {
+			r.interactions = append(r.interactions, &c.Interactions[i])
+		}
+		r.used = make([]bool, len(r.interactions))
+	}
+	return r, nil
+}
+
+// Load reads a cassette file.
+func Load(path string) (*Cassette, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cassette: %w", err)
+	}
+	var c Cassette
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("cassette %s: %w", path, err)
+	}
+	if c.Version != cassetteVersion {
+		return nil, fmt.Errorf("cassette %s: unsupported version %d", path, c.Version)
+	}
+	return &c, nil
+}
+
+// Close writes the recorded exchanges to the cassette file in ModeRecord,
+// including the part of bodies read so far. It does nothing in ModeReplay.
+func (r *Recorder) Close() error {
+	if r.mode != ModeRecord {
+		return nil
+	}
+	r.mu.Lock()
+	c := Cassette{Version: cassetteVersion, Interactions: []Interaction{}}
+	for _, in := range r.interactions {
+		c.Interactions = append(c.Interactions, *in)
+	}
+	r.mu.Unlock()
+
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return fmt.Errorf("cassette: %w", err)
+	}
+	if err := os.WriteFile(r.path, append(b, '\n'), 0o644); err != nil {
+		return fmt.Errorf("cassette: %w", err)
+	}
+	return nil
+}
+
+// Unused returns the recorded requests that were not replayed.
+func (r *Recorder) Unused() []Request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var unused []Request
+	for i, in := range r.interactions {
+		if r.mode == ModeReplay && !r.used[i] {
+			unused = append(unused, in.Request)
+		}
+	}
+	return unused
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	recorded := r.request(req, body)
+	if r.mode == ModeReplay {
+		return r.replay(req, recorded)
+	}
+	return r.record(req, body, recorded)
+}
+
+// request returns the redacted form of req, as recorded and matched.
+func (r *Recorder) request(req *http.Request, body []byte) Request {
+	u := url.URL{Path: req.URL.Path}
+	if q := req.URL.Query(); len(q) > 0 {
+		for key := range q {
+			if r.redact[strings.ToLower(key)] {
+				q[key] = []string{Redacted}
+			}
+		}
+		u.RawQuery = q.Encode()
+	}
+	out := Request{Method: req.Method, URL: u.String(), Body: r.redactBody(body)}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		out.Header = http.Header{"Content-Type": {ct}}
+	}
+	if req.Header.Get("Authorization") != "" {
+		if out.Header == nil {
+			out.Header = http.Header{}
+		}
+		out.Header.Set("Authorization", "Bearer "+Redacted)
+	}
+	return out
+}
+
+func (r *Recorder) record(req *http.Request, body []byte, recorded Request) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	out.ContentLength = int64(len(body))
+	resp, err := r.transport.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+
+	in := &Interaction{Request: recorded, Response: Response{
+		Status: resp.StatusCode,
+		Header: recordedHeader(resp.Header),
+	}}
+	r.mu.Lock()
+	r.interactions = append(r.interactions, in)
+	r.mu.Unlock()
+	resp.Body = &recordingBody{ReadCloser: resp.Body, r: r, in: in, stream: isEventStream(resp.Header)}
+	return resp, nil
+}
+
+// recordedHeader drops the headers that change on every response or that
+// would no longer hold once bodies are redacted.
+func recordedHeader(h http.Header) http.Header {
+	out := h.Clone()
+	for _, key := range []string{"Date", "Set-Cookie", "Content-Length", "Transfer-Encoding", "Connection", "Keep-Alive"} {
+		out.Del(key)
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+func isEventStream(h http.Header) bool {
+	mt, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return mt == "text/event-stream"
+}
+
+// recordingBody keeps what is read from a recorded response.
+type recordingBody struct {
+	io.ReadCloser
+	r      *Recorder
+	in     *Interaction
+	stream bool
+	chunks []string
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.chunks = append(b.chunks, string(p[:n]))
+		b.r.mu.Lock()
+		if b.stream {
+			b.in.Response.Chunks = b.r.redactChunks(b.chunks)
+		} else {
+			b.in.Response.Body = b.r.redactBody([]byte(strings.Join(b.chunks, "")))
+		}
+		b.r.mu.Unlock()
+	}
+	return n, err
+}
+
+func (r *Recorder) replay(req *http.Request, recorded Request) (*http.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, in := range r.interactions {
+		if !r.used[i] && matches(in.Request, recorded) {
+			r.used[i] = true
+			return replayResponse(req, in.Response), nil
+		}
+	}
+	return nil, r.mismatch(recorded)
+}
+
+func matches(a, b Request) bool {
+	return a.Method == b.Method && a.URL == b.URL && a.Body == b.Body
+}
+
+func replayResponse(req *http.Request, recorded Response) *http.Response {
+	chunks := recorded.Chunks
+	length := int64(-1)
+	if chunks == nil {
+		chunks = []string{recorded.Body}
+		length = int64(len(recorded.Body))
+	}
+	header := recorded.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", recorded.Status, http.StatusText(recorded.Status)),
+		StatusCode:    recorded.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          &chunkedBody{chunks: slices.Clone(chunks)},
+		ContentLength: length,
+		Request:       req,
+	}
+}
+
+// chunkedBody returns at most one recorded chunk per Read, so that readers
+// see the chunk boundaries of the recording.
+type chunkedBody struct {
+	chunks []string
+}
+
+func (b *chunkedBody) Read(p []byte) (int, error) {
+	for len(b.chunks) > 0 && b.chunks[0] == "" {
+		b.chunks = b.chunks[1:]
+	}
+	if len(b.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, b.chunks[0])
+	b.chunks[0] = b.chunks[0][n:]
+	return n, nil
+}
+
+func (b *chunkedBody) Close() error { return nil }
+
+// MismatchError reports a request that matches no unused recorded request,
+// with the closest one, if any.
+type MismatchError struct {
+	Path    string
+	Request Request
+	Closest *Request
+}
+
+func (e *MismatchError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%v in %s: %s %s", ErrNoMatch, e.Path, e.Request.Method, e.Request.URL)
+	if e.Closest == nil {
+		sb.WriteString("\nno unused recorded request left")
+		return sb.String()
+	}
+	sb.WriteString("\ndiff against the closest recorded request (- recorded, + sent):\n")
+	sb.WriteString(diff(describe(*e.Closest), describe(e.Request)))
+	return sb.String()
+}
+
+func (e *MismatchError) Is(target error) bool { return target == ErrNoMatch }
+
+func (r *Recorder) mismatch(sent Request) error {
+	err := &MismatchError{Path: r.path, Request: sent}
+	best := -1
+	for i, in := range r.interactions {
+		if r.used[i] {
+			continue
+		}
+		score := 0
+		if in.Request.Method == sent.Method {
+			score++
+		}
+		if pathOf(in.Request.URL) == pathOf(sent.URL) {
+			score += 2
+		}
+		if in.Request.URL == sent.URL {
+			score++
+		}
+		if score > best {
+			best = score
+			closest := in.Request
+			err.Closest = &closest
+		}
+	}
+	return err
+}
+
+func pathOf(u string) string {
+	path, _, _ := strings.Cut(u, "?")
+	return path
+}
+
+// describe renders a request line by line for diffs, with JSON bodies
+// indented.
+func describe(req Request) []string {
+	lines := []string{req.Method + " " + req.URL}
+	if req.Body == "" {
+		return lines
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(req.Body), "", "  "); err == nil {
+		return append(lines, strings.Split(buf.String(), "\n")...)
+	}
+	return append(lines, strings.Split(req.Body, "\n")...)
+}
+
+// diff returns a line diff of a and b, marking the lines only in a with "-"
+// and the lines only in b with "+".
+func diff(a, b []string) string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var sb strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			sb.WriteString("  " + a[i] + "\n")
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			sb.WriteString("- " + a[i] + "\n")
+			i++
+		default:
+			sb.WriteString("+ " + b[j] + "\n")
+			j++
+		}
+	}
+	return sb.String()
+}
+
+// redactBody replaces the redacted fields of a JSON body. Bodies without
+// any are returned as they are; others are rewritten compactly with sorted
+// keys.
+func (r *Recorder) redactBody(body []byte) string {
+	redacted, _ := r.redactJSON(body)
+	return redacted
+}
+
+func (r *Recorder) redactJSON(body []byte) (string, bool) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return "", false
+	}
+	var v any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return string(body), false
+	}
+	if !r.redactValue(v) {
+		return string(body), false
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return string(body), false
+	}
+	return string(b), true
+}
+
+// redactValue replaces the redacted fields of v in place and reports whether
+// there were any.
+func (r *Recorder) redactValue(v any) bool {
+	changed := false
+	switch v := v.(type) {
+	case map[string]any:
+		for key, field := range v {
+			if r.redact[strings.ToLower(key)] && field != nil {
+				v[key] = Redacted
+				changed = true
+			} else if r.redactValue(field) {
+				changed = true
+			}
+		}
+	case []any:
+		for _, field := range v {
+			if r.redactValue(field) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// redactChunks redacts the data lines of an event stream read in chunks. A
+// chunk boundary inside a line that changed moves to the end of that line;
+// the others are kept.
+func (r *Recorder) redactChunks(chunks []string) []string {
+	if len(chunks) == 0 {
+		return nil
+	}
+	text := strings.Join(chunks, "")
+	var boundaries []int
+	offset := 0
+	for _, c := range chunks[:len(chunks)-1] {
+		offset += len(c)
+		boundaries = append(boundaries, offset)
+	}
+
+	var out strings.Builder
+	var mapped []int
+	start := 0
+	for start < len(text) {
+		end := strings.IndexByte(text[start:], '\n')
+		if end < 0 {
+			end = len(text)
+		} else {
+			end += start + 1
+		}
+		line := text[start:end]
+		redacted := r.redactLine(line)
+		newStart := out.Len()
+		out.WriteString(redacted)
+		for _, b := range boundaries {
+			if b <= start || b >= end {
+				continue
+			}
+			if redacted == line {
+				mapped = append(mapped, newStart+b-start)
+			} else {
+				mapped = append(mapped, out.Len())
+			}
+		}
+		for _, b := range boundaries {
+			if b == end {
+				mapped = append(mapped, out.Len())
+			}
+		}
+		start = end
+	}
+
+	redacted := out.String()
+	sort.Ints(mapped)
+	mapped = slices.Compact(mapped)
+	var result []string
+	prev := 0
+	for _, b := range mapped {
+		if b > prev && b < len(redacted) {
+			result = append(result, redacted[prev:b])
+			prev = b
+		}
+	}
+	return append(result, redacted[prev:])
+}
+
+// redactLine redacts the JSON of a complete "data:" line.
+func (r *Recorder) redactLine(line string) string {
+	content, ok := strings.CutSuffix(line, "\n")
+	if !ok {
+		return line
+	}
+	content, cr := strings.CutSuffix(content, "\r")
+	data, ok := strings.CutPrefix(content, "data:")
+	if !ok {
+		return line
+	}
+	redacted, changed := r.redactJSON([]byte(strings.TrimPrefix(data, " ")))
+	if !changed {
+		return line
+	}
+	suffix := "\n"
+	if cr {
+		suffix = "\r\n"
+	}
+	return "data: " + redacted + suffix
+}
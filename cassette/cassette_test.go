@@ -0,0 +1,182 @@
+package cassette
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func streamServer(t *testing.T, chunks ...string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, c := range chunks {
+			fmt.Fprint(w, c)
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// reads returns the pieces returned by every Read of body.
+func reads(t *testing.T, body io.Reader) []string {
+	t.Helper()
+	var out []string
+	buf := make([]byte, 4096)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			out = append(out, string(buf[:n]))
+		}
+		if err == io.EOF {
+			return out
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func post(t *testing.T, rt http.RoundTripper, url, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer app-secret")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	chunks := []string{
+		"data: {\"event\":\"message\",\"answer\":\"a\"}\n\n",
+		"data: {\"event\":\"mess",
+		"age\",\"answer\":\"b\"}\n\n",
+		"data: {\"event\":\"workflow_finished\",\"created_by\":{\"user\":\"alice\"}}\n\n",
+	}
+	srv := streamServer(t, chunks...)
+	path := filepath.Join(t.TempDir(), "cassette.json")
+
+	rec, err := New(Config{Path: path, Mode: ModeRecord})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := post(t, rec, srv.URL+"/v1/chat-messages?user=alice", `{"query":"hi","user":"alice"}`)
+	got := reads(t, resp.Body)
+	resp.Body.Close()
+	if strings.Join(got, "") != strings.Join(chunks, "") {
+		t.Errorf("recorded body = %q", got)
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, _ := os.ReadFile(path)
+	if bytes.Contains(file, []byte("alice")) || bytes.Contains(file, []byte("app-secret")) {
+		t.Errorf("the cassette leaks a secret:\n%s", file)
+	}
+
+	rec, err = New(Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = post(t, rec, "https://dify.test/v1/chat-messages?user=bob", `{"user":"bob","query":"hi"}`)
+	replayed := reads(t, resp.Body)
+	want := []string{chunks[0], chunks[1], chunks[2], "data: {\"created_by\":{\"user\":\"REDACTED\"},\"event\":\"workflow_finished\"}\n\n"}
+	if fmt.Sprint(replayed) != fmt.Sprint(want) {
+		t.Errorf("replayed reads:\n%q\nwant\n%q", replayed, want)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("response = %d %v", resp.StatusCode, resp.Header)
+	}
+	if len(rec.Unused()) != 0 {
+		t.Errorf("unused = %v", rec.Unused())
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	os.WriteFile(path, []byte(`{"version":1,"interactions":[
+		{"request":{"method":"GET","url":"/v1/parameters"},"response":{"status":200,"body":"{}"}},
+		{"request":{"method":"POST","url":"/v1/chat-messages","body":"{\"query\":\"hi\",\"user\":\"REDACTED\"}"},"response":{"status":200,"body":"{}"}}
+	]}`), 0o644)
+	rec, err := New(Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "https://dify.test/v1/chat-messages", strings.NewReader(`{"query":"hello","user":"alice"}`))
+	_, err = rec.RoundTrip(req)
+	var mismatch *MismatchError
+	if !errors.As(err, &mismatch) || !errors.Is(err, ErrNoMatch) {
+		t.Fatalf("err = %v", err)
+	}
+	for _, want := range []string{
+		"POST /v1/chat-messages",
+		`-   "query": "hi",`,
+		`+   "query": "hello",`,
+		`    "user": "REDACTED"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not contain %q:\n%v", want, err)
+		}
+	}
+
+	// Identical requests are replayed once each.
+	get := func() error {
+		req, _ := http.NewRequest(http.MethodGet, "https://dify.test/v1/parameters", nil)
+		resp, err := rec.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	if err := get(); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(); !errors.Is(err, ErrNoMatch) {
+		t.Errorf("second replay: %v", err)
+	}
+}
+
+func TestRedactChunks(t *testing.T) {
+	r, _ := New(Config{Mode: ModeRecord})
+	chunks := []string{
+		"event: ping\n\nda",
+		"ta: {\"user\":\"al",
+		"ice\"}\n\ndata: {\"answer\":",
+		"\"x\"}\n\n",
+	}
+	got := r.redactChunks(chunks)
+	// The boundaries inside the redacted line move to its end.
+	want := []string{
+		"event: ping\n\ndata: {\"user\":\"REDACTED\"}\n",
+		"\ndata: {\"answer\":",
+		"\"x\"}\n\n",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("redactChunks =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	got := diff([]string{"a", "b", "c"}, []string{"a", "x", "c", "d"})
+	want := "  a\n- b\n+ x\n  c\n+ d\n"
+	if got != want {
+		t.Errorf("diff =\n%s\nwant\n%s", got, want)
+	}
+}
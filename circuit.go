@@ -0,0 +1,309 @@
+package dify
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is matched with errors.Is by the *CircuitOpenError of calls
+// rejected by an open circuit breaker.
+var ErrCircuitOpen = errors.New("dify: circuit open")
+
+// CircuitState is the state of the circuit breaker of one host and secret.
+type CircuitState int
+
+const (
+	// CircuitClosed lets every call through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects every call until OpenTimeout has passed.
+	CircuitOpen
+	// CircuitHalfOpen lets probe calls through to decide whether to close
+	// the circuit again.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+// CircuitBreaker stops calls to a Dify host that keeps failing, separately
+// for every API secret, so that callers fail fast with ErrCircuitOpen
+// instead of piling up on a degraded server.
+//
+// Every attempt, retries included, counts. An attempt fails when it gets no
+// response or a 5xx status; attempts abandoned by their caller's context do
+// not count. Streams count once, when they are opened.
+type CircuitBreaker struct {
+	// ConsecutiveFailures opens the circuit after that many failed attempts
+	// in a row. Defaults to 5 when FailureRate is not set either.
+	ConsecutiveFailures int
+	// FailureRate, between 0 and 1, opens the circuit when that fraction of
+	// the attempts within Window failed, once there were at least
+	// MinRequests of them. They default to 20 requests and 1 minute.
+	FailureRate float64
+	MinRequests int
+	Window      time.Duration
+	// OpenTimeout is how long an open circuit rejects calls before letting
+	// probes through. Defaults to 30s.
+	OpenTimeout time.Duration
+	// HalfOpenRequests is the number of probes let through by a half-open
+	// circuit. It closes once they all succeeded and opens again on the
+	// first failure. Defaults to 1.
+	HalfOpenRequests int
+	// OnStateChange is called on every state change, in order, while the
+	// circuit is locked. It must not block.
+	OnStateChange func(CircuitStateChange)
+}
+
+// CircuitStateChange describes a circuit that changed state.
+type CircuitStateChange struct {
+	Host string
+	// Secret is the API secret of the circuit, redacted to its last
+	// characters.
+	Secret string
+	From   CircuitState
+	To     CircuitState
+}
+
+// CircuitOpenError is returned, wrapped in a *url.Error, for calls rejected
+// by an open or half-open circuit.
+type CircuitOpenError struct {
+	Host string
+	// Secret is the API secret of the call, redacted to its last
+	// characters.
+	Secret string
+	State  CircuitState
+	// RetryAfter is how long until an open circuit lets a probe through.
+	// It is zero for a half-open circuit whose probes are still running.
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	if e.State == CircuitHalfOpen {
+		return fmt.Sprintf("dify: circuit half-open for %s (%s), waiting for probes", e.Host, e.Secret)
+	}
+	return fmt.Sprintf("dify: circuit open for %s (%s), retry in %s", e.Host, e.Secret, e.RetryAfter.Round(time.Millisecond))
+}
+
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// withDefaults fills the zero fields of b. A nil breaker disables it.
+func (b *CircuitBreaker) withDefaults() *CircuitBreaker {
+	if b == nil {
+		return nil
+	}
+	r := *b
+	if r.ConsecutiveFailures <= 0 && r.FailureRate <= 0 {
+		r.ConsecutiveFailures = 5
+	}
+	if r.FailureRate > 0 {
+		if r.MinRequests <= 0 {
+			r.MinRequests = 20
+		}
+		if r.Window <= 0 {
+			r.Window = time.Minute
+		}
+	}
+	if r.OpenTimeout <= 0 {
+		r.OpenTimeout = 30 * time.Second
+	}
+	if r.HalfOpenRequests <= 0 {
+		r.HalfOpenRequests = 1
+	}
+	return &r
+}
+
+// circuitTransport rejects requests to hosts whose circuit is open before
+// passing them on.
+type circuitTransport struct {
+	base   http.RoundTripper
+	policy *CircuitBreaker
+
+	mu       sync.Mutex
+	circuits map[circuitKey]*circuit
+}
+
+type circuitKey struct {
+	host   string
+	secret string
+}
+
+func newCircuitTransport(base http.RoundTripper, policy *CircuitBreaker) *circuitTransport {
+	return &circuitTransport{
+		base:     base,
+		policy:   policy,
+		circuits: make(map[circuitKey]*circuit),
+	}
+}
+
+func (t *circuitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cb := t.circuit(req.URL.Host, strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+	gen, err := cb.allow(time.Now())
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	switch {
+	case err != nil && req.Context().Err() != nil:
+		cb.record(gen, attemptAbandoned, time.Now())
+	case err != nil || resp.StatusCode >= 500:
+		cb.record(gen, attemptFailed, time.Now())
+	default:
+		cb.record(gen, attemptSucceeded, time.Now())
+	}
+	return resp, err
+}
+
+func (t *circuitTransport) circuit(host, secret string) *circuit {
+	key := circuitKey{host: host, secret: secret}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cb, ok := t.circuits[key]
+	if !ok {
+		cb = &circuit{policy: t.policy, host: host, secret: redactSecret(secret)}
+		t.circuits[key] = cb
+	}
+	return cb
+}
+
+type attemptOutcome int
+
+const (
+	attemptSucceeded attemptOutcome = iota
+	attemptFailed
+	attemptAbandoned
+)
+
+// circuit is the breaker of one host and secret.
+type circuit struct {
+	policy *CircuitBreaker
+	host   string
+	secret string
+
+	mu    sync.Mutex
+	state CircuitState
+	// gen changes with every state change, so that attempts let through
+	// in an earlier state are not counted in the current one.
+	gen uint64
+
+	// Closed: the attempts of the current window.
+	windowStart time.Time
+	requests    int
+	failures    int
+	consecutive int
+
+	// Open: when probes are let through.
+	openUntil time.Time
+
+	// Half-open: the probes let through and those that succeeded.
+	probes    int
+	successes int
+}
+
+// allow admits an attempt, returning the generation to record its outcome
+// with, or rejects it with a *CircuitOpenError.
+func (c *circuit) allow(now time.Time) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case CircuitClosed:
+		if c.policy.Window > 0 && now.Sub(c.windowStart) >= c.policy.Window {
+			c.windowStart = now
+			c.requests, c.failures = 0, 0
+		}
+	case CircuitOpen:
+		if now.Before(c.openUntil) {
+			return 0, &CircuitOpenError{Host: c.host, Secret: c.secret, State: CircuitOpen, RetryAfter: c.openUntil.Sub(now)}
+		}
+		c.setState(CircuitHalfOpen, now)
+		fallthrough
+	case CircuitHalfOpen:
+		if c.probes >= c.policy.HalfOpenRequests {
+			return 0, &CircuitOpenError{Host: c.host, Secret: c.secret, State: CircuitHalfOpen}
+		}
+		c.probes++
+	}
+	return c.gen, nil
+}
+
+// record counts the outcome of an attempt admitted in generation gen.
+func (c *circuit) record(gen uint64, outcome attemptOutcome, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+
+	switch c.state {
+	case CircuitClosed:
+		if outcome == attemptAbandoned {
+			return
+		}
+		c.requests++
+		if outcome == attemptSucceeded {
+			c.consecutive = 0
+			return
+		}
+		c.failures++
+		c.consecutive++
+		if c.tripped() {
+			c.setState(CircuitOpen, now)
+		}
+	case CircuitHalfOpen:
+		switch outcome {
+		case attemptAbandoned:
+			// Free the probe for another call.
+			c.probes--
+		case attemptFailed:
+			c.setState(CircuitOpen, now)
+		case attemptSucceeded:
+			c.successes++
+			if c.successes >= c.policy.HalfOpenRequests {
+				c.setState(CircuitClosed, now)
+			}
+		}
+	}
+}
+
+func (c *circuit) tripped() bool {
+	p := c.policy
+	if p.ConsecutiveFailures > 0 && c.consecutive >= p.ConsecutiveFailures {
+		return true
+	}
+	return p.FailureRate > 0 && c.requests >= p.MinRequests &&
+		float64(c.failures) >= p.FailureRate*float64(c.requests)
+}
+
+func (c *circuit) setState(state CircuitState, now time.Time) {
+	from := c.state
+	c.state = state
+	c.gen++
+	c.windowStart = now
+	c.requests, c.failures, c.consecutive = 0, 0, 0
+	c.probes, c.successes = 0, 0
+	if state == CircuitOpen {
+		c.openUntil = now.Add(c.policy.OpenTimeout)
+	}
+	if c.policy.OnStateChange != nil {
+		c.policy.OnStateChange(CircuitStateChange{Host: c.host, Secret: c.secret, From: from, To: state})
+	}
+}
@@ -0,0 +1,155 @@
+package dify
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitConsecutiveFailures(t *testing.T) {
+	var changes []CircuitStateChange
+	c := &circuit{policy: (&CircuitBreaker{
+		ConsecutiveFailures: 2,
+		OpenTimeout:         time.Minute,
+		OnStateChange:       func(change CircuitStateChange) { changes = append(changes, change) },
+	}).withDefaults()}
+
+	now := time.Now()
+	for _, outcome := range []attemptOutcome{attemptFailed, attemptSucceeded, attemptFailed, attemptAbandoned, attemptFailed} {
+		gen, err := c.allow(now)
+		if err != nil {
+			t.Fatalf("closed circuit rejected a call: %v", err)
+		}
+		c.record(gen, outcome, now)
+	}
+	if c.state != CircuitOpen {
+		t.Fatalf("state = %v after two failures in a row, want open", c.state)
+	}
+
+	_, err := c.allow(now)
+	var openErr *CircuitOpenError
+	if !errors.As(err, &openErr) || !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("allow on an open circuit = %v", err)
+	}
+	if openErr.RetryAfter <= 0 || openErr.RetryAfter > time.Minute {
+		t.Errorf("RetryAfter = %v", openErr.RetryAfter)
+	}
+	if len(changes) != 1 || changes[0].From != CircuitClosed || changes[0].To != CircuitOpen {
+		t.Errorf("changes = %+v", changes)
+	}
+}
+
+func TestCircuitFailureRate(t *testing.T) {
+	c := &circuit{policy: (&CircuitBreaker{FailureRate: 0.5, MinRequests: 4, Window: time.Minute}).withDefaults()}
+	now := time.Now()
+	for _, outcome := range []attemptOutcome{attemptFailed, attemptSucceeded, attemptFailed} {
+		gen, _ := c.allow(now)
+		c.record(gen, outcome, now)
+	}
+	if c.state != CircuitClosed {
+		t.Fatalf("circuit opened below MinRequests")
+	}
+
+	// A new window starts the count again.
+	now = now.Add(time.Minute)
+	for _, outcome := range []attemptOutcome{attemptSucceeded, attemptFailed, attemptSucceeded} {
+		gen, _ := c.allow(now)
+		c.record(gen, outcome, now)
+	}
+	if c.state != CircuitClosed {
+		t.Fatalf("circuit opened with a failure rate of 1/3")
+	}
+	gen, _ := c.allow(now)
+	c.record(gen, attemptFailed, now)
+	if c.state != CircuitOpen {
+		t.Fatalf("state = %v with a failure rate of 2/4, want open", c.state)
+	}
+}
+
+func TestCircuitHalfOpen(t *testing.T) {
+	var changes []CircuitStateChange
+	c := &circuit{policy: (&CircuitBreaker{
+		ConsecutiveFailures: 1,
+		OpenTimeout:         time.Second,
+		HalfOpenRequests:    2,
+		OnStateChange:       func(change CircuitStateChange) { changes = append(changes, change) },
+	}).withDefaults()}
+
+	now := time.Now()
+	gen, _ := c.allow(now)
+	c.record(gen, attemptFailed, now)
+
+	// After OpenTimeout, two probes are let through and further calls are
+	// rejected while they run.
+	now = now.Add(2 * time.Second)
+	probe1, err := c.allow(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe2, err := c.allow(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.allow(now)
+	var openErr *CircuitOpenError
+	if !errors.As(err, &openErr) || openErr.State != CircuitHalfOpen {
+		t.Fatalf("third call on a half-open circuit = %v", err)
+	}
+
+	// An abandoned probe frees its place.
+	c.record(probe1, attemptAbandoned, now)
+	probe3, err := c.allow(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.record(probe2, attemptSucceeded, now)
+	c.record(probe3, attemptSucceeded, now)
+	if c.state != CircuitClosed {
+		t.Fatalf("state = %v after all probes succeeded, want closed", c.state)
+	}
+
+	// A failed probe opens the circuit again.
+	gen, _ = c.allow(now)
+	c.record(gen, attemptFailed, now)
+	now = now.Add(2 * time.Second)
+	gen, _ = c.allow(now)
+	c.record(gen, attemptFailed, now)
+	if c.state != CircuitOpen {
+		t.Fatalf("state = %v after a failed probe, want open", c.state)
+	}
+
+	var got []string
+	for _, change := range changes {
+		got = append(got, change.From.String()+">"+change.To.String())
+	}
+	want := []string{"closed>open", "open>half-open", "half-open>closed", "closed>open", "open>half-open", "half-open>open"}
+	if len(got) != len(want) {
+		t.Fatalf("changes = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("changes = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestCircuitIgnoresStaleOutcomes(t *testing.T) {
+	c := &circuit{policy: (&CircuitBreaker{ConsecutiveFailures: 1, OpenTimeout: time.Second}).withDefaults()}
+	now := time.Now()
+	slow, _ := c.allow(now)
+	gen, _ := c.allow(now)
+	c.record(gen, attemptFailed, now)
+
+	now = now.Add(2 * time.Second)
+	probe, _ := c.allow(now)
+	// A call let through before the circuit opened does not decide the
+	// probe.
+	c.record(slow, attemptSucceeded, now)
+	if c.state != CircuitHalfOpen {
+		t.Fatalf("state = %v, want half-open", c.state)
+	}
+	c.record(probe, attemptSucceeded, now)
+	if c.state != CircuitClosed {
+		t.Fatalf("state = %v, want closed", c.state)
+	}
+}
@@ -1,33 +1,173 @@
 package dify
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"maps"
 	"net/http"
+	"slices"
 	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 type Client struct {
 	host             string
 	defaultAPISecret string
+	secrets          SecretProvider
 	httpClient       *http.Client
+	streamClient     *http.Client
+	tracer           trace.Tracer
+	streamDefaults   streamOptions
+	retry            *RetryPolicy
+	middlewares      []Middleware
+	logger           *requestLogger
+	endpoints        *endpointTransport
+	apps             appRegistry
+	datasets         map[string]string
+	cache            *responseCache
 }
 
 func NewClientWithConfig(c *ClientConfig) *Client {
 	var httpClient = &http.Client{}
+	if c.HTTPClient != nil {
+		client := *c.HTTPClient
+		httpClient = &client
+	}
 
 	if c.Timeout != 0 {
 		httpClient.Timeout = c.Timeout
 	}
-	if c.Transport != nil {
-		httpClient.Transport = c.Transport
+	hosts, sockets := unixSocketHosts(endpointHosts(c.Host, c.Hosts))
+	transport := buildTransport(c, sockets)
+	// The stream observers are recorded below every other transport, where
+	// all of them are registered.
+	httpClient.Transport = observingTransport{transport}
+
+	logger := newRequestLogger(c)
+	if c.BlockingRateLimit.enabled() || c.StreamingRateLimit.enabled() {
+		limiter := newRateLimitedTransport(httpClient.Transport, c)
+		if logger != nil {
+			onWait := limiter.onWait
+			limiter.onWait = func(w RateLimitWait) {
+				logger.onRateLimitWait(w)
+				if onWait != nil {
+					onWait(w)
+				}
+			}
+		}
+		httpClient.Transport = limiter
+	}
+	// The circuit breaker sits outside the rate limiter, so rejected calls
+	// never wait for it.
+	if breaker := c.CircuitBreaker.withDefaults(); breaker != nil {
+		if logger != nil {
+			onChange := breaker.OnStateChange
+			breaker.OnStateChange = func(change CircuitStateChange) {
+				logger.onCircuitStateChange(change)
+				if onChange != nil {
+					onChange(change)
+				}
+			}
+		}
+		httpClient.Transport = newCircuitTransport(httpClient.Transport, breaker)
+	}
+	// Endpoints are chosen outermost, so that the circuit breaker and the
+	// rate limiter see the chosen host.
+	var host = c.Host
+	var endpoints *endpointTransport
+	if len(hosts) > 0 {
+		host = hosts[0]
+	}
+	if len(hosts) > 1 {
+		balancing := c.LoadBalancing
+		if logger != nil {
+			onChange := balancing.OnHealthChange
+			balancing.OnHealthChange = func(change EndpointHealthChange) {
+				logger.onEndpointHealthChange(change)
+				if onChange != nil {
+					onChange(change)
+				}
+			}
+		}
+		// Probes bypass the rate limiter and the circuit breaker.
+		if t := newEndpointTransport(httpClient.Transport, transport, hosts, balancing); len(t.endpoints) > 1 {
+			endpoints = t
+			httpClient.Transport = t
+		}
+	}
+
+	// Streams with their own timeouts use a client without the overall one.
+	var streamClient = httpClient
+	if httpClient.Timeout != 0 {
+		client := *httpClient
+		client.Timeout = 0
+		streamClient = &client
 	}
 
-	return &Client{
-		host:             c.Host,
+	// The logger and metrics run innermost, seeing requests as modified by
+	// the configured middlewares.
+	var middlewares = slices.Clone(c.Middlewares)
+	if logger != nil {
+		middlewares = append(middlewares, logger.middleware)
+	}
+	if c.Metrics != nil {
+		middlewares = append(middlewares, metricsMiddleware(c.Metrics))
+	}
+
+	var tracerProvider = c.TracerProvider
+	if tracerProvider == nil {
+		tracerProvider = noop.NewTracerProvider()
+	}
+
+	client := &Client{
+		host:             host,
 		defaultAPISecret: c.DefaultAPISecret,
+		secrets:          c.SecretProvider,
 		httpClient:       httpClient,
+		streamClient:     streamClient,
+		tracer:           tracerProvider.Tracer(instrumentationName),
+		retry:            c.Retry.withDefaults(),
+		middlewares:      middlewares,
+		logger:           logger,
+		endpoints:        endpoints,
+		datasets:         maps.Clone(c.Datasets),
+		cache:            newResponseCache(c.Cache),
+		streamDefaults: streamOptions{
+			strict:            c.StrictStreamDecoding,
+			firstEventTimeout: c.StreamFirstEventTimeout,
+			idleTimeout:       c.StreamIdleTimeout,
+			totalTimeout:      c.StreamTimeout,
+		},
+	}
+	for name, app := range c.Apps {
+		if app.Secret == "" && app.SecretProvider == nil {
+			app.Secret, app.SecretProvider = c.DefaultAPISecret, c.SecretProvider
+		}
+		if err := client.apps.register(client, name, app); err != nil {
+			client.apps.reject(name, err)
+		}
+	}
+	return client
+}
+
+// Close stops the health probes of ClientConfig.LoadBalancing. The client
+// can still be used afterwards.
+func (c *Client) Close() error {
+	if c.endpoints != nil {
+		c.endpoints.close()
 	}
+	return nil
+}
+
+// taskContext sends the calls of ctx to the endpoint running taskID.
+func (c *Client) taskContext(ctx context.Context, taskID string) context.Context {
+	if c.endpoints == nil {
+		return ctx
+	}
+	return c.endpoints.taskContext(ctx, taskID)
 }
 
 func NewClient(host, defaultAPISecret string) *Client {
@@ -37,37 +177,95 @@ func NewClient(host, defaultAPISecret string) *Client {
 	})
 }
 
-func (c *Client) sendRequest(req *http.Request) (*http.Response, error) {
-	return c.httpClient.Do(req)
+// sendRequest sends req through the middlewares inside a call span, which
+// ends when the response body is closed. Failed attempts are retried
+// following the client's retry policy within scope, and a call rejected with
+// the secret of a SecretProvider once more with the refreshed secret.
+func (c *Client) sendRequest(req *http.Request, scope retryScope) (*http.Response, error) {
+	req, ct := c.startCallTrace(req)
+	observed := &observedStream{}
+	req = req.WithContext(withObservedStream(req.Context(), observed))
+	httpClient := c.httpClient
+	if hasStreamWatchdog(req.Context()) {
+		httpClient = c.streamClient
+	}
+	send := chainMiddlewares(c.middlewares, func(req *http.Request) (*http.Response, error) {
+		return c.doWithSecretRefresh(req, func(req *http.Request) (*http.Response, error) {
+			return c.doWithRetry(httpClient, req, scope, func(attempt int, delay time.Duration) {
+				ct.recordRetry(attempt, delay)
+				if c.logger != nil {
+					c.logger.onRetry(req, attempt, delay)
+				}
+			})
+		})
+	})
+	resp, err := send(req)
+	if err != nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		ct.recordError(err)
+		ct.end()
+		return nil, err
+	}
+	ct.recordResponse(resp)
+	resp.Body = &tracedBody{ReadCloser: resp.Body, ct: ct, observed: observed}
+	return resp, nil
+}
+
+// sendStreamRequest sends a streaming request and turns a non-2xx answer into
+// an *APIError, so callers only ever receive a response carrying an event
+// stream.
+func (c *Client) sendStreamRequest(req *http.Request) (*http.Response, error) {
+	req = req.WithContext(withStreamingCall(req.Context()))
+	resp, err := c.sendRequest(req, retryAll)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(req, resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
 }
 
 func (c *Client) sendJSONRequest(req *http.Request, res interface{}) error {
-	resp, err := c.sendRequest(req)
+	resp, err := c.sendRequest(req, retryAll)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		var errBody struct {
-			Code    string `json:"code"`
-			Message string `json:"message"`
-			Status  int    `json:"status"`
-		}
-		err = json.NewDecoder(resp.Body).Decode(&errBody)
-		if err != nil {
-			return err
-		}
-		return fmt.Errorf("HTTP response error: [%v]%v", errBody.Code, errBody.Message)
+	if err := checkResponse(req, resp); err != nil {
+		return err
 	}
 
 	err = json.NewDecoder(resp.Body).Decode(res)
 	if err != nil {
 		return err
 	}
+	if usage, ok := reportedUsage(res); ok {
+		if ct := responseTrace(resp); ct != nil {
+			ct.recordUsage(usage)
+		}
+	}
 	return nil
 }
 
+// checkResponse returns an *APIError for a non-2xx response to req. The
+// request is the one given to sendRequest: resp.Request may be unset by a
+// custom RoundTripper.
+func checkResponse(req *http.Request, resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	apiErr := newAPIError(req, resp)
+	if ct := responseTrace(resp); ct != nil {
+		ct.recordErrorCode(apiErr.Code)
+	}
+	return apiErr
+}
+
 func (c *Client) getHost() string {
 	var host = strings.TrimSuffix(c.host, "/")
 	return host
@@ -1,13 +1,103 @@
 package dify
 
 import (
+	"log/slog"
 	"net/http"
 	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ClientConfig struct {
 	Host             string
 	DefaultAPISecret string
 	Timeout          time.Duration
-	Transport        *http.Transport
+
+	// SecretProvider supplies the secret of every call instead of
+	// DefaultAPISecret, for secrets rotated while the client runs. Calls
+	// rejected with a 401 are sent once more after a refresh. See
+	// SecretProvider.
+	SecretProvider SecretProvider
+
+	// Apps registers apps by name, see Client.App. Apps without a secret use
+	// SecretProvider or DefaultAPISecret. Client.App and Client.VerifyApps
+	// return the error of an app that could not be registered, which
+	// Validate reports beforehand.
+	Apps map[string]AppConfig
+	// Datasets holds knowledge base API keys by name, see Client.DatasetKey.
+	Datasets map[string]string
+
+	// Transport sends the requests, http.DefaultTransport when nil.
+	// HTTPClient is used instead of a new http.Client, keeping its cookie
+	// jar and redirect policy; its Transport is used when Transport is nil,
+	// and its Timeout when Timeout is zero. Neither is modified.
+	Transport  http.RoundTripper
+	HTTPClient *http.Client
+
+	// ProxyURL sends every call through an HTTP or HTTPS proxy. When empty,
+	// the proxy comes from HTTP_PROXY, HTTPS_PROXY and NO_PROXY. TLS trusts
+	// private CAs and presents a client certificate. Host and Hosts can also
+	// be Unix sockets, such as "unix:///var/run/dify.sock". These options
+	// apply to an *http.Transport only, a nil one or a clone of Transport;
+	// with another round tripper, calls fail with ErrTransportOptions.
+	ProxyURL string
+	TLS      *TLSOptions
+
+	// Hosts spreads calls across several Dify base URLs serving the same
+	// apps, after Host if it is set, following LoadBalancing.
+	Hosts         []string
+	LoadBalancing LoadBalancing
+
+	// Middlewares wrap every API call, the first one outermost. See
+	// Middleware.
+	Middlewares []Middleware
+
+	// Retry retries failed requests, see RetryPolicy. Requests are not
+	// retried when nil.
+	Retry *RetryPolicy
+
+	// BlockingRateLimit and StreamingRateLimit limit blocking and streaming
+	// calls separately, per API secret. OnRateLimitWait is called whenever a
+	// call had to wait for either.
+	BlockingRateLimit  RateLimit
+	StreamingRateLimit RateLimit
+	OnRateLimitWait    func(RateLimitWait)
+
+	// CircuitBreaker fails calls fast with ErrCircuitOpen while a host keeps
+	// failing for an API secret, see CircuitBreaker. Disabled when nil.
+	CircuitBreaker *CircuitBreaker
+
+	// Cache serves Parameters, Info, Meta and Site from a cache, see
+	// ResponseCache. Disabled when nil.
+	Cache *ResponseCache
+
+	// StrictStreamDecoding ends every stream on its first malformed event
+	// instead of skipping it, see WithStrictDecoding.
+	StrictStreamDecoding bool
+
+	// StreamFirstEventTimeout, StreamIdleTimeout and StreamTimeout limit
+	// streaming calls, see WithFirstEventTimeout, WithIdleTimeout and
+	// WithStreamTimeout. A stream with any of them set is not subject to
+	// Timeout, which would otherwise end long but healthy streams.
+	StreamFirstEventTimeout time.Duration
+	StreamIdleTimeout       time.Duration
+	StreamTimeout           time.Duration
+
+	// Logger receives a record for every call, retry and stream. Nothing is
+	// logged when nil. Request, response and stream event bodies are only
+	// logged with LogBodies, truncated to LogBodyLimit bytes (4KB by
+	// default), and the JSON fields named in LogRedactFields, such as
+	// "query" or "password", are replaced at any depth.
+	Logger          *slog.Logger
+	LogBodies       bool
+	LogBodyLimit    int
+	LogRedactFields []string
+
+	// Metrics receives request counts, latencies, error codes, stream
+	// timings and token usage of every call, see MemoryMetrics.
+	Metrics MetricsSink
+
+	// TracerProvider enables OpenTelemetry spans for every API call and for
+	// the nodes of workflow streams. Tracing is disabled when nil.
+	TracerProvider trace.TracerProvider
 }
@@ -0,0 +1,469 @@
+package dify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configFile is the layout of configuration files and, through the same
+// names in upper case, of DIFY_* environment variables.
+type configFile struct {
+	Host       string   `json:"host" yaml:"host"`
+	Hosts      []string `json:"hosts" yaml:"hosts"`
+	APIKey     string   `json:"api_key" yaml:"api_key"`
+	APIKeyFile string   `json:"api_key_file" yaml:"api_key_file"`
+	Timeout    string   `json:"timeout" yaml:"timeout"`
+
+	Stream   configStream         `json:"stream" yaml:"stream"`
+	Retry    *configRetry         `json:"retry" yaml:"retry"`
+	ProxyURL string               `json:"proxy_url" yaml:"proxy_url"`
+	TLS      *configTLS           `json:"tls" yaml:"tls"`
+	Apps     map[string]configApp `json:"apps" yaml:"apps"`
+	Datasets map[string]string    `json:"datasets" yaml:"datasets"`
+}
+
+type configStream struct {
+	FirstEventTimeout string `json:"first_event_timeout" yaml:"first_event_timeout"`
+	IdleTimeout       string `json:"idle_timeout" yaml:"idle_timeout"`
+	Timeout           string `json:"timeout" yaml:"timeout"`
+}
+
+type configRetry struct {
+	MaxAttempts *int   `json:"max_attempts" yaml:"max_attempts"`
+	MinBackoff  string `json:"min_backoff" yaml:"min_backoff"`
+	MaxBackoff  string `json:"max_backoff" yaml:"max_backoff"`
+}
+
+type configTLS struct {
+	CAFile     string `json:"ca_file" yaml:"ca_file"`
+	CertFile   string `json:"cert_file" yaml:"cert_file"`
+	KeyFile    string `json:"key_file" yaml:"key_file"`
+	ServerName string `json:"server_name" yaml:"server_name"`
+}
+
+type configApp struct {
+	APIKey     string `json:"api_key" yaml:"api_key"`
+	APIKeyFile string `json:"api_key_file" yaml:"api_key_file"`
+	Mode       string `json:"mode" yaml:"mode"`
+}
+
+// LoadConfig reads a client configuration from a YAML or JSON file, if path
+// is not empty, then from DIFY_* environment variables, which take
+// precedence. The file format follows its extension, YAML unless ".json":
+//
+//	host: https://dify.example.com
+//	hosts: [https://dify-west.example.com]
+//	api_key: app-...           # or api_key_file: /run/secrets/dify-api-key
+//	timeout: 30s
+//	stream: {first_event_timeout: 10s, idle_timeout: 30s, timeout: 5m}
+//	retry: {max_attempts: 3, min_backoff: 500ms, max_backoff: 10s}
+//	proxy_url: http://proxy.internal:3128
+//	tls: {ca_file: ca.pem, cert_file: client.pem, key_file: client.key, server_name: dify.internal}
+//	apps:
+//	  support-bot: {api_key: app-..., mode: chat}
+//	  reports: {api_key_file: /run/secrets/dify-reports, mode: workflow}
+//	datasets:
+//	  manuals: dataset-...
+//
+// The environment variables are DIFY_HOST, DIFY_HOSTS (comma separated),
+// DIFY_API_KEY, DIFY_API_KEY_FILE, DIFY_TIMEOUT,
+// DIFY_STREAM_FIRST_EVENT_TIMEOUT, DIFY_STREAM_IDLE_TIMEOUT,
+// DIFY_STREAM_TIMEOUT, DIFY_RETRY_MAX_ATTEMPTS, DIFY_RETRY_MIN_BACKOFF,
+// DIFY_RETRY_MAX_BACKOFF, DIFY_PROXY_URL, DIFY_TLS_CA_FILE,
+// DIFY_TLS_CERT_FILE, DIFY_TLS_KEY_FILE, DIFY_TLS_SERVER_NAME, and
+// DIFY_APP_<NAME>_API_KEY, DIFY_APP_<NAME>_API_KEY_FILE, DIFY_APP_<NAME>_MODE
+// and DIFY_DATASET_<NAME>_API_KEY, where <NAME> is the app or dataset name in
+// upper case with underscores for dashes.
+//
+// Keys given as files are read through a FileSecret, so that they can be
+// rotated while the client runs, and take precedence over keys given
+// directly. Hosts ending in /v1 are trimmed, since the client adds it. The
+// loaded configuration is validated and every problem is reported in the
+// returned error.
+func LoadConfig(path string) (*ClientConfig, error) {
+	var f configFile
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("dify: reading config: %w", err)
+		}
+		if err := f.parse(data, strings.EqualFold(filepath.Ext(path), ".json")); err != nil {
+			return nil, fmt.Errorf("dify: parsing %s: %w", path, err)
+		}
+	}
+	f.applyEnv(os.Environ())
+
+	c, errs := f.clientConfig()
+	if err := c.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// LoadConfigFromEnv reads a client configuration from DIFY_* environment
+// variables, see LoadConfig.
+func LoadConfigFromEnv() (*ClientConfig, error) {
+	return LoadConfig("")
+}
+
+func (f *configFile) parse(data []byte, isJSON bool) error {
+	if isJSON {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		return dec.Decode(f)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(f); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// applyEnv overrides f with the DIFY_* variables of environ.
+func (f *configFile) applyEnv(environ []string) {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, "DIFY_") && v != "" {
+			env[k] = v
+		}
+	}
+	set := func(dst *string, key string) {
+		if v, ok := env[key]; ok {
+			*dst = v
+		}
+	}
+
+	set(&f.Host, "DIFY_HOST")
+	if v, ok := env["DIFY_HOSTS"]; ok {
+		f.Hosts = nil
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				f.Hosts = append(f.Hosts, h)
+			}
+		}
+	}
+	set(&f.APIKey, "DIFY_API_KEY")
+	set(&f.APIKeyFile, "DIFY_API_KEY_FILE")
+	set(&f.Timeout, "DIFY_TIMEOUT")
+	set(&f.Stream.FirstEventTimeout, "DIFY_STREAM_FIRST_EVENT_TIMEOUT")
+	set(&f.Stream.IdleTimeout, "DIFY_STREAM_IDLE_TIMEOUT")
+	set(&f.Stream.Timeout, "DIFY_STREAM_TIMEOUT")
+	set(&f.ProxyURL, "DIFY_PROXY_URL")
+
+	for _, key := range []string{"DIFY_RETRY_MAX_ATTEMPTS", "DIFY_RETRY_MIN_BACKOFF", "DIFY_RETRY_MAX_BACKOFF"} {
+		if _, ok := env[key]; ok && f.Retry == nil {
+			f.Retry = &configRetry{}
+		}
+	}
+	if f.Retry != nil {
+		if v, ok := env["DIFY_RETRY_MAX_ATTEMPTS"]; ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				// Reported by clientConfig as an invalid value.
+				n = -1
+			}
+			f.Retry.MaxAttempts = &n
+		}
+		set(&f.Retry.MinBackoff, "DIFY_RETRY_MIN_BACKOFF")
+		set(&f.Retry.MaxBackoff, "DIFY_RETRY_MAX_BACKOFF")
+	}
+
+	for _, key := range []string{"DIFY_TLS_CA_FILE", "DIFY_TLS_CERT_FILE", "DIFY_TLS_KEY_FILE", "DIFY_TLS_SERVER_NAME"} {
+		if _, ok := env[key]; ok && f.TLS == nil {
+			f.TLS = &configTLS{}
+		}
+	}
+	if f.TLS != nil {
+		set(&f.TLS.CAFile, "DIFY_TLS_CA_FILE")
+		set(&f.TLS.CertFile, "DIFY_TLS_CERT_FILE")
+		set(&f.TLS.KeyFile, "DIFY_TLS_KEY_FILE")
+		set(&f.TLS.ServerName, "DIFY_TLS_SERVER_NAME")
+	}
+
+	for k, v := range env {
+		if name, ok := envName(k, "DIFY_APP_", "_API_KEY"); ok {
+			app := f.Apps[name]
+			app.APIKey = v
+			f.setApp(name, app)
+		} else if name, ok := envName(k, "DIFY_APP_", "_API_KEY_FILE"); ok {
+			app := f.Apps[name]
+			app.APIKeyFile = v
+			f.setApp(name, app)
+		} else if name, ok := envName(k, "DIFY_APP_", "_MODE"); ok {
+			app := f.Apps[name]
+			app.Mode = v
+			f.setApp(name, app)
+		} else if name, ok := envName(k, "DIFY_DATASET_", "_API_KEY"); ok {
+			if f.Datasets == nil {
+				f.Datasets = make(map[string]string)
+			}
+			f.Datasets[name] = v
+		}
+	}
+}
+
+func (f *configFile) setApp(name string, app configApp) {
+	if f.Apps == nil {
+		f.Apps = make(map[string]configApp)
+	}
+	f.Apps[name] = app
+}
+
+// envName extracts the app or dataset name of a variable such as
+// DIFY_APP_SUPPORT_BOT_API_KEY, "support-bot".
+func envName(key, prefix, suffix string) (string, bool) {
+	name, ok := strings.CutPrefix(key, prefix)
+	if !ok {
+		return "", false
+	}
+	name, ok = strings.CutSuffix(name, suffix)
+	if !ok || name == "" {
+		return "", false
+	}
+	return strings.ReplaceAll(strings.ToLower(name), "_", "-"), true
+}
+
+// clientConfig converts f, returning the values that could not be parsed.
+func (f *configFile) clientConfig() (*ClientConfig, []error) {
+	var errs []error
+	secretFile := func(field, path string) SecretProvider {
+		if path == "" {
+			return nil
+		}
+		secret := NewFileSecret(path)
+		if _, err := secret.Secret(context.Background()); err != nil {
+			errs = append(errs, fmt.Errorf("dify: config %s: %w", field, err))
+		}
+		return secret
+	}
+	duration := func(field, v string) time.Duration {
+		if v == "" {
+			return 0
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("dify: config %s: invalid duration %q", field, v))
+		}
+		return d
+	}
+
+	c := &ClientConfig{
+		Host:                    normalizeHost(f.Host),
+		DefaultAPISecret:        f.APIKey,
+		SecretProvider:          secretFile("api_key_file", f.APIKeyFile),
+		Timeout:                 duration("timeout", f.Timeout),
+		ProxyURL:                f.ProxyURL,
+		StreamFirstEventTimeout: duration("stream.first_event_timeout", f.Stream.FirstEventTimeout),
+		StreamIdleTimeout:       duration("stream.idle_timeout", f.Stream.IdleTimeout),
+		StreamTimeout:           duration("stream.timeout", f.Stream.Timeout),
+	}
+	for _, h := range f.Hosts {
+		c.Hosts = append(c.Hosts, normalizeHost(h))
+	}
+	if f.Retry != nil {
+		c.Retry = &RetryPolicy{
+			MinBackoff: duration("retry.min_backoff", f.Retry.MinBackoff),
+			MaxBackoff: duration("retry.max_backoff", f.Retry.MaxBackoff),
+		}
+		if f.Retry.MaxAttempts != nil {
+			if *f.Retry.MaxAttempts < 1 {
+				errs = append(errs, errors.New("dify: config retry.max_attempts: must be a number of at least 1"))
+			}
+			c.Retry.MaxAttempts = *f.Retry.MaxAttempts
+		}
+	}
+	if f.TLS != nil {
+		c.TLS = &TLSOptions{
+			CAFile:     f.TLS.CAFile,
+			CertFile:   f.TLS.CertFile,
+			KeyFile:    f.TLS.KeyFile,
+			ServerName: f.TLS.ServerName,
+		}
+	}
+	if len(f.Apps) > 0 {
+		c.Apps = make(map[string]AppConfig, len(f.Apps))
+		for name, app := range f.Apps {
+			c.Apps[name] = AppConfig{
+				Secret:         app.APIKey,
+				SecretProvider: secretFile("apps."+name+".api_key_file", app.APIKeyFile),
+				Mode:           AppMode(app.Mode),
+			}
+		}
+	}
+	if len(f.Datasets) > 0 {
+		c.Datasets = make(map[string]string, len(f.Datasets))
+		for name, key := range f.Datasets {
+			c.Datasets[name] = key
+		}
+	}
+	return c, errs
+}
+
+// normalizeHost trims the trailing slashes of a host and a /v1 that the
+// client would add again.
+func normalizeHost(host string) string {
+	host = strings.TrimRight(strings.TrimSpace(host), "/")
+	if strings.HasSuffix(host, "/v1") && !strings.HasPrefix(host, unixHostPrefix) {
+		host = strings.TrimRight(strings.TrimSuffix(host, "/v1"), "/")
+	}
+	return host
+}
+
+var appModes = []AppMode{AppModeChat, AppModeAgentChat, AppModeAdvancedChat, AppModeCompletion, AppModeWorkflow}
+
+// Validate checks the hosts, secrets, app modes, timeouts, retry policy and
+// TLS options of c, and returns every problem found.
+func (c *ClientConfig) Validate() error {
+	var errs []error
+	problem := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf("dify: config "+format, args...))
+	}
+
+	if c.Host == "" && len(c.Hosts) == 0 {
+		problem("host: not set")
+	}
+	for _, h := range append([]string{c.Host}, c.Hosts...) {
+		if h == "" {
+			continue
+		}
+		if err := validateHost(h); err != nil {
+			problem("host %q: %v", h, err)
+		}
+	}
+
+	defaultSecret := c.DefaultAPISecret != "" || c.SecretProvider != nil
+	if !defaultSecret && len(c.Apps) == 0 {
+		problem("api_key: not set, and no apps are configured")
+	}
+	names := make([]string, 0, len(c.Apps))
+	for name := range c.Apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		app := c.Apps[name]
+		if name == "" {
+			problem("apps: empty app name")
+		}
+		if app.Secret == "" && app.SecretProvider == nil && !defaultSecret {
+			problem("apps.%s.api_key: not set", name)
+		}
+		if app.Mode != "" && !slices.Contains(appModes, app.Mode) {
+			problem("apps.%s.mode: unknown mode %q", name, app.Mode)
+		}
+	}
+	for name, key := range c.Datasets {
+		if key == "" {
+			problem("datasets.%s: no API key", name)
+		}
+	}
+
+	for field, d := range map[string]time.Duration{
+		"timeout":                    c.Timeout,
+		"stream.first_event_timeout": c.StreamFirstEventTimeout,
+		"stream.idle_timeout":        c.StreamIdleTimeout,
+		"stream.timeout":             c.StreamTimeout,
+	} {
+		if d < 0 {
+			problem("%s: negative duration %v", field, d)
+		}
+	}
+	if r := c.Retry; r != nil {
+		if r.MinBackoff < 0 || r.MaxBackoff < 0 {
+			problem("retry: negative backoff")
+		}
+		if r.MaxBackoff > 0 && r.MinBackoff > r.MaxBackoff {
+			problem("retry: min_backoff %v is above max_backoff %v", r.MinBackoff, r.MaxBackoff)
+		}
+		if r.Jitter < 0 || r.Jitter > 1 {
+			problem("retry: jitter %v is not between 0 and 1", r.Jitter)
+		}
+	}
+
+	if c.ProxyURL != "" || c.TLS != nil || c.hasUnixHost() {
+		base := c.Transport
+		if base == nil && c.HTTPClient != nil {
+			base = c.HTTPClient.Transport
+		}
+		if _, ok := base.(*http.Transport); base != nil && !ok {
+			problem("transport: proxy_url, tls and unix:// hosts cannot be applied to a %T", base)
+		}
+	}
+	if c.ProxyURL != "" {
+		if u, err := url.Parse(c.ProxyURL); err != nil || u.Host == "" {
+			problem("proxy_url %q: not a URL", c.ProxyURL)
+		}
+	}
+	if t := c.TLS; t != nil {
+		if (t.CertFile == "") != (t.KeyFile == "") || (len(t.CertPEM) == 0) != (len(t.KeyPEM) == 0) {
+			problem("tls: a client certificate needs both a certificate and a key")
+		}
+		for field, path := range map[string]string{"ca_file": t.CAFile, "cert_file": t.CertFile, "key_file": t.KeyFile} {
+			if path == "" {
+				continue
+			}
+			if _, err := os.Stat(path); err != nil {
+				problem("tls.%s: %v", field, err)
+			}
+		}
+	}
+	sortErrors(errs)
+	return errors.Join(errs...)
+}
+
+func (c *ClientConfig) hasUnixHost() bool {
+	for _, h := range append([]string{c.Host}, c.Hosts...) {
+		if strings.HasPrefix(h, unixHostPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateHost(h string) error {
+	if path, ok := strings.CutPrefix(h, unixHostPrefix); ok {
+		if path == "" {
+			return errors.New("no socket path")
+		}
+		return nil
+	}
+	u, err := url.Parse(h)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("scheme must be http, https or unix")
+	}
+	if u.Host == "" {
+		return errors.New("no host name")
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return errors.New("must not have a query or fragment")
+	}
+	return nil
+}
+
+// sortErrors orders errors by message, for reports that do not depend on
+// map iteration.
+func sortErrors(errs []error) {
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+}
@@ -0,0 +1,33 @@
+package dify
+
+import "testing"
+
+func TestNormalizeHost(t *testing.T) {
+	tests := map[string]string{
+		"https://dify.example.com":        "https://dify.example.com",
+		"https://dify.example.com/":       "https://dify.example.com",
+		"https://dify.example.com/v1":     "https://dify.example.com",
+		"https://dify.example.com/v1/":    "https://dify.example.com",
+		"https://example.com/dify/v1":     "https://example.com/dify",
+		" https://dify.example.com/api/ ": "https://dify.example.com/api",
+		"unix:///var/run/v1":              "unix:///var/run/v1",
+		"https://dify.example.com/v10":    "https://dify.example.com/v10",
+	}
+	for host, want := range tests {
+		if got := normalizeHost(host); got != want {
+			t.Errorf("normalizeHost(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	if name, ok := envName("DIFY_APP_SUPPORT_BOT_API_KEY", "DIFY_APP_", "_API_KEY"); !ok || name != "support-bot" {
+		t.Errorf("envName = %q, %v", name, ok)
+	}
+	if _, ok := envName("DIFY_APP__API_KEY", "DIFY_APP_", "_API_KEY"); ok {
+		t.Error("envName accepted an empty name")
+	}
+	if _, ok := envName("DIFY_API_KEY", "DIFY_APP_", "_API_KEY"); ok {
+		t.Error("envName accepted DIFY_API_KEY")
+	}
+}
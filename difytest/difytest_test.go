@@ -0,0 +1,355 @@
+package difytest_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/zruijie/dify-sdk-go"
+	"github.com/zruijie/dify-sdk-go/difytest"
+)
+
+func TestChatConversation(t *testing.T) {
+	srv := difytest.NewServer()
+	defer srv.Close()
+	api := srv.Client().API()
+	ctx := context.Background()
+
+	srv.Enqueue(difytest.EndpointChat, difytest.Response{Answer: "Hello Alice!"})
+	first, err := api.ChatMessages(ctx, &dify.ChatMessageRequest{Query: "I am Alice", User: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Answer != "Hello Alice!" || first.ConversationID == "" || first.Metadata.Usage.TotalTokens == 0 {
+		t.Fatalf("first answer = %+v", first)
+	}
+	second, err := api.ChatMessages(ctx, &dify.ChatMessageRequest{Query: "Who am I?", User: "alice", ConversationID: first.ConversationID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Answer != "Who am I?" || second.ConversationID != first.ConversationID {
+		t.Fatalf("second answer = %+v, want the echo in the same conversation", second)
+	}
+
+	messages, err := api.Messages(ctx, &dify.MessagesRequest{ConversationID: first.ConversationID, User: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages.Data) != 2 || messages.Data[0].Query != "I am Alice" || messages.Data[1].Answer != "Who am I?" {
+		t.Fatalf("messages = %+v", messages.Data)
+	}
+	page, err := api.Messages(ctx, &dify.MessagesRequest{ConversationID: first.ConversationID, User: "alice", FirstID: second.ID, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Data) != 1 || page.Data[0].ID != first.ID || page.HasMore {
+		t.Fatalf("page before the second message = %+v", page)
+	}
+
+	conversations, err := api.Conversations(ctx, &dify.ConversationsRequest{User: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conversations.Data) != 1 || conversations.Data[0].ID != first.ConversationID {
+		t.Fatalf("conversations = %+v", conversations.Data)
+	}
+	if _, err := api.ConversationsRenaming(ctx, &dify.ConversationsRenamingRequest{ConversationID: first.ConversationID, Name: "Intro", User: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if conv, _ := srv.Conversation(first.ConversationID); conv.Name != "Intro" || len(conv.Messages) != 2 {
+		t.Fatalf("conversation = %+v", conv)
+	}
+
+	// Conversations belong to their user.
+	_, err = api.ChatMessages(ctx, &dify.ChatMessageRequest{Query: "Hi", User: "bob", ConversationID: first.ConversationID})
+	var apiErr *dify.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || apiErr.Code != "not_found" {
+		t.Fatalf("chat in the conversation of another user: err = %v", err)
+	}
+}
+
+func TestConversationsOrder(t *testing.T) {
+	srv := difytest.NewServer()
+	defer srv.Close()
+	api := srv.Client().API()
+	ctx := context.Background()
+
+	var ids []string
+	for _, query := range []string{"one", "two", "three"} {
+		resp, err := api.ChatMessages(ctx, &dify.ChatMessageRequest{Query: query, User: "alice"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, resp.ConversationID)
+	}
+	// A new message moves its conversation first.
+	if _, err := api.ChatMessages(ctx, &dify.ChatMessageRequest{Query: "again", User: "alice", ConversationID: ids[0]}); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := api.Conversations(ctx, &dify.ConversationsRequest{User: "alice", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Data) != 2 || page.Data[0].ID != ids[0] || page.Data[1].ID != ids[2] || !page.HasMore {
+		t.Fatalf("first page = %+v", page)
+	}
+	page, err = api.Conversations(ctx, &dify.ConversationsRequest{User: "alice", Limit: 2, LastID: page.Data[1].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Data) != 1 || page.Data[0].ID != ids[1] || page.HasMore {
+		t.Fatalf("second page = %+v", page)
+	}
+}
+
+func TestStreamScript(t *testing.T) {
+	srv := difytest.NewServer()
+	defer srv.Close()
+	api := srv.Client().API()
+
+	srv.Enqueue(difytest.EndpointChat, difytest.Response{Events: []difytest.Event{
+		difytest.MessageEvent("Hel"),
+		difytest.PingEvent().After(20 * time.Millisecond),
+		difytest.MessageEvent("lo"),
+		difytest.ErrorEvent(http.StatusBadRequest, "quota_exceeded", "quota exceeded"),
+	}})
+	start := time.Now()
+	stream, err := api.StreamChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "Hi", User: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	var answer string
+	for stream.Next() {
+		ev := stream.Current()
+		if ev.TaskID == "" || ev.ConversationID == "" || ev.MessageID == "" {
+			t.Errorf("event %+v lacks ids", ev)
+		}
+		answer += ev.Answer
+	}
+	var streamErr *dify.StreamError
+	if !errors.As(stream.Err(), &streamErr) || streamErr.Code != "quota_exceeded" {
+		t.Fatalf("stream err = %v, want the scripted error event", stream.Err())
+	}
+	if answer != "Hello" {
+		t.Errorf("answer = %q, want %q", answer, "Hello")
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("stream took %v, want the scripted delay", elapsed)
+	}
+}
+
+func TestStreamDefault(t *testing.T) {
+	srv := difytest.NewServer()
+	defer srv.Close()
+
+	stream, err := srv.Client().API().StreamChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "how are you", User: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	var events []string
+	var answer string
+	var usage dify.Usage
+	for stream.Next() {
+		ev := stream.Current()
+		events = append(events, ev.Event)
+		answer += ev.Answer
+		if ev.Metadata != nil {
+			usage = ev.Metadata.Usage
+		}
+	}
+	if err := stream.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if answer != "how are you" || len(events) != 4 || events[3] != "message_end" || usage.TotalTokens != 6 {
+		t.Fatalf("events = %v, answer = %q, usage = %+v", events, answer, usage)
+	}
+}
+
+func TestStop(t *testing.T) {
+	srv := difytest.NewServer()
+	defer srv.Close()
+	api := srv.Client().API()
+	ctx := context.Background()
+
+	srv.Enqueue(difytest.EndpointChat, difytest.Response{Events: []difytest.Event{
+		difytest.MessageEvent("partial"),
+		difytest.MessageEvent(" never sent").After(time.Minute),
+	}})
+	stream, err := api.StreamChatMessages(ctx, &dify.ChatMessageRequest{Query: "Hi", User: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if !stream.Next() {
+		t.Fatal(stream.Err())
+	}
+	resp, err := api.StopChatMessages(ctx, &dify.StopRequest{TaskID: stream.Current().TaskID, User: "alice"})
+	if err != nil || resp.Result != "success" {
+		t.Fatalf("stop = %+v, %v", resp, err)
+	}
+	if stream.Next() {
+		t.Fatalf("stream went on after stop with %+v", stream.Current())
+	}
+	if err := stream.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWorkflow(t *testing.T) {
+	srv := difytest.NewServer()
+	defer srv.Close()
+	api := srv.Client().API()
+	ctx := context.Background()
+
+	srv.Enqueue(difytest.EndpointWorkflow, difytest.Response{Outputs: map[string]any{"summary": "short"}})
+	resp, err := api.RunWorkflow(ctx, dify.WorkflowRequest{Inputs: map[string]any{"text": "long"}, User: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data.Status != "succeeded" || resp.Data.Outputs["summary"] != "short" {
+		t.Fatalf("run = %+v", resp)
+	}
+
+	var events []string
+	var outputs map[string]any
+	err = api.RunStreamWorkflow(ctx, dify.WorkflowRequest{Inputs: map[string]any{"text": "echo"}, User: "alice"}, func(ev dify.StreamingResponse) {
+		events = append(events, ev.Event)
+		if ev.Event == "workflow_finished" {
+			outputs = ev.Data.Outputs
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"workflow_started", "node_started", "node_finished", "workflow_finished"}
+	if len(events) != len(want) || events[0] != want[0] || events[3] != want[3] || outputs["text"] != "echo" {
+		t.Fatalf("events = %v, outputs = %v", events, outputs)
+	}
+}
+
+func TestCompletionAndFeedback(t *testing.T) {
+	srv := difytest.NewServer()
+	defer srv.Close()
+	api := srv.Client().API()
+	ctx := context.Background()
+
+	resp, err := api.CompletionMessages(ctx, &dify.CompletionMessageRequest{Inputs: map[string]any{"query": "translate"}, User: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Answer != "translate" || resp.Mode != "completion" {
+		t.Fatalf("completion = %+v", resp)
+	}
+	if _, err := api.MessagesFeedbacks(ctx, &dify.MessagesFeedbacksRequest{MessageID: resp.MessageID, Rating: "like", User: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, _ := srv.Message(resp.MessageID); msg.Feedback != "like" {
+		t.Fatalf("message = %+v, want the feedback", msg)
+	}
+	_, err = api.MessagesFeedbacks(ctx, &dify.MessagesFeedbacksRequest{MessageID: "missing", Rating: "like", User: "alice"})
+	var apiErr *dify.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("feedback of a missing message: err = %v", err)
+	}
+}
+
+func TestScriptedErrorsAndRequests(t *testing.T) {
+	srv := difytest.NewServer()
+	defer srv.Close()
+	api := srv.Client().API()
+	ctx := context.Background()
+
+	srv.Enqueue(difytest.EndpointParameters, difytest.Error(http.StatusBadRequest, "app_unavailable", "App unavailable"))
+	_, err := api.Parameters(ctx, &dify.ParametersRequest{User: "alice"})
+	var apiErr *dify.APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != "app_unavailable" {
+		t.Fatalf("scripted error: err = %v", err)
+	}
+	if err := srv.SetParameters(map[string]any{"opening_statement": "Welcome"}); err != nil {
+		t.Fatal(err)
+	}
+	params, err := api.Parameters(ctx, &dify.ParametersRequest{User: "alice"})
+	if err != nil || params.OpeningStatement != "Welcome" {
+		t.Fatalf("parameters = %+v, %v", params, err)
+	}
+
+	srv.Handle(difytest.EndpointChat, func(req difytest.Request) difytest.Response {
+		var body dify.ChatMessageRequest
+		req.Decode(&body)
+		return difytest.Response{Answer: "inputs: " + body.Inputs["lang"].(string)}
+	})
+	chat, err := api.ChatMessages(ctx, &dify.ChatMessageRequest{Query: "Hi", User: "alice", Inputs: map[string]any{"lang": "fr"}})
+	if err != nil || chat.Answer != "inputs: fr" {
+		t.Fatalf("handled chat = %+v, %v", chat, err)
+	}
+
+	requests := srv.RequestsTo(difytest.EndpointChat)
+	if len(requests) != 1 || requests[0].Header.Get("Authorization") != "Bearer "+difytest.DefaultAPIKey {
+		t.Fatalf("chat requests = %+v", requests)
+	}
+	if got := len(srv.Requests()); got != 3 {
+		t.Errorf("requests = %d, want 3", got)
+	}
+
+	srv.Enqueue(difytest.EndpointParameters, difytest.Response{
+		Status: http.StatusTooManyRequests, Code: "too_many_requests",
+		Header: http.Header{"Retry-After": {"3"}},
+	})
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/v1/parameters?user=alice", nil)
+	req.Header.Set("Authorization", "Bearer "+difytest.DefaultAPIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "3" {
+		t.Errorf("scripted header: status %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	_, err = dify.NewClient(srv.URL, "app-wrong").API().ChatMessages(ctx, &dify.ChatMessageRequest{Query: "Hi", User: "alice"})
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("wrong key: err = %v", err)
+	}
+}
+
+func TestFileUpload(t *testing.T) {
+	srv := difytest.NewServer()
+	defer srv.Close()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("user", "alice")
+	fw, _ := mw.CreateFormFile("file", "notes.txt")
+	fw.Write([]byte("hello"))
+	mw.Close()
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/v1/files/upload", &body)
+	req.Header.Set("Authorization", "Bearer "+difytest.DefaultAPIKey)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var uploaded struct {
+		ID        string `json:"id"`
+		Extension string `json:"extension"`
+		Size      int    `json:"size"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&uploaded); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusCreated || uploaded.Extension != "txt" || uploaded.Size != 5 {
+		t.Fatalf("upload = %d %+v", resp.StatusCode, uploaded)
+	}
+	if f, ok := srv.File(uploaded.ID); !ok || string(f.Content) != "hello" || f.User != "alice" {
+		t.Fatalf("file = %+v", f)
+	}
+}
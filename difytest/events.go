@@ -0,0 +1,161 @@
+package difytest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Event is one server-sent event of a scripted stream.
+type Event struct {
+	// Name is the event type, such as "message", "message_end", "ping" or
+	// "workflow_finished".
+	Name string
+	// Data are the fields of the event besides "event". The ids of the
+	// call, such as task_id, message_id and conversation_id, are filled in
+	// when missing.
+	Data map[string]any
+	// Delay is waited before sending the event.
+	Delay time.Duration
+	// Raw, when set, is sent as it is instead of the event, for malformed
+	// streams.
+	Raw string
+}
+
+// After returns e sent after a delay d.
+func (e Event) After(d time.Duration) Event {
+	e.Delay = d
+	return e
+}
+
+// MessageEvent returns a "message" event carrying a chunk of the answer.
+func MessageEvent(answer string) Event {
+	return Event{Name: "message", Data: map[string]any{"answer": answer}}
+}
+
+// MessageEndEvent returns a "message_end" event reporting usage.
+func MessageEndEvent(promptTokens, completionTokens int) Event {
+	return Event{Name: "message_end", Data: map[string]any{
+		"metadata": map[string]any{"usage": usage(promptTokens, completionTokens)},
+	}}
+}
+
+// PingEvent returns the keep-alive event Dify sends every 10 seconds.
+func PingEvent() Event {
+	return Event{Name: "ping"}
+}
+
+// ErrorEvent returns an "error" event, which ends a stream with a
+// *dify.StreamError.
+func ErrorEvent(status int, code, message string) Event {
+	return Event{Name: "error", Data: map[string]any{"status": status, "code": code, "message": message}}
+}
+
+// WorkflowEvent returns a workflow event, such as "node_started", with data
+// as its "data" field.
+func WorkflowEvent(name string, data map[string]any) Event {
+	return Event{Name: name, Data: map[string]any{"data": data}}
+}
+
+// RawEvent returns an event sending text as it is, which should end with a
+// blank line.
+func RawEvent(text string) Event {
+	return Event{Raw: text}
+}
+
+// encode returns the event in the text/event-stream format, with the fields
+// of ids filled in when missing.
+func (e Event) encode(ids map[string]any) string {
+	if e.Raw != "" {
+		return e.Raw
+	}
+	if e.Name == "ping" {
+		return "event: ping\n\n"
+	}
+	data := map[string]any{"event": e.Name}
+	for k, v := range ids {
+		data[k] = v
+	}
+	for k, v := range e.Data {
+		data[k] = v
+	}
+	b, _ := json.Marshal(data)
+	return "data: " + string(b) + "\n\n"
+}
+
+// answerOf returns the answer carried by the message events of events.
+func answerOf(events []Event) string {
+	var b strings.Builder
+	for _, e := range events {
+		if e.Name == "message" || e.Name == "agent_message" {
+			answer, _ := e.Data["answer"].(string)
+			b.WriteString(answer)
+		}
+	}
+	return b.String()
+}
+
+// answerEvents streams answer word by word and ends with a message_end.
+func answerEvents(answer string, promptTokens int) []Event {
+	var events []Event
+	for _, chunk := range strings.SplitAfter(answer, " ") {
+		if chunk != "" {
+			events = append(events, MessageEvent(chunk))
+		}
+	}
+	return append(events, MessageEndEvent(promptTokens, tokens(answer)))
+}
+
+// stream sends events to w until they are sent, the task is stopped or the
+// client goes away.
+func stream(w http.ResponseWriter, r *http.Request, t *task, events []Event, ids map[string]any) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	for _, e := range events {
+		if e.Delay > 0 {
+			timer := time.NewTimer(e.Delay)
+			select {
+			case <-timer.C:
+			case <-t.stopped:
+				timer.Stop()
+				return
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			}
+		}
+		select {
+		case <-t.stopped:
+			return
+		default:
+		}
+		if _, err := w.Write([]byte(e.encode(ids))); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// tokens is the token count reported for text: one per word.
+func tokens(text string) int {
+	return len(strings.Fields(text))
+}
+
+func usage(promptTokens, completionTokens int) map[string]any {
+	return map[string]any{
+		"prompt_tokens":     promptTokens,
+		"completion_tokens": completionTokens,
+		"total_tokens":      promptTokens + completionTokens,
+		"total_price":       "0",
+		"currency":          "USD",
+		"latency":           0.0,
+	}
+}
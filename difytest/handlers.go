@@ -0,0 +1,534 @@
+package difytest
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zruijie/dify-sdk-go"
+)
+
+// workflowID is the id of the workflow run by the Server.
+const workflowID = "00000000-0000-4000-8000-000000000000"
+
+// Conversation is a conversation kept by the Server.
+type Conversation struct {
+	ID        string
+	User      string
+	Name      string
+	Inputs    map[string]any
+	Messages  []Message
+	CreatedAt int64
+}
+
+// Message is a chat or completion message kept by the Server. Completion
+// messages have no conversation.
+type Message struct {
+	ID             string
+	ConversationID string
+	User           string
+	Inputs         map[string]any
+	Query          string
+	Answer         string
+	// Feedback is the rating given to the message, "like" or "dislike", or
+	// empty.
+	Feedback  string
+	CreatedAt int64
+}
+
+// File is a file uploaded to the Server.
+type File struct {
+	ID        string
+	Name      string
+	Size      int
+	Extension string
+	MimeType  string
+	User      string
+	Content   []byte
+	CreatedAt int64
+}
+
+type conversation struct {
+	id        string
+	user      string
+	name      string
+	inputs    map[string]any
+	messages  []*Message
+	createdAt int64
+	// updated orders the conversations by their last message.
+	updated int
+}
+
+func (c *conversation) snapshot() Conversation {
+	out := Conversation{ID: c.id, User: c.user, Name: c.name, Inputs: c.inputs, CreatedAt: c.createdAt}
+	for _, m := range c.messages {
+		out.Messages = append(out.Messages, *m)
+	}
+	return out
+}
+
+// task is a running chat, completion or workflow call, which a stop request
+// ends.
+type task struct {
+	user    string
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func (t *task) stop() {
+	t.once.Do(func() { close(t.stopped) })
+}
+
+// Conversation returns the conversation id with its messages.
+func (s *Server) Conversation(id string) (Conversation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.conversations[id]
+	if !ok {
+		return Conversation{}, false
+	}
+	return c.snapshot(), true
+}
+
+// Message returns the message id.
+func (s *Server) Message(id string) (Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.messages[id]
+	if !ok {
+		return Message{}, false
+	}
+	return *m, true
+}
+
+// File returns the uploaded file id.
+func (s *Server) File(id string) (File, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[id]
+	if !ok {
+		return File{}, false
+	}
+	return *f, true
+}
+
+// newTask registers a running call of user. Callers hold s.mu.
+func (s *Server) newTask(user string) (string, *task) {
+	id := s.newID()
+	t := &task{user: user, stopped: make(chan struct{})}
+	s.tasks[id] = t
+	return id, t
+}
+
+// conversationOf returns the conversation id of user. Callers hold s.mu.
+func (s *Server) conversationOf(id, user string) (*conversation, bool) {
+	c, ok := s.conversations[id]
+	if !ok || c.user != user {
+		return nil, false
+	}
+	return c, true
+}
+
+func (s *Server) chat(w http.ResponseWriter, r *http.Request, req Request, script Response) {
+	var body dify.ChatMessageRequest
+	if err := req.Decode(&body); err != nil || body.Query == "" || body.User == "" {
+		writeError(w, http.StatusBadRequest, "invalid_param", "query and user are required")
+		return
+	}
+	answer := script.Answer
+	if script.Events != nil {
+		answer = answerOf(script.Events)
+	} else if answer == "" {
+		answer = body.Query
+	}
+
+	now := time.Now().Unix()
+	s.mu.Lock()
+	var conv *conversation
+	if body.ConversationID != "" {
+		var ok bool
+		if conv, ok = s.conversationOf(body.ConversationID, body.User); !ok {
+			s.mu.Unlock()
+			writeError(w, http.StatusNotFound, "not_found", "Conversation Not Exists.")
+			return
+		}
+	} else {
+		conv = &conversation{id: s.newID(), user: body.User, name: "New conversation", inputs: body.Inputs, createdAt: now}
+		s.conversations[conv.id] = conv
+	}
+	msg := &Message{ID: s.newID(), ConversationID: conv.id, User: body.User, Inputs: conv.inputs, Query: body.Query, Answer: answer, CreatedAt: now}
+	s.messages[msg.ID] = msg
+	conv.messages = append(conv.messages, msg)
+	s.seq++
+	conv.updated = s.seq
+	taskID, t := s.newTask(body.User)
+	s.mu.Unlock()
+
+	if body.ResponseMode == "streaming" {
+		events := script.Events
+		if events == nil {
+			events = answerEvents(answer, tokens(body.Query))
+		}
+		stream(w, r, t, events, map[string]any{
+			"task_id": taskID, "id": msg.ID, "message_id": msg.ID,
+			"conversation_id": conv.id, "created_at": now,
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"event": "message", "task_id": taskID, "id": msg.ID, "message_id": msg.ID,
+		"conversation_id": conv.id, "mode": "chat", "answer": answer,
+		"metadata":   map[string]any{"usage": usage(tokens(body.Query), tokens(answer))},
+		"created_at": now,
+	})
+}
+
+func (s *Server) completion(w http.ResponseWriter, r *http.Request, req Request, script Response) {
+	var body dify.CompletionMessageRequest
+	if err := req.Decode(&body); err != nil || body.User == "" {
+		writeError(w, http.StatusBadRequest, "invalid_param", "user is required")
+		return
+	}
+	query, _ := body.Inputs["query"].(string)
+	answer := script.Answer
+	if script.Events != nil {
+		answer = answerOf(script.Events)
+	} else if answer == "" {
+		answer = query
+	}
+
+	now := time.Now().Unix()
+	s.mu.Lock()
+	msg := &Message{ID: s.newID(), User: body.User, Inputs: body.Inputs, Query: query, Answer: answer, CreatedAt: now}
+	s.messages[msg.ID] = msg
+	taskID, t := s.newTask(body.User)
+	s.mu.Unlock()
+
+	if body.ResponseMode == "streaming" {
+		events := script.Events
+		if events == nil {
+			events = answerEvents(answer, tokens(query))
+		}
+		stream(w, r, t, events, map[string]any{
+			"task_id": taskID, "id": msg.ID, "message_id": msg.ID, "created_at": now,
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"event": "message", "task_id": taskID, "id": msg.ID, "message_id": msg.ID,
+		"mode": "completion", "answer": answer,
+		"metadata":   map[string]any{"usage": usage(tokens(query), tokens(answer))},
+		"created_at": now,
+	})
+}
+
+func (s *Server) workflow(w http.ResponseWriter, r *http.Request, req Request, script Response) {
+	var body dify.WorkflowRequest
+	if err := req.Decode(&body); err != nil || body.User == "" {
+		writeError(w, http.StatusBadRequest, "invalid_param", "user is required")
+		return
+	}
+	outputs := script.Outputs
+	if outputs == nil {
+		outputs = body.Inputs
+	}
+
+	now := time.Now().Unix()
+	s.mu.Lock()
+	runID := s.newID()
+	taskID, t := s.newTask(body.User)
+	s.mu.Unlock()
+
+	run := map[string]any{
+		"id": runID, "workflow_id": workflowID, "status": "succeeded", "outputs": outputs,
+		"error": nil, "elapsed_time": 0.0, "total_tokens": 0, "total_steps": 1,
+		"created_at": now, "finished_at": now,
+	}
+	if body.ResponseMode == "streaming" {
+		events := script.Events
+		if events == nil {
+			node := map[string]any{
+				"id": runID + "-start", "node_id": "start", "node_type": "start", "title": "Start",
+				"index": 1, "inputs": body.Inputs, "created_at": now,
+			}
+			finished := map[string]any{"status": "succeeded", "outputs": body.Inputs, "elapsed_time": 0.0}
+			for k, v := range node {
+				finished[k] = v
+			}
+			events = []Event{
+				WorkflowEvent("workflow_started", map[string]any{
+					"id": runID, "workflow_id": workflowID, "sequence_number": 1, "inputs": body.Inputs, "created_at": now,
+				}),
+				WorkflowEvent("node_started", node),
+				WorkflowEvent("node_finished", finished),
+				WorkflowEvent("workflow_finished", run),
+			}
+		}
+		stream(w, r, t, events, map[string]any{"task_id": taskID, "workflow_run_id": runID})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"workflow_run_id": runID, "task_id": taskID, "data": run})
+}
+
+func (s *Server) stop(w http.ResponseWriter, r *http.Request, req Request, _ Response) {
+	var body dify.StopRequest
+	if err := req.Decode(&body); err != nil || body.User == "" {
+		writeError(w, http.StatusBadRequest, "invalid_param", "user is required")
+		return
+	}
+	s.mu.Lock()
+	t, ok := s.tasks[r.PathValue("task")]
+	s.mu.Unlock()
+	// Like Dify, a stop of an unknown or finished task succeeds.
+	if ok && t.user == body.User {
+		t.stop()
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"result": "success"})
+}
+
+func (s *Server) listConversations(w http.ResponseWriter, r *http.Request, req Request, _ Response) {
+	user := req.Query.Get("user")
+	if user == "" {
+		writeError(w, http.StatusBadRequest, "invalid_param", "user is required")
+		return
+	}
+	limit, ok := pageLimit(req.Query.Get("limit"))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid_param", "limit must be between 1 and 100")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var convs []*conversation
+	for _, c := range s.conversations {
+		if c.user == user {
+			convs = append(convs, c)
+		}
+	}
+	slices.SortFunc(convs, func(a, b *conversation) int { return b.updated - a.updated })
+	if lastID := req.Query.Get("last_id"); lastID != "" {
+		i := slices.IndexFunc(convs, func(c *conversation) bool { return c.id == lastID })
+		if i < 0 {
+			writeError(w, http.StatusNotFound, "not_found", "Last Conversation Not Exists.")
+			return
+		}
+		convs = convs[i+1:]
+	}
+	hasMore := len(convs) > limit
+	data := []map[string]any{}
+	for _, c := range convs[:min(limit, len(convs))] {
+		data = append(data, conversationJSON(c))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"limit": limit, "has_more": hasMore, "data": data})
+}
+
+func (s *Server) renameConversation(w http.ResponseWriter, r *http.Request, req Request, _ Response) {
+	var body struct {
+		Name         string `json:"name"`
+		AutoGenerate bool   `json:"auto_generate"`
+		User         string `json:"user"`
+	}
+	if err := req.Decode(&body); err != nil || body.User == "" || (body.Name == "" && !body.AutoGenerate) {
+		writeError(w, http.StatusBadRequest, "invalid_param", "name and user are required")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.conversationOf(r.PathValue("id"), body.User)
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "Conversation Not Exists.")
+		return
+	}
+	c.name = body.Name
+	if body.AutoGenerate && len(c.messages) > 0 {
+		// Dify asks the model for a title; the first query stands in for it.
+		c.name = truncate(c.messages[0].Query, 20)
+	}
+	writeJSON(w, http.StatusOK, conversationJSON(c))
+}
+
+func (s *Server) deleteConversation(w http.ResponseWriter, r *http.Request, req Request, _ Response) {
+	var body struct {
+		User string `json:"user"`
+	}
+	if err := req.Decode(&body); err != nil || body.User == "" {
+		writeError(w, http.StatusBadRequest, "invalid_param", "user is required")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.conversationOf(r.PathValue("id"), body.User)
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "Conversation Not Exists.")
+		return
+	}
+	delete(s.conversations, c.id)
+	for _, m := range c.messages {
+		delete(s.messages, m.ID)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"result": "success"})
+}
+
+func (s *Server) listMessages(w http.ResponseWriter, r *http.Request, req Request, _ Response) {
+	user := req.Query.Get("user")
+	if user == "" || req.Query.Get("conversation_id") == "" {
+		writeError(w, http.StatusBadRequest, "invalid_param", "conversation_id and user are required")
+		return
+	}
+	limit, ok := pageLimit(req.Query.Get("limit"))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid_param", "limit must be between 1 and 100")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.conversationOf(req.Query.Get("conversation_id"), user)
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "Conversation Not Exists.")
+		return
+	}
+	// Pages go back in time from first_id, each in chronological order.
+	msgs := c.messages
+	if firstID := req.Query.Get("first_id"); firstID != "" {
+		i := slices.IndexFunc(msgs, func(m *Message) bool { return m.ID == firstID })
+		if i < 0 {
+			writeError(w, http.StatusNotFound, "not_found", "First Message Not Exists.")
+			return
+		}
+		msgs = msgs[:i]
+	}
+	hasMore := len(msgs) > limit
+	data := []map[string]any{}
+	for _, m := range msgs[max(len(msgs)-limit, 0):] {
+		var feedback any
+		if m.Feedback != "" {
+			feedback = map[string]any{"rating": m.Feedback}
+		}
+		data = append(data, map[string]any{
+			"id": m.ID, "conversation_id": m.ConversationID, "inputs": m.Inputs,
+			"query": m.Query, "answer": m.Answer, "feedback": feedback,
+			"message_files": []any{}, "retriever_resources": []any{}, "created_at": m.CreatedAt,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"limit": limit, "has_more": hasMore, "data": data})
+}
+
+func (s *Server) feedback(w http.ResponseWriter, r *http.Request, req Request, _ Response) {
+	var body struct {
+		Rating *string `json:"rating"`
+		User   string  `json:"user"`
+	}
+	if err := req.Decode(&body); err != nil || body.User == "" {
+		writeError(w, http.StatusBadRequest, "invalid_param", "user is required")
+		return
+	}
+	rating := ""
+	if body.Rating != nil {
+		rating = *body.Rating
+	}
+	if rating != "" && rating != "like" && rating != "dislike" {
+		writeError(w, http.StatusBadRequest, "invalid_param", "rating must be like, dislike or null")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.messages[r.PathValue("id")]
+	if !ok || m.User != body.User {
+		writeError(w, http.StatusNotFound, "not_found", "Message Not Exists.")
+		return
+	}
+	m.Feedback = rating
+	writeJSON(w, http.StatusOK, map[string]any{"result": "success"})
+}
+
+func (s *Server) getParameters(w http.ResponseWriter, r *http.Request, _ Request, _ Response) {
+	s.mu.Lock()
+	parameters := s.parameters
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(parameters)
+}
+
+func (s *Server) uploadFile(w http.ResponseWriter, r *http.Request, _ Request, _ Response) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeError(w, http.StatusBadRequest, "no_file_uploaded", "Please upload your file.")
+		return
+	}
+	user := r.FormValue("user")
+	headers := r.MultipartForm.File["file"]
+	if len(headers) == 0 {
+		writeError(w, http.StatusBadRequest, "no_file_uploaded", "Please upload your file.")
+		return
+	}
+	if len(headers) > 1 {
+		writeError(w, http.StatusBadRequest, "too_many_files", "Only one file is allowed.")
+		return
+	}
+	fh := headers[0]
+	f, err := fh.Open()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "no_file_uploaded", "Please upload your file.")
+		return
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "no_file_uploaded", "Please upload your file.")
+		return
+	}
+
+	s.mu.Lock()
+	file := &File{
+		ID:        s.newID(),
+		Name:      fh.Filename,
+		Size:      len(content),
+		Extension: filepath.Ext(fh.Filename),
+		MimeType:  fh.Header.Get("Content-Type"),
+		User:      user,
+		Content:   content,
+		CreatedAt: time.Now().Unix(),
+	}
+	if len(file.Extension) > 0 {
+		file.Extension = file.Extension[1:]
+	}
+	s.files[file.ID] = file
+	s.mu.Unlock()
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"id": file.ID, "name": file.Name, "size": file.Size, "extension": file.Extension,
+		"mime_type": file.MimeType, "created_by": file.User, "created_at": file.CreatedAt,
+	})
+}
+
+func conversationJSON(c *conversation) map[string]any {
+	updatedAt := c.createdAt
+	if n := len(c.messages); n > 0 {
+		updatedAt = c.messages[n-1].CreatedAt
+	}
+	return map[string]any{
+		"id": c.id, "name": c.name, "inputs": c.inputs, "status": "normal",
+		"introduction": "", "created_at": c.createdAt, "updated_at": updatedAt,
+	}
+}
+
+// pageLimit parses the limit of a page, 20 when empty.
+func pageLimit(s string) (int, bool) {
+	if s == "" {
+		return 20, true
+	}
+	n, err := strconv.Atoi(s)
+	return n, err == nil && n >= 1 && n <= 100
+}
+
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n]) + "..."
+}
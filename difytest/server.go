@@ -0,0 +1,306 @@
+// Package difytest provides an in-process fake Dify server for the tests of
+// applications using the SDK.
+//
+// The Server implements the chat, completion, workflow, conversation,
+// message, feedback, parameters, file upload and stop endpoints. Chat
+// messages keep their conversations in memory, so multi-turn flows, the
+// conversation list and the message history behave as with Dify. Answers
+// echo the query unless responses are scripted with Enqueue or Handle,
+// including event streams with delays, pings and errors. Every request the
+// server received can be inspected with Requests.
+//
+//	srv := difytest.NewServer()
+//	defer srv.Close()
+//	srv.Enqueue(difytest.EndpointChat, difytest.Response{Answer: "Hello!"})
+//	resp, err := srv.Client().API().ChatMessages(ctx, &dify.ChatMessageRequest{Query: "Hi", User: "alice"})
+package difytest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/zruijie/dify-sdk-go"
+)
+
+// DefaultAPIKey is the key accepted by a Server without Config.APIKey.
+const DefaultAPIKey = "app-test"
+
+// Endpoint names the endpoints of the Server, for scripting and inspecting
+// requests.
+type Endpoint string
+
+const (
+	EndpointChat               Endpoint = "chat-messages"
+	EndpointCompletion         Endpoint = "completion-messages"
+	EndpointWorkflow           Endpoint = "workflows/run"
+	EndpointStop               Endpoint = "stop"
+	EndpointConversations      Endpoint = "conversations"
+	EndpointRenameConversation Endpoint = "conversations/name"
+	EndpointDeleteConversation Endpoint = "conversations/delete"
+	EndpointMessages           Endpoint = "messages"
+	EndpointFeedback           Endpoint = "messages/feedbacks"
+	EndpointParameters         Endpoint = "parameters"
+	EndpointFileUpload         Endpoint = "files/upload"
+)
+
+// Config configures a Server.
+type Config struct {
+	// APIKey is the only key accepted, DefaultAPIKey when empty. Other keys
+	// are answered with a 401.
+	APIKey string
+}
+
+// Server is a fake Dify server. It is safe for concurrent use.
+type Server struct {
+	*httptest.Server
+	apiKey string
+
+	mu            sync.Mutex
+	requests      []Request
+	scripts       map[Endpoint][]Response
+	handlers      map[Endpoint]func(Request) Response
+	conversations map[string]*conversation
+	messages      map[string]*Message
+	files         map[string]*File
+	tasks         map[string]*task
+	parameters    []byte
+	ids           int
+	seq           int
+}
+
+// NewServer starts a Server accepting DefaultAPIKey. The caller must Close
+// it.
+func NewServer() *Server {
+	return NewServerWithConfig(Config{})
+}
+
+// NewServerWithConfig starts a Server configured by cfg. The caller must
+// Close it.
+func NewServerWithConfig(cfg Config) *Server {
+	s := &Server{
+		apiKey:        cfg.APIKey,
+		scripts:       make(map[Endpoint][]Response),
+		handlers:      make(map[Endpoint]func(Request) Response),
+		conversations: make(map[string]*conversation),
+		messages:      make(map[string]*Message),
+		files:         make(map[string]*File),
+		tasks:         make(map[string]*task),
+		parameters:    []byte(defaultParameters),
+	}
+	if s.apiKey == "" {
+		s.apiKey = DefaultAPIKey
+	}
+	mux := http.NewServeMux()
+	s.route(mux, "POST /v1/chat-messages", EndpointChat, s.chat)
+	s.route(mux, "POST /v1/completion-messages", EndpointCompletion, s.completion)
+	s.route(mux, "POST /v1/workflows/run", EndpointWorkflow, s.workflow)
+	s.route(mux, "POST /v1/chat-messages/{task}/stop", EndpointStop, s.stop)
+	s.route(mux, "POST /v1/completion-messages/{task}/stop", EndpointStop, s.stop)
+	s.route(mux, "POST /v1/workflows/tasks/{task}/stop", EndpointStop, s.stop)
+	s.route(mux, "GET /v1/conversations", EndpointConversations, s.listConversations)
+	s.route(mux, "POST /v1/conversations/{id}/name", EndpointRenameConversation, s.renameConversation)
+	s.route(mux, "DELETE /v1/conversations/{id}", EndpointDeleteConversation, s.deleteConversation)
+	s.route(mux, "GET /v1/messages", EndpointMessages, s.listMessages)
+	s.route(mux, "POST /v1/messages/{id}/feedbacks", EndpointFeedback, s.feedback)
+	s.route(mux, "GET /v1/parameters", EndpointParameters, s.getParameters)
+	s.route(mux, "POST /v1/files/upload", EndpointFileUpload, s.uploadFile)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "not_found", "The requested URL was not found on the server.")
+	})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Client returns a client of the server using its API key.
+func (s *Server) Client() *dify.Client {
+	return dify.NewClient(s.URL, s.apiKey)
+}
+
+// Request is a request received by the Server.
+type Request struct {
+	Endpoint Endpoint
+	Method   string
+	Path     string
+	Query    url.Values
+	Header   http.Header
+	Body     []byte
+}
+
+// Decode decodes the JSON body of r into v.
+func (r Request) Decode(v any) error {
+	return json.Unmarshal(r.Body, v)
+}
+
+// Requests returns the requests received so far, in order, including the
+// rejected ones.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// RequestsTo returns the requests received so far for e.
+func (s *Server) RequestsTo(e Endpoint) []Request {
+	var out []Request
+	for _, r := range s.Requests() {
+		if r.Endpoint == e {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// Response scripts the answer to one call. A Status of 400 or more answers
+// with a Dify error for any endpoint; the other fields apply to the chat,
+// completion and workflow endpoints.
+type Response struct {
+	// Status, Code and Message make up a Dify error answer.
+	Status  int
+	Code    string
+	Message string
+	// Delay is waited before answering.
+	Delay time.Duration
+	// Header is added to the headers of the answer, such as the Retry-After
+	// of an error.
+	Header http.Header
+
+	// Answer is the answer of a chat or completion message, streamed word
+	// by word. Defaults to an echo of the query.
+	Answer string
+	// Outputs are the outputs of a workflow run. Defaults to its inputs.
+	Outputs map[string]any
+	// Events replace the generated events of a streaming call, and are sent
+	// as they are, apart from the ids filled in. See MessageEvent, PingEvent
+	// and ErrorEvent.
+	Events []Event
+}
+
+// Error returns a Response answering with a Dify error.
+func Error(status int, code, message string) Response {
+	return Response{Status: status, Code: code, Message: message}
+}
+
+// Enqueue scripts the next answers of e, used once each in order before
+// the handler of e.
+func (s *Server) Enqueue(e Endpoint, responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts[e] = append(s.scripts[e], responses...)
+}
+
+// Handle scripts every answer of e that was not enqueued. A nil h restores
+// the default answers.
+func (s *Server) Handle(e Endpoint, h func(Request) Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h == nil {
+		delete(s.handlers, e)
+		return
+	}
+	s.handlers[e] = h
+}
+
+// SetParameters sets the answer of the parameters endpoint, marshalled to
+// JSON.
+func (s *Server) SetParameters(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.parameters = b
+	s.mu.Unlock()
+	return nil
+}
+
+// endpointHandler answers a call of an endpoint after authentication,
+// recording and the scripted errors and delays.
+type endpointHandler func(w http.ResponseWriter, r *http.Request, req Request, script Response)
+
+func (s *Server) route(mux *http.ServeMux, pattern string, e Endpoint, h endpointHandler) {
+	mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		req := Request{
+			Endpoint: e,
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			Query:    r.URL.Query(),
+			Header:   r.Header.Clone(),
+			Body:     body,
+		}
+
+		s.mu.Lock()
+		s.requests = append(s.requests, req)
+		s.mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer "+s.apiKey {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "Access token is invalid")
+			return
+		}
+
+		script := s.script(e, req)
+		if script.Delay > 0 {
+			select {
+			case <-time.After(script.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		for k, v := range script.Header {
+			w.Header()[k] = v
+		}
+		if script.Status >= 400 {
+			writeError(w, script.Status, script.Code, script.Message)
+			return
+		}
+		h(w, r, req, script)
+	})
+}
+
+// script returns the scripted answer of a call, or a zero Response for the
+// default one.
+func (s *Server) script(e Endpoint, req Request) Response {
+	s.mu.Lock()
+	if queue := s.scripts[e]; len(queue) > 0 {
+		s.scripts[e] = queue[1:]
+		s.mu.Unlock()
+		return queue[0]
+	}
+	h := s.handlers[e]
+	s.mu.Unlock()
+	if h != nil {
+		return h(req)
+	}
+	return Response{}
+}
+
+// newID returns a new id shaped like the UUIDs of Dify. Callers hold s.mu.
+func (s *Server) newID() string {
+	s.ids++
+	return fmt.Sprintf("00000000-0000-4000-8000-%012d", s.ids)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	if code == "" {
+		code = "error"
+	}
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	writeJSON(w, status, map[string]any{"code": code, "message": message, "status": status})
+}
+
+const defaultParameters = `{"opening_statement":"","suggested_questions":[],"suggested_questions_after_answer":{"enabled":false},"speech_to_text":{"enabled":false},"text_to_speech":{"enabled":false},"retriever_resource":{"enabled":false},"annotation_reply":{"enabled":false},"more_like_this":{"enabled":false},"user_input_form":[],"sensitive_word_avoidance":{"enabled":false},"file_upload":{"image":{"enabled":false}},"system_parameters":{"file_size_limit":15,"image_file_size_limit":10,"audio_file_size_limit":50,"video_file_size_limit":100}}`
@@ -0,0 +1,484 @@
+package dify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LoadBalancingStrategy picks the endpoint of each call among the healthy
+// ones.
+type LoadBalancingStrategy int
+
+const (
+	// RoundRobin takes the endpoints in turn.
+	RoundRobin LoadBalancingStrategy = iota
+	// LeastInFlight takes the endpoint with the fewest calls in flight,
+	// open streams included.
+	LeastInFlight
+	// LatencyWeighted picks endpoints at random, weighted by the inverse of
+	// their average time to response headers.
+	LatencyWeighted
+)
+
+// LoadBalancing configures how calls are spread across the hosts of
+// ClientConfig.Hosts.
+//
+// An endpoint that fails EjectAfter attempts in a row, with no response or
+// a 5xx status, is ejected from the rotation for EjectFor. It then gets
+// calls again, and is ejected again on its next failure until a call or a
+// probe succeeds. When every endpoint is ejected, calls go to all of them.
+//
+// A call that gets no response is sent to the next endpoint, if its body
+// can be sent again. Streams stay on the endpoint they were opened on, and
+// the Stop* calls of a task go to the endpoint running it.
+type LoadBalancing struct {
+	Strategy LoadBalancingStrategy
+	// EjectAfter defaults to 3 and EjectFor to 30s.
+	EjectAfter int
+	EjectFor   time.Duration
+	// ProbeInterval enables active health checks: every endpoint is sent a
+	// GET of ProbePath, "/health" by default, at that interval. A probe
+	// that does not get a 2xx answer within ProbeTimeout, 5s by default,
+	// ejects the endpoint and a successful one brings it back. Client.Close
+	// stops the probes.
+	ProbeInterval time.Duration
+	ProbePath     string
+	ProbeTimeout  time.Duration
+	// OnHealthChange is called when an endpoint is ejected or brought back.
+	OnHealthChange func(EndpointHealthChange)
+}
+
+// EndpointHealthChange describes an endpoint that was ejected or brought
+// back.
+type EndpointHealthChange struct {
+	// Host is the base URL of the endpoint.
+	Host    string
+	Healthy bool
+	// Err is the failure that ejected the endpoint.
+	Err error
+}
+
+func (l LoadBalancing) withDefaults() LoadBalancing {
+	if l.EjectAfter <= 0 {
+		l.EjectAfter = 3
+	}
+	if l.EjectFor <= 0 {
+		l.EjectFor = 30 * time.Second
+	}
+	if l.ProbePath == "" {
+		l.ProbePath = "/health"
+	}
+	if l.ProbeTimeout <= 0 {
+		l.ProbeTimeout = 5 * time.Second
+	}
+	return l
+}
+
+// endpointHosts returns Host followed by Hosts, normalized and without
+// duplicates.
+func endpointHosts(host string, hosts []string) []string {
+	var out []string
+	for _, h := range append([]string{host}, hosts...) {
+		h = normalizeHost(h)
+		if h != "" && !slices.Contains(out, h) {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+// endpoint is one Dify base URL and its health.
+type endpoint struct {
+	name     string
+	base     *url.URL
+	inFlight atomic.Int64
+
+	mu           sync.Mutex
+	consecutive  int
+	ejected      bool
+	ejectedUntil time.Time
+	// latency is the moving average time to response headers, zero until
+	// the first call.
+	latency time.Duration
+}
+
+func (e *endpoint) available(now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return !e.ejected || !now.Before(e.ejectedUntil)
+}
+
+func (e *endpoint) averageLatency() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.latency
+}
+
+// endpointTransport sends every request to one of several endpoints. The
+// requests are built against the first one and rewritten to the chosen one.
+type endpointTransport struct {
+	base      http.RoundTripper
+	probe     http.RoundTripper
+	policy    LoadBalancing
+	endpoints []*endpoint
+	next      atomic.Uint64
+
+	mu    sync.Mutex
+	tasks map[string]*endpoint
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// newEndpointTransport balances across hosts, skipping those that are not
+// valid URLs. Probes only run when at least two endpoints remain.
+func newEndpointTransport(base, probe http.RoundTripper, hosts []string, policy LoadBalancing) *endpointTransport {
+	t := &endpointTransport{
+		base:   base,
+		probe:  probe,
+		policy: policy.withDefaults(),
+		tasks:  make(map[string]*endpoint),
+		stop:   make(chan struct{}),
+	}
+	for _, h := range hosts {
+		u, err := url.Parse(h)
+		if err != nil {
+			continue
+		}
+		t.endpoints = append(t.endpoints, &endpoint{name: h, base: u})
+	}
+	if t.policy.ProbeInterval > 0 && len(t.endpoints) > 1 {
+		go t.probeLoop()
+	}
+	return t
+}
+
+// close stops the health probes.
+func (t *endpointTransport) close() {
+	t.stopOnce.Do(func() { close(t.stop) })
+}
+
+type pinnedEndpointKey struct{}
+
+// withPinnedEndpoint makes the calls of ctx go to e, without failover.
+func withPinnedEndpoint(ctx context.Context, e *endpoint) context.Context {
+	return context.WithValue(ctx, pinnedEndpointKey{}, e)
+}
+
+// taskContext pins ctx to the endpoint running taskID, if it is known.
+func (t *endpointTransport) taskContext(ctx context.Context, taskID string) context.Context {
+	t.mu.Lock()
+	e := t.tasks[taskID]
+	t.mu.Unlock()
+	if e == nil {
+		return ctx
+	}
+	return withPinnedEndpoint(ctx, e)
+}
+
+func (t *endpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pinned, _ := req.Context().Value(pinnedEndpointKey{}).(*endpoint)
+	tried := make(map[*endpoint]bool, len(t.endpoints))
+	for {
+		e := pinned
+		if e == nil {
+			e = t.pick(tried)
+		}
+		resp, err := t.send(e, req)
+		if err == nil || pinned != nil || req.Context().Err() != nil {
+			return resp, err
+		}
+		// Only calls that cannot have reached Dify move on to the next
+		// endpoint, whatever the retry policy: a reset may come after Dify
+		// started to run the call.
+		if !unsentError(err) && !errors.Is(err, ErrCircuitOpen) {
+			return nil, err
+		}
+		tried[e] = true
+		if len(tried) == len(t.endpoints) {
+			return nil, err
+		}
+		next, rewindErr := rewindRequest(req)
+		if rewindErr != nil {
+			return nil, err
+		}
+		req = next
+	}
+}
+
+// pick chooses an endpoint that was not tried yet, preferring those that
+// are not ejected.
+func (t *endpointTransport) pick(tried map[*endpoint]bool) *endpoint {
+	now := time.Now()
+	var candidates, fallback []*endpoint
+	for _, e := range t.endpoints {
+		if tried[e] {
+			continue
+		}
+		if e.available(now) {
+			candidates = append(candidates, e)
+		} else {
+			fallback = append(fallback, e)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = fallback
+	}
+
+	n := int(t.next.Add(1) - 1)
+	switch t.policy.Strategy {
+	case LeastInFlight:
+		best := candidates[n%len(candidates)]
+		for i := 1; i < len(candidates); i++ {
+			e := candidates[(n+i)%len(candidates)]
+			if e.inFlight.Load() < best.inFlight.Load() {
+				best = e
+			}
+		}
+		return best
+	case LatencyWeighted:
+		return pickByLatency(candidates)
+	default:
+		return candidates[n%len(candidates)]
+	}
+}
+
+// pickByLatency picks an endpoint with a probability proportional to the
+// inverse of its latency. Endpoints without calls yet weigh as much as the
+// fastest one, so that they get tried.
+func pickByLatency(candidates []*endpoint) *endpoint {
+	weights := make([]float64, len(candidates))
+	var top, total float64
+	for i, e := range candidates {
+		if l := e.averageLatency(); l > 0 {
+			weights[i] = 1 / max(l.Seconds(), 1e-3)
+			top = max(top, weights[i])
+		}
+	}
+	if top == 0 {
+		top = 1
+	}
+	for i := range weights {
+		if weights[i] == 0 {
+			weights[i] = top
+		}
+		total += weights[i]
+	}
+	r := rand.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return candidates[i]
+		}
+		r -= w
+	}
+	return candidates[len(candidates)-1]
+}
+
+// send sends req to e and records the outcome.
+func (t *endpointTransport) send(e *endpoint, req *http.Request) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	out.URL = t.resolve(e, req.URL)
+	out.Host = ""
+	var pin *taskPin
+	if isStreamingCall(req.Context()) {
+		pin = &taskPin{t: t, e: e}
+		out = ObserveStreamEvents(out, pin.observe)
+	}
+
+	e.inFlight.Add(1)
+	start := time.Now()
+	resp, err := t.base.RoundTrip(out)
+	if err != nil {
+		e.inFlight.Add(-1)
+		if req.Context().Err() == nil {
+			t.fail(e, err)
+		}
+		return nil, err
+	}
+	if resp.StatusCode >= 500 {
+		t.fail(e, fmt.Errorf("dify: %s answered %s", e.name, resp.Status))
+	} else {
+		t.succeed(e, time.Since(start))
+	}
+	resp.Body = &endpointBody{ReadCloser: resp.Body, e: e, pin: pin}
+	return resp, nil
+}
+
+// resolve rewrites u, built against the first endpoint, for e.
+func (t *endpointTransport) resolve(e *endpoint, u *url.URL) *url.URL {
+	primary := t.endpoints[0].base
+	out := *u
+	out.Scheme = e.base.Scheme
+	out.Host = e.base.Host
+	out.Path = e.base.Path + strings.TrimPrefix(u.Path, primary.Path)
+	out.RawPath = ""
+	return &out
+}
+
+func (t *endpointTransport) fail(e *endpoint, err error) {
+	now := time.Now()
+	e.mu.Lock()
+	e.consecutive++
+	eject := e.consecutive >= t.policy.EjectAfter && !now.Before(e.ejectedUntil)
+	changed := eject && !e.ejected
+	if eject {
+		e.ejected = true
+		e.ejectedUntil = now.Add(t.policy.EjectFor)
+	}
+	e.mu.Unlock()
+	if changed {
+		t.reportHealth(e, false, err)
+	}
+}
+
+func (t *endpointTransport) succeed(e *endpoint, latency time.Duration) {
+	e.mu.Lock()
+	e.consecutive = 0
+	if latency > 0 {
+		if e.latency == 0 {
+			e.latency = latency
+		} else {
+			e.latency += (latency - e.latency) * 3 / 10
+		}
+	}
+	changed := e.ejected
+	e.ejected = false
+	e.ejectedUntil = time.Time{}
+	e.mu.Unlock()
+	if changed {
+		t.reportHealth(e, true, nil)
+	}
+}
+
+func (t *endpointTransport) reportHealth(e *endpoint, healthy bool, err error) {
+	if t.policy.OnHealthChange != nil {
+		t.policy.OnHealthChange(EndpointHealthChange{Host: e.name, Healthy: healthy, Err: err})
+	}
+}
+
+func (t *endpointTransport) probeLoop() {
+	ticker := time.NewTicker(t.policy.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			var wg sync.WaitGroup
+			for _, e := range t.endpoints {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					t.probeEndpoint(e)
+				}()
+			}
+			wg.Wait()
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+func (t *endpointTransport) probeEndpoint(e *endpoint) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.policy.ProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.name+t.policy.ProbePath, nil)
+	if err != nil {
+		return
+	}
+	start := time.Now()
+	resp, err := t.probe.RoundTrip(req)
+	if err == nil {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			err = fmt.Errorf("dify: probe of %s answered %s", e.name, resp.Status)
+		}
+	}
+	if err != nil {
+		t.ejectProbed(e, err)
+		return
+	}
+	t.succeed(e, time.Since(start))
+}
+
+// ejectProbed ejects an endpoint whose probe failed, extending its ejection
+// while the probes keep failing.
+func (t *endpointTransport) ejectProbed(e *endpoint, err error) {
+	e.mu.Lock()
+	changed := !e.ejected
+	e.ejected = true
+	e.ejectedUntil = time.Now().Add(t.policy.EjectFor)
+	e.mu.Unlock()
+	if changed {
+		t.reportHealth(e, false, err)
+	}
+}
+
+// taskPin remembers the endpoint of the task a stream runs, so that it can
+// be stopped there.
+type taskPin struct {
+	t *endpointTransport
+	e *endpoint
+
+	mu     sync.Mutex
+	taskID string
+	closed bool
+}
+
+func (p *taskPin) observe(ev StreamEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.taskID != "" || p.closed {
+		return
+	}
+	var event struct {
+		TaskID string `json:"task_id"`
+	}
+	if json.Unmarshal(ev.Data, &event) != nil || event.TaskID == "" {
+		return
+	}
+	p.taskID = event.TaskID
+	p.t.mu.Lock()
+	p.t.tasks[p.taskID] = p.e
+	p.t.mu.Unlock()
+}
+
+func (p *taskPin) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.taskID != "" {
+		p.t.mu.Lock()
+		delete(p.t.tasks, p.taskID)
+		p.t.mu.Unlock()
+	}
+}
+
+// endpointBody counts a call as in flight until its body is closed.
+type endpointBody struct {
+	io.ReadCloser
+	e    *endpoint
+	pin  *taskPin
+	once sync.Once
+}
+
+func (b *endpointBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.e.inFlight.Add(-1)
+		if b.pin != nil {
+			b.pin.release()
+		}
+	})
+	return err
+}
@@ -0,0 +1,85 @@
+package dify
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestEndpointHosts(t *testing.T) {
+	got := endpointHosts("https://a/", []string{"https://b", "https://a", "", "https://b/"})
+	if len(got) != 2 || got[0] != "https://a" || got[1] != "https://b" {
+		t.Errorf("endpointHosts = %v", got)
+	}
+	if got := endpointHosts("", []string{"https://b"}); len(got) != 1 || got[0] != "https://b" {
+		t.Errorf("endpointHosts without Host = %v", got)
+	}
+}
+
+func TestEndpointResolve(t *testing.T) {
+	tr := newEndpointTransport(http.DefaultTransport, http.DefaultTransport, []string{"https://a/dify", "http://b:8080"}, LoadBalancing{})
+	u, _ := url.Parse("https://a/dify/v1/chat-messages?user=x")
+	got := tr.resolve(tr.endpoints[1], u).String()
+	if got != "http://b:8080/v1/chat-messages?user=x" {
+		t.Errorf("resolve = %s", got)
+	}
+	if got := tr.resolve(tr.endpoints[0], u).String(); got != u.String() {
+		t.Errorf("resolve on the first endpoint = %s", got)
+	}
+}
+
+func TestEndpointPick(t *testing.T) {
+	hosts := []string{"http://a", "http://b", "http://c"}
+	tr := newEndpointTransport(http.DefaultTransport, http.DefaultTransport, hosts, LoadBalancing{EjectAfter: 1, EjectFor: time.Minute})
+	a, b, c := tr.endpoints[0], tr.endpoints[1], tr.endpoints[2]
+
+	var order []string
+	for i := 0; i < 4; i++ {
+		order = append(order, tr.pick(nil).name)
+	}
+	if order[0] != "http://a" || order[1] != "http://b" || order[2] != "http://c" || order[3] != "http://a" {
+		t.Errorf("round robin order = %v", order)
+	}
+
+	tr.fail(b, nil)
+	for i := 0; i < 4; i++ {
+		if e := tr.pick(nil); e == b {
+			t.Fatal("picked an ejected endpoint")
+		}
+	}
+	if e := tr.pick(map[*endpoint]bool{a: true, c: true}); e != b {
+		t.Errorf("pick with only an ejected endpoint left = %s", e.name)
+	}
+	tr.succeed(b, time.Millisecond)
+	if !b.available(time.Now()) {
+		t.Error("endpoint still ejected after a success")
+	}
+
+	tr.policy.Strategy = LeastInFlight
+	a.inFlight.Store(2)
+	b.inFlight.Store(1)
+	c.inFlight.Store(3)
+	for i := 0; i < 3; i++ {
+		if e := tr.pick(nil); e != b {
+			t.Errorf("least in-flight picked %s", e.name)
+		}
+	}
+}
+
+func TestEndpointPickByLatency(t *testing.T) {
+	tr := newEndpointTransport(http.DefaultTransport, http.DefaultTransport, []string{"http://fast", "http://slow"}, LoadBalancing{})
+	tr.succeed(tr.endpoints[0], 10*time.Millisecond)
+	tr.succeed(tr.endpoints[1], 100*time.Millisecond)
+
+	fast := 0
+	for i := 0; i < 2000; i++ {
+		if pickByLatency(tr.endpoints) == tr.endpoints[0] {
+			fast++
+		}
+	}
+	// The fast endpoint weighs ten times as much: about 91% of the picks.
+	if fast < 1700 || fast > 1940 {
+		t.Errorf("fast endpoint picked %d times out of 2000", fast)
+	}
+}
@@ -0,0 +1,209 @@
+package dify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	// maxErrorBodySize caps how much of an error response is read.
+	maxErrorBodySize = 64 << 10
+	// maxErrorRawSize caps the raw body kept on an APIError.
+	maxErrorRawSize = 4 << 10
+)
+
+// Sentinel errors for common Dify error codes, matched by *APIError and
+// *StreamError with errors.Is:
+//
+//	if errors.Is(err, dify.ErrProviderQuotaExceeded) {
+//		...
+//	}
+var (
+	ErrInvalidParam             = errors.New("dify: invalid_param")
+	ErrAppUnavailable           = errors.New("dify: app_unavailable")
+	ErrProviderNotInitialize    = errors.New("dify: provider_not_initialize")
+	ErrProviderQuotaExceeded    = errors.New("dify: provider_quota_exceeded")
+	ErrModelCurrentlyNotSupport = errors.New("dify: model_currently_not_support")
+	ErrConversationNotExists    = errors.New("dify: conversation_not_exists")
+	ErrUnauthorized             = errors.New("dify: unauthorized")
+	ErrRateLimited              = errors.New("dify: rate limited")
+)
+
+var codeSentinels = map[string]error{
+	"invalid_param":               ErrInvalidParam,
+	"app_unavailable":             ErrAppUnavailable,
+	"provider_not_initialize":     ErrProviderNotInitialize,
+	"provider_quota_exceeded":     ErrProviderQuotaExceeded,
+	"model_currently_not_support": ErrModelCurrentlyNotSupport,
+	"conversation_not_exists":     ErrConversationNotExists,
+	"unauthorized":                ErrUnauthorized,
+	"too_many_requests":           ErrRateLimited,
+	"rate_limit_error":            ErrRateLimited,
+}
+
+// matchesSentinel reports whether an error with the given status, code and
+// message is target. Dify reports a missing conversation as a plain
+// not_found, so that one is recognised by its message.
+func matchesSentinel(target error, status int, code, message string) bool {
+	if sentinel, ok := codeSentinels[code]; ok && sentinel == target {
+		return true
+	}
+	switch target {
+	case ErrUnauthorized:
+		return status == http.StatusUnauthorized
+	case ErrRateLimited:
+		return status == http.StatusTooManyRequests
+	case ErrConversationNotExists:
+		return code == "not_found" && strings.HasPrefix(message, "Conversation Not Exists")
+	}
+	return false
+}
+
+// APIError is returned by every endpoint when Dify answers with a non-2xx
+// status. Use errors.Is with the Err* sentinels to check for common codes.
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	// Raw is the response body, truncated to 4KB.
+	Raw []byte
+
+	Method string
+	Path   string
+}
+
+func (e *APIError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("HTTP response error: %s %s: %d [%s]%s", e.Method, e.Path, e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("HTTP response error: %s %s: %d %s", e.Method, e.Path, e.StatusCode, e.Message)
+}
+
+func (e *APIError) Is(target error) bool {
+	return matchesSentinel(target, e.StatusCode, e.Code, e.Message)
+}
+
+// newAPIError reads the error body of resp, the answer to req. Dify normally
+// answers with a JSON object carrying code and message; for any other body,
+// such as the HTML page of a proxy, the message is the status text.
+func newAPIError(req *http.Request, resp *http.Response) *APIError {
+	apiErr := &APIError{StatusCode: resp.StatusCode, Method: req.Method, Path: req.URL.Path}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	var errBody struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &errBody) == nil {
+		apiErr.Code = errBody.Code
+		apiErr.Message = errBody.Message
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = http.StatusText(resp.StatusCode)
+	}
+	if len(body) > maxErrorRawSize {
+		body = body[:maxErrorRawSize]
+	}
+	apiErr.Raw = body
+	return apiErr
+}
+
+// StreamError is an error event sent by Dify inside a stream. It ends the
+// stream and is returned from the streaming call.
+type StreamError struct {
+	TaskID    string
+	MessageID string
+	Status    int
+	Code      string
+	Message   string
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("stream error: %d [%s]%s", e.Status, e.Code, e.Message)
+}
+
+func (e *StreamError) Is(target error) bool {
+	return matchesSentinel(target, e.Status, e.Code, e.Message)
+}
+
+func (e *StreamError) event() ErrorEvent {
+	return ErrorEvent{
+		Event:     EventError,
+		TaskID:    e.TaskID,
+		MessageID: e.MessageID,
+		Status:    e.Status,
+		Code:      e.Code,
+		Message:   e.Message,
+	}
+}
+
+// StreamDecodeError reports a stream event whose payload could not be decoded.
+type StreamDecodeError struct {
+	Event string
+	Raw   []byte
+	Err   error
+}
+
+func (e *StreamDecodeError) Error() string {
+	if e.Event != "" {
+		return fmt.Sprintf("error decoding %s event: %v", e.Event, e.Err)
+	}
+	return fmt.Sprintf("error decoding event: %v", e.Err)
+}
+
+func (e *StreamDecodeError) Unwrap() error {
+	return e.Err
+}
+
+// StreamProtocolError reports a stream event that decodes but does not follow
+// the Dify event format, such as a payload without an event type.
+type StreamProtocolError struct {
+	Raw    []byte
+	Reason string
+}
+
+func (e *StreamProtocolError) Error() string {
+	return "stream protocol error: " + e.Reason
+}
+
+func newStreamDecodeError(event sseEvent, eventType string, err error) *StreamDecodeError {
+	return &StreamDecodeError{
+		Event: eventType,
+		Raw:   append([]byte(nil), event.Data...),
+		Err:   err,
+	}
+}
+
+func newStreamProtocolError(event sseEvent, reason string) *StreamProtocolError {
+	return &StreamProtocolError{
+		Raw:    append([]byte(nil), event.Data...),
+		Reason: reason,
+	}
+}
+
+// isMalformedEventError reports whether err concerns a single bad event, after
+// which a lenient stream can carry on.
+func isMalformedEventError(err error) bool {
+	var decodeErr *StreamDecodeError
+	var protocolErr *StreamProtocolError
+	return errors.As(err, &decodeErr) || errors.As(err, &protocolErr)
+}
+
+// decodeStreamError turns an error event into a *StreamError.
+func decodeStreamError(event sseEvent) error {
+	var ev ErrorEvent
+	if err := json.Unmarshal(event.Data, &ev); err != nil {
+		return newStreamDecodeError(event, EventError, err)
+	}
+	return &StreamError{
+		TaskID:    ev.TaskID,
+		MessageID: ev.MessageID,
+		Status:    ev.Status,
+		Code:      ev.Code,
+		Message:   ev.Message,
+	}
+}
@@ -0,0 +1,173 @@
+package dify
+
+import "encoding/json"
+
+// peekEventType returns the "event" member of a top-level JSON object without
+// decoding the rest of the payload, so a stream event can be unmarshalled
+// exactly once into the type it names. It falls back to a regular decode when
+// the value uses escape sequences, and returns "" when there is no such member.
+func peekEventType(data []byte) string {
+	raw, escaped, ok := scanTopLevelString(data, "event")
+	if !ok {
+		return ""
+	}
+	if escaped {
+		var v struct {
+			Event string `json:"event"`
+		}
+		if json.Unmarshal(data, &v) != nil {
+			return ""
+		}
+		return v.Event
+	}
+	return internEventType(raw)
+}
+
+// internEventType maps the raw bytes of known event names onto their constants
+// so peeking does not allocate for them.
+func internEventType(raw []byte) string {
+	for _, name := range knownEventTypes {
+		if string(raw) == name {
+			return name
+		}
+	}
+	return string(raw)
+}
+
+var knownEventTypes = []string{
+	EventWorkflowStarted,
+	EventNodeStarted,
+	EventNodeFinished,
+	EventWorkflowFinished,
+	EventTTSMessage,
+	EventTTSMessageEnd,
+	EventTextChunk,
+	EventIterationStarted,
+	EventIterationNext,
+	EventIterationCompleted,
+	EventLoopStarted,
+	EventLoopNext,
+	EventLoopCompleted,
+	EventParallelBranchStarted,
+	EventParallelBranchFinished,
+	EventNodeRetry,
+	EventAgentLog,
+	EventMessage,
+	EventAgentMessage,
+	EventMessageEnd,
+	EventError,
+	EventPing,
+}
+
+// scanTopLevelString looks up key among the members of the JSON object in data
+// and returns the raw contents of its string value.
+func scanTopLevelString(data []byte, key string) (value []byte, escaped, ok bool) {
+	i := skipJSONSpace(data, 0)
+	if i >= len(data) || data[i] != '{' {
+		return nil, false, false
+	}
+	i++
+	for {
+		i = skipJSONSpace(data, i)
+		if i >= len(data) || data[i] != '"' {
+			return nil, false, false
+		}
+		keyStart := i + 1
+		keyEnd, keyEscaped, ok := scanJSONString(data, i)
+		if !ok {
+			return nil, false, false
+		}
+		i = skipJSONSpace(data, keyEnd+1)
+		if i >= len(data) || data[i] != ':' {
+			return nil, false, false
+		}
+		i = skipJSONSpace(data, i+1)
+
+		if !keyEscaped && string(data[keyStart:keyEnd]) == key {
+			if i >= len(data) || data[i] != '"' {
+				return nil, false, false
+			}
+			end, esc, ok := scanJSONString(data, i)
+			if !ok {
+				return nil, false, false
+			}
+			return data[i+1 : end], esc, true
+		}
+
+		if i, ok = skipJSONValue(data, i); !ok {
+			return nil, false, false
+		}
+		i = skipJSONSpace(data, i)
+		if i >= len(data) || data[i] != ',' {
+			return nil, false, false
+		}
+		i++
+	}
+}
+
+// scanJSONString returns the index of the closing quote of the string that
+// starts at data[start].
+func scanJSONString(data []byte, start int) (end int, escaped, ok bool) {
+	for i := start + 1; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			escaped = true
+			i++
+		case '"':
+			return i, escaped, true
+		}
+	}
+	return 0, false, false
+}
+
+// skipJSONValue returns the index just past the value that starts at data[i].
+func skipJSONValue(data []byte, i int) (int, bool) {
+	if i >= len(data) {
+		return 0, false
+	}
+	switch data[i] {
+	case '"':
+		end, _, ok := scanJSONString(data, i)
+		return end + 1, ok
+	case '{', '[':
+		depth := 0
+		for ; i < len(data); i++ {
+			switch data[i] {
+			case '"':
+				end, _, ok := scanJSONString(data, i)
+				if !ok {
+					return 0, false
+				}
+				i = end
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1, true
+				}
+			}
+		}
+		return 0, false
+	default:
+		for ; i < len(data); i++ {
+			switch data[i] {
+			case ',', '}', ']', ' ', '\t', '\r', '\n':
+				return i, true
+			}
+		}
+		return i, true
+	}
+}
+
+func skipJSONSpace(data []byte, i int) int {
+	for i < len(data) {
+		switch data[i] {
+		case ' ', '\t', '\r', '\n':
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
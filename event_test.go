@@ -0,0 +1,41 @@
+package dify
+
+import "testing"
+
+func TestPeekEventType(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"first member", `{"event":"node_started","task_id":"t"}`, EventNodeStarted},
+		{"after other members", `{"task_id":"t","n":1.5,"ok":true,"x":null,"event":"tts_message"}`, EventTTSMessage},
+		{"whitespace", " {\n \"event\" : \"workflow_finished\" }", EventWorkflowFinished},
+		{"nested event is skipped", `{"data":{"event":"inner","list":[{"event":"x"},"]"]},"event":"node_finished"}`, EventNodeFinished},
+		{"escaped strings before", `{"data":"a \"event\": \"x\" \\","event":"tts_message_end"}`, EventTTSMessageEnd},
+		{"escaped value", `{"event":"custom\u005fevent"}`, "custom_event"},
+		{"unknown event", `{"event":"something_new"}`, "something_new"},
+		{"missing", `{"task_id":"t"}`, ""},
+		{"non-string", `{"event":1}`, ""},
+		{"not an object", `["event","x"]`, ""},
+		{"truncated", `{"event":"node_sta`, ""},
+		{"empty", ``, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := peekEventType([]byte(tt.data)); got != tt.want {
+				t.Errorf("peekEventType(%s) = %q, want %q", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPeekEventTypeDoesNotAllocate(t *testing.T) {
+	data := []byte(`{"task_id":"t","data":{"event":"x"},"event":"node_started"}`)
+	allocs := testing.AllocsPerRun(100, func() {
+		peekEventType(data)
+	})
+	if allocs != 0 {
+		t.Errorf("peekEventType allocated %v times per run", allocs)
+	}
+}
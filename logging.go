@@ -0,0 +1,344 @@
+package dify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultLogBodyLimit caps logged bodies when LogBodyLimit is not set.
+const defaultLogBodyLimit = 4 << 10
+
+const redactedValue = "[REDACTED]"
+
+// requestLogger logs API calls to a slog.Logger:
+//
+//   - Debug: request start, rate limit waits, and with LogBodies the bodies
+//     and every stream event
+//   - Info: successful calls, streams that ended normally, circuit breakers
+//     leaving the open state, endpoints brought back and refreshed secrets
+//   - Warn: retries, non-2xx answers, streams that ended with an error,
+//     circuit breakers opening, endpoints ejected and failed secret refreshes
+//   - Error: calls that failed without a response
+//
+// API secrets are logged redacted to their last characters, and the JSON
+// fields named in LogRedactFields are replaced in logged bodies.
+type requestLogger struct {
+	logger    *slog.Logger
+	bodies    bool
+	bodyLimit int
+	redact    map[string]bool
+}
+
+func newRequestLogger(c *ClientConfig) *requestLogger {
+	if c.Logger == nil {
+		return nil
+	}
+	l := &requestLogger{
+		logger:    c.Logger,
+		bodies:    c.LogBodies,
+		bodyLimit: c.LogBodyLimit,
+		redact:    make(map[string]bool, len(c.LogRedactFields)),
+	}
+	if l.bodyLimit <= 0 {
+		l.bodyLimit = defaultLogBodyLimit
+	}
+	for _, field := range c.LogRedactFields {
+		l.redact[strings.ToLower(field)] = true
+	}
+	return l
+}
+
+// requestAttrs identifies the call of req in every log record.
+func requestAttrs(req *http.Request) []any {
+	return []any{
+		slog.String("method", req.Method),
+		slog.String("path", endpointName(req.URL.Path)),
+		slog.String("app", redactSecret(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))),
+		slog.Bool("streaming", isStreamingCall(req.Context())),
+	}
+}
+
+// middleware logs every call. It runs innermost, so it sees the request as
+// modified by the configured middlewares.
+func (l *requestLogger) middleware(next RequestHandler) RequestHandler {
+	return func(req *http.Request) (*http.Response, error) {
+		ctx := req.Context()
+		attrs := requestAttrs(req)
+		streaming := isStreamingCall(ctx)
+
+		if l.logger.Enabled(ctx, slog.LevelDebug) {
+			args := attrs
+			if l.bodies {
+				args = append(args, slog.String("body", l.requestBody(req)))
+			}
+			l.logger.DebugContext(ctx, "dify request", args...)
+		}
+
+		var stream *streamLog
+		if streaming {
+			stream = &streamLog{logger: l}
+			req = ObserveStreamEvents(req, stream.observe)
+		}
+
+		start := time.Now()
+		resp, err := next(req)
+		latency := slog.Duration("latency", time.Since(start))
+		if err != nil {
+			l.logger.ErrorContext(ctx, "dify request failed", append(attrs, latency, slog.String("error", err.Error()))...)
+			return resp, err
+		}
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			// Peek at the error body for the Dify code, leaving it in place
+			// for the caller.
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorRawSize))
+			resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+			var errBody struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			}
+			json.Unmarshal(body, &errBody)
+			l.logger.WarnContext(ctx, "dify request error", append(attrs, latency,
+				slog.Int("status", resp.StatusCode),
+				slog.String("code", errBody.Code),
+				slog.String("message", errBody.Message),
+			)...)
+			return resp, nil
+		}
+
+		if streaming {
+			stream.attrs = slices.Clip(append(attrs, slog.Int("status", resp.StatusCode)))
+			stream.start = start
+			resp.Body = &loggedStreamBody{ReadCloser: resp.Body, log: stream}
+			l.logger.DebugContext(ctx, "dify stream opened", append(stream.attrs, latency)...)
+			return resp, nil
+		}
+
+		args := append(attrs, latency, slog.Int("status", resp.StatusCode))
+		if l.bodies {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, int64(l.bodyLimit)+1))
+			resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+			args = append(args, slog.String("body", l.formatBody(body)))
+		}
+		l.logger.InfoContext(ctx, "dify request finished", args...)
+		return resp, nil
+	}
+}
+
+// onRetry logs a retry of req.
+func (l *requestLogger) onRetry(req *http.Request, attempt int, delay time.Duration) {
+	l.logger.WarnContext(req.Context(), "dify request retry", append(requestAttrs(req),
+		slog.Int("attempt", attempt),
+		slog.Duration("delay", delay),
+	)...)
+}
+
+// onSecretRefresh logs the refresh of a secret rejected by Dify.
+func (l *requestLogger) onSecretRefresh(req *http.Request, err error) {
+	if err != nil {
+		l.logger.WarnContext(req.Context(), "dify secret refresh failed", append(requestAttrs(req),
+			slog.String("error", err.Error()),
+		)...)
+		return
+	}
+	l.logger.InfoContext(req.Context(), "dify secret refreshed", requestAttrs(req)...)
+}
+
+// onRateLimitWait logs a call that waited for a rate limit.
+func (l *requestLogger) onRateLimitWait(w RateLimitWait) {
+	level := slog.LevelDebug
+	if w.Err != nil {
+		level = slog.LevelWarn
+	}
+	args := []any{
+		slog.String("app", w.Secret),
+		slog.Bool("streaming", w.Streaming),
+		slog.String("limit", w.Limit),
+		slog.Duration("wait", w.Wait),
+	}
+	if w.Err != nil {
+		args = append(args, slog.String("error", w.Err.Error()))
+	}
+	l.logger.Log(context.Background(), level, "dify rate limit wait", args...)
+}
+
+// onCircuitStateChange logs a circuit breaker changing state.
+func (l *requestLogger) onCircuitStateChange(change CircuitStateChange) {
+	level := slog.LevelInfo
+	if change.To == CircuitOpen {
+		level = slog.LevelWarn
+	}
+	l.logger.Log(context.Background(), level, "dify circuit state change",
+		slog.String("host", change.Host),
+		slog.String("app", change.Secret),
+		slog.String("from", change.From.String()),
+		slog.String("to", change.To.String()),
+	)
+}
+
+// onEndpointHealthChange logs an endpoint being ejected or brought back.
+func (l *requestLogger) onEndpointHealthChange(change EndpointHealthChange) {
+	if change.Healthy {
+		l.logger.Info("dify endpoint restored", slog.String("host", change.Host))
+		return
+	}
+	args := []any{slog.String("host", change.Host)}
+	if change.Err != nil {
+		args = append(args, slog.String("error", change.Err.Error()))
+	}
+	l.logger.Warn("dify endpoint ejected", args...)
+}
+
+func (l *requestLogger) requestBody(req *http.Request) string {
+	if req.GetBody == nil {
+		return ""
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return ""
+	}
+	defer body.Close()
+	b, _ := io.ReadAll(io.LimitReader(body, int64(l.bodyLimit)+1))
+	return l.formatBody(b)
+}
+
+// formatBody redacts the configured fields of a JSON body and truncates it
+// to the body limit.
+func (l *requestLogger) formatBody(body []byte) string {
+	truncated := len(body) > l.bodyLimit
+	if !truncated && len(l.redact) > 0 {
+		var v any
+		if json.Unmarshal(body, &v) == nil {
+			if b, err := json.Marshal(l.redactValue(v)); err == nil {
+				body = b
+			}
+		}
+	}
+	if len(body) > l.bodyLimit {
+		body = body[:l.bodyLimit]
+		truncated = true
+	}
+	if truncated {
+		if len(l.redact) > 0 {
+			// A truncated body cannot be parsed, so its fields cannot be
+			// redacted reliably.
+			return "[TRUNCATED]"
+		}
+		return string(body) + "...[TRUNCATED]"
+	}
+	return string(body)
+}
+
+func (l *requestLogger) redactValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, field := range v {
+			if l.redact[strings.ToLower(k)] {
+				v[k] = redactedValue
+			} else {
+				v[k] = l.redactValue(field)
+			}
+		}
+	case []any:
+		for i := range v {
+			v[i] = l.redactValue(v[i])
+		}
+	}
+	return v
+}
+
+// streamLog follows one stream from its events to its end.
+type streamLog struct {
+	logger *requestLogger
+	attrs  []any
+	start  time.Time
+
+	mu       sync.Mutex
+	events   int
+	lastType string
+	errEvent string
+	readErr  error
+	closed   bool
+}
+
+func (s *streamLog) observe(ev StreamEvent) {
+	s.mu.Lock()
+	s.events++
+	s.lastType = ev.Event
+	if ev.Event == EventError {
+		s.errEvent = string(ev.Data)
+	}
+	s.mu.Unlock()
+
+	if s.logger.bodies {
+		s.logger.logger.Debug("dify stream event", append(s.attrs,
+			slog.String("event", ev.Event),
+			slog.String("data", s.logger.formatBody(ev.Data)),
+		)...)
+	}
+}
+
+func (s *streamLog) finish() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	args := append(s.attrs,
+		slog.Duration("duration", time.Since(s.start)),
+		slog.Int("events", s.events),
+		slog.String("last_event", s.lastType),
+	)
+	level := slog.LevelInfo
+	switch {
+	case s.errEvent != "":
+		level = slog.LevelWarn
+		args = append(args, slog.String("error_event", s.logger.formatBody([]byte(s.errEvent))))
+	case s.readErr != nil:
+		level = slog.LevelWarn
+		args = append(args, slog.String("error", s.readErr.Error()))
+	}
+	s.mu.Unlock()
+
+	s.logger.logger.Log(context.Background(), level, "dify stream closed", args...)
+}
+
+// loggedStreamBody records read errors of a stream and logs its end on Close.
+type loggedStreamBody struct {
+	io.ReadCloser
+	log *streamLog
+}
+
+func (b *loggedStreamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		b.log.mu.Lock()
+		if b.log.readErr == nil && !b.log.closed {
+			b.log.readErr = err
+		}
+		b.log.mu.Unlock()
+	}
+	return n, err
+}
+
+func (b *loggedStreamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.log.finish()
+	return err
+}
+
+// readCloser reads from one reader and closes another.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
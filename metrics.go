@@ -0,0 +1,443 @@
+package dify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricLabels identify the calls a measurement belongs to.
+type MetricLabels struct {
+	// Endpoint is the API path with ids replaced by {id}.
+	Endpoint string
+	// App is the name of the registered app of the call, or for the calls of
+	// the API of a client, its API secret redacted to its last characters.
+	App string
+}
+
+// MetricsSink receives measurements of every API call and stream. It must be
+// safe for concurrent use.
+type MetricsSink interface {
+	// ObserveRequest is called once per call with the final status, zero when
+	// no response arrived, and the latency until the response headers.
+	ObserveRequest(labels MetricLabels, status int, latency time.Duration)
+	// ObserveError is called for every failed call or stream with the Dify
+	// error code, "http_<status>" for answers without one, "transport" and
+	// "stream_read" for connection failures, or "circuit_open" for calls
+	// rejected by the circuit breaker.
+	ObserveError(labels MetricLabels, code string)
+	// ObserveTimeToFirstToken is called when a stream delivers its first
+	// piece of answer text.
+	ObserveTimeToFirstToken(labels MetricLabels, d time.Duration)
+	// ObserveStreamDuration is called when a stream is closed.
+	ObserveStreamDuration(labels MetricLabels, d time.Duration)
+	// ObserveUsage is called with the token usage reported by a blocking
+	// answer, message_end or workflow_finished.
+	ObserveUsage(labels MetricLabels, usage Usage)
+}
+
+// answersWithUsage reports whether the blocking answers of endpoint carry
+// their token usage: those of the chat, completion and workflow runs.
+func answersWithUsage(endpoint string) bool {
+	switch endpoint {
+	case "/v1/chat-messages", "/v1/completion-messages", "/v1/workflows/run":
+		return true
+	}
+	return false
+}
+
+// metricsMiddleware feeds sink from every call. It runs innermost, next to
+// the request logger.
+func metricsMiddleware(sink MetricsSink) Middleware {
+	return func(next RequestHandler) RequestHandler {
+		return func(req *http.Request) (*http.Response, error) {
+			labels := MetricLabels{Endpoint: endpointName(req.URL.Path)}
+			// Redacted secrets of the same length and ending are alike, so the
+			// name of a registered app is preferred.
+			if app := appFromContext(req.Context()); app != nil {
+				labels.App = app.name
+			} else {
+				labels.App = redactSecret(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+			}
+			streaming := isStreamingCall(req.Context())
+
+			start := time.Now()
+			var stream *streamMetrics
+			if streaming {
+				stream = &streamMetrics{sink: sink, labels: labels, start: start}
+				req = ObserveStreamEvents(req, stream.observe)
+			}
+
+			resp, err := next(req)
+			if err != nil {
+				sink.ObserveRequest(labels, 0, time.Since(start))
+				code := "transport"
+				if errors.Is(err, ErrCircuitOpen) {
+					code = "circuit_open"
+				}
+				sink.ObserveError(labels, code)
+				return resp, err
+			}
+			sink.ObserveRequest(labels, resp.StatusCode, time.Since(start))
+
+			switch {
+			case resp.StatusCode < 200 || resp.StatusCode >= 300:
+				body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorRawSize))
+				resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+				var errBody struct {
+					Code string `json:"code"`
+				}
+				json.Unmarshal(body, &errBody)
+				if errBody.Code == "" {
+					errBody.Code = "http_" + strconv.Itoa(resp.StatusCode)
+				}
+				sink.ObserveError(labels, errBody.Code)
+			case streaming:
+				resp.Body = &measuredStreamBody{ReadCloser: resp.Body, metrics: stream}
+			case answersWithUsage(labels.Endpoint):
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body = readCloser{bytes.NewReader(body), resp.Body}
+				var answer struct {
+					Metadata MessageMetadata `json:"metadata"`
+					Data     struct {
+						TotalTokens int `json:"total_tokens"`
+					} `json:"data"`
+				}
+				if json.Unmarshal(body, &answer) == nil {
+					usage := answer.Metadata.Usage
+					if usage.TotalTokens == 0 {
+						usage.TotalTokens = answer.Data.TotalTokens
+					}
+					if usage.TotalTokens > 0 {
+						sink.ObserveUsage(labels, usage)
+					}
+				}
+			}
+			return resp, nil
+		}
+	}
+}
+
+// streamMetrics measures one stream from its events.
+type streamMetrics struct {
+	sink   MetricsSink
+	labels MetricLabels
+	start  time.Time
+
+	mu         sync.Mutex
+	firstToken bool
+	failed     bool
+	closed     bool
+}
+
+func (s *streamMetrics) observe(ev StreamEvent) {
+	switch ev.Event {
+	case EventMessage, EventAgentMessage, EventTextChunk:
+		s.mu.Lock()
+		seen := s.firstToken
+		s.mu.Unlock()
+		if seen {
+			return
+		}
+		var chunk struct {
+			Answer string `json:"answer"`
+			Data   struct {
+				Text string `json:"text"`
+			} `json:"data"`
+		}
+		if json.Unmarshal(ev.Data, &chunk) == nil && (chunk.Answer != "" || chunk.Data.Text != "") {
+			s.mu.Lock()
+			s.firstToken = true
+			s.mu.Unlock()
+			s.sink.ObserveTimeToFirstToken(s.labels, time.Since(s.start))
+		}
+	case EventMessageEnd:
+		var end struct {
+			Metadata MessageMetadata `json:"metadata"`
+		}
+		if json.Unmarshal(ev.Data, &end) == nil && end.Metadata.Usage.TotalTokens > 0 {
+			s.sink.ObserveUsage(s.labels, end.Metadata.Usage)
+		}
+	case EventWorkflowFinished:
+		var finished struct {
+			Data struct {
+				TotalTokens int `json:"total_tokens"`
+			} `json:"data"`
+		}
+		if json.Unmarshal(ev.Data, &finished) == nil && finished.Data.TotalTokens > 0 {
+			s.sink.ObserveUsage(s.labels, Usage{TotalTokens: finished.Data.TotalTokens})
+		}
+	case EventError:
+		var streamErr ErrorEvent
+		json.Unmarshal(ev.Data, &streamErr)
+		s.fail(streamErr.Code)
+	}
+}
+
+func (s *streamMetrics) fail(code string) {
+	s.mu.Lock()
+	if s.failed || s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.failed = true
+	s.mu.Unlock()
+	if code == "" {
+		code = "stream_error"
+	}
+	s.sink.ObserveError(s.labels, code)
+}
+
+func (s *streamMetrics) finish() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.mu.Unlock()
+	s.sink.ObserveStreamDuration(s.labels, time.Since(s.start))
+}
+
+// measuredStreamBody reports read failures and the stream duration.
+type measuredStreamBody struct {
+	io.ReadCloser
+	metrics *streamMetrics
+}
+
+func (b *measuredStreamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.metrics.fail("stream_read")
+	}
+	return n, err
+}
+
+func (b *measuredStreamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.metrics.finish()
+	return err
+}
+
+// DefaultLatencyBuckets are the histogram buckets of MemoryMetrics, in
+// seconds, spanning quick blocking calls to long workflow streams.
+var DefaultLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// MemoryMetrics is a MetricsSink that keeps its measurements in memory and
+// serves them in the Prometheus text format:
+//
+//	metrics := dify.NewMemoryMetrics()
+//	c := dify.NewClientWithConfig(&dify.ClientConfig{..., Metrics: metrics})
+//	http.Handle("/metrics", metrics)
+type MemoryMetrics struct {
+	buckets []float64
+
+	mu         sync.Mutex
+	requests   map[requestKey]float64
+	latency    map[MetricLabels]*histogram
+	errors     map[errorKey]float64
+	firstToken map[MetricLabels]*histogram
+	streams    map[MetricLabels]*histogram
+	tokens     map[tokenKey]float64
+	price      map[priceKey]float64
+}
+
+type requestKey struct {
+	MetricLabels
+	status int
+}
+
+type errorKey struct {
+	MetricLabels
+	code string
+}
+
+type tokenKey struct {
+	MetricLabels
+	kind string
+}
+
+type priceKey struct {
+	MetricLabels
+	currency string
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(buckets []float64, v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(buckets))
+	}
+	for i, le := range buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// NewMemoryMetrics returns an empty MemoryMetrics using DefaultLatencyBuckets.
+func NewMemoryMetrics() *MemoryMetrics {
+	return NewMemoryMetricsWithBuckets(DefaultLatencyBuckets)
+}
+
+// NewMemoryMetricsWithBuckets returns an empty MemoryMetrics whose histograms
+// use buckets, given in seconds.
+func NewMemoryMetricsWithBuckets(buckets []float64) *MemoryMetrics {
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+	return &MemoryMetrics{
+		buckets:    buckets,
+		requests:   make(map[requestKey]float64),
+		latency:    make(map[MetricLabels]*histogram),
+		errors:     make(map[errorKey]float64),
+		firstToken: make(map[MetricLabels]*histogram),
+		streams:    make(map[MetricLabels]*histogram),
+		tokens:     make(map[tokenKey]float64),
+		price:      make(map[priceKey]float64),
+	}
+}
+
+func (m *MemoryMetrics) observeHistogram(hs map[MetricLabels]*histogram, labels MetricLabels, d time.Duration) {
+	h, ok := hs[labels]
+	if !ok {
+		h = &histogram{}
+		hs[labels] = h
+	}
+	h.observe(m.buckets, d.Seconds())
+}
+
+func (m *MemoryMetrics) ObserveRequest(labels MetricLabels, status int, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{labels, status}]++
+	m.observeHistogram(m.latency, labels, latency)
+}
+
+func (m *MemoryMetrics) ObserveError(labels MetricLabels, code string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors[errorKey{labels, code}]++
+}
+
+func (m *MemoryMetrics) ObserveTimeToFirstToken(labels MetricLabels, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observeHistogram(m.firstToken, labels, d)
+}
+
+func (m *MemoryMetrics) ObserveStreamDuration(labels MetricLabels, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observeHistogram(m.streams, labels, d)
+}
+
+func (m *MemoryMetrics) ObserveUsage(labels MetricLabels, usage Usage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[tokenKey{labels, "prompt"}] += float64(usage.PromptTokens)
+	m.tokens[tokenKey{labels, "completion"}] += float64(usage.CompletionTokens)
+	m.tokens[tokenKey{labels, "total"}] += float64(usage.TotalTokens)
+	if price, err := strconv.ParseFloat(usage.TotalPrice, 64); err == nil {
+		m.price[priceKey{labels, usage.Currency}] += price
+	}
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format.
+func (m *MemoryMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WritePrometheus(w)
+}
+
+// WritePrometheus writes all metrics in the Prometheus text exposition
+// format.
+func (m *MemoryMetrics) WritePrometheus(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b bytes.Buffer
+	writeHeader(&b, "dify_requests_total", "counter", "API calls by final HTTP status, 0 when no response arrived.")
+	for _, k := range sortedKeys(m.requests) {
+		writeSample(&b, "dify_requests_total", k.MetricLabels, m.requests[k], "status", strconv.Itoa(k.status))
+	}
+	m.writeHistogram(&b, "dify_request_duration_seconds", "Latency of API calls until the response headers.", m.latency)
+	writeHeader(&b, "dify_errors_total", "counter", "Failed calls and streams by Dify error code.")
+	for _, k := range sortedKeys(m.errors) {
+		writeSample(&b, "dify_errors_total", k.MetricLabels, m.errors[k], "code", k.code)
+	}
+	m.writeHistogram(&b, "dify_time_to_first_token_seconds", "Time from sending a streaming call to its first answer text.", m.firstToken)
+	m.writeHistogram(&b, "dify_stream_duration_seconds", "Duration of streams until they are closed.", m.streams)
+	writeHeader(&b, "dify_tokens_total", "counter", "Tokens reported by Dify, by kind.")
+	for _, k := range sortedKeys(m.tokens) {
+		writeSample(&b, "dify_tokens_total", k.MetricLabels, m.tokens[k], "kind", k.kind)
+	}
+	writeHeader(&b, "dify_price_total", "counter", "Price reported by Dify, by currency.")
+	for _, k := range sortedKeys(m.price) {
+		writeSample(&b, "dify_price_total", k.MetricLabels, m.price[k], "currency", k.currency)
+	}
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func (m *MemoryMetrics) writeHistogram(b *bytes.Buffer, name, help string, hs map[MetricLabels]*histogram) {
+	writeHeader(b, name, "histogram", help)
+	for _, labels := range sortedKeys(hs) {
+		h := hs[labels]
+		for i, le := range m.buckets {
+			writeSample(b, name+"_bucket", labels, float64(h.counts[i]), "le", formatFloat(le))
+		}
+		writeSample(b, name+"_bucket", labels, float64(h.count), "le", "+Inf")
+		writeSample(b, name+"_sum", labels, h.sum)
+		writeSample(b, name+"_count", labels, float64(h.count))
+	}
+}
+
+func writeHeader(b *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeSample writes one sample with the endpoint and app labels followed by
+// extra name/value pairs.
+func writeSample(b *bytes.Buffer, name string, labels MetricLabels, value float64, extra ...string) {
+	fmt.Fprintf(b, "%s{endpoint=%s,app=%s", name, quoteLabel(labels.Endpoint), quoteLabel(labels.App))
+	for i := 0; i+1 < len(extra); i += 2 {
+		fmt.Fprintf(b, ",%s=%s", extra[i], quoteLabel(extra[i+1]))
+	}
+	fmt.Fprintf(b, "} %s\n", formatFloat(value))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of m in a stable order for the exposition.
+func sortedKeys[K comparable, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b K) int {
+		return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+	})
+	return keys
+}
@@ -0,0 +1,42 @@
+package dify
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryMetricsPrometheus(t *testing.T) {
+	m := NewMemoryMetricsWithBuckets([]float64{1, 0.1})
+	labels := MetricLabels{Endpoint: "/v1/chat-messages", App: `app-"x"`}
+	m.ObserveRequest(labels, 200, 50*time.Millisecond)
+	m.ObserveRequest(labels, 200, 500*time.Millisecond)
+	m.ObserveError(labels, "invalid_param")
+	m.ObserveUsage(labels, Usage{PromptTokens: 3, CompletionTokens: 4, TotalTokens: 7, TotalPrice: "0.25", Currency: "USD"})
+	m.ObserveUsage(labels, Usage{TotalTokens: 1, TotalPrice: "0.5", Currency: "USD"})
+
+	var b bytes.Buffer
+	if err := m.WritePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		"# TYPE dify_requests_total counter\n",
+		`dify_requests_total{endpoint="/v1/chat-messages",app="app-\"x\"",status="200"} 2` + "\n",
+		`dify_request_duration_seconds_bucket{endpoint="/v1/chat-messages",app="app-\"x\"",le="0.1"} 1` + "\n",
+		`dify_request_duration_seconds_bucket{endpoint="/v1/chat-messages",app="app-\"x\"",le="1"} 2` + "\n",
+		`dify_request_duration_seconds_bucket{endpoint="/v1/chat-messages",app="app-\"x\"",le="+Inf"} 2` + "\n",
+		`dify_request_duration_seconds_sum{endpoint="/v1/chat-messages",app="app-\"x\""} 0.55` + "\n",
+		`dify_request_duration_seconds_count{endpoint="/v1/chat-messages",app="app-\"x\""} 2` + "\n",
+		`dify_errors_total{endpoint="/v1/chat-messages",app="app-\"x\"",code="invalid_param"} 1` + "\n",
+		`dify_tokens_total{endpoint="/v1/chat-messages",app="app-\"x\"",kind="total"} 8` + "\n",
+		`dify_tokens_total{endpoint="/v1/chat-messages",app="app-\"x\"",kind="prompt"} 3` + "\n",
+		`dify_price_total{endpoint="/v1/chat-messages",app="app-\"x\"",currency="USD"} 0.75` + "\n",
+		"# TYPE dify_stream_duration_seconds histogram\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+}
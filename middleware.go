@@ -0,0 +1,122 @@
+package dify
+
+import (
+	"context"
+	"net/http"
+)
+
+// RequestHandler sends a request to Dify and returns its response.
+type RequestHandler func(req *http.Request) (*http.Response, error)
+
+// Middleware wraps every API call. It may modify the request before passing
+// it to next, and inspect or replace the response. A middleware that reads a
+// response body must replace it with one that yields the same bytes.
+//
+// Middlewares run once per call, around the retries of the client's retry
+// policy, with the first one in ClientConfig.Middlewares outermost:
+//
+//	func audit(next dify.RequestHandler) dify.RequestHandler {
+//		return func(req *http.Request) (*http.Response, error) {
+//			resp, err := next(req)
+//			log.Printf("%s %s: %v", req.Method, req.URL.Path, err)
+//			return resp, err
+//		}
+//	}
+type Middleware func(next RequestHandler) RequestHandler
+
+// HeaderMiddleware sets header on every request, for example to route
+// tenants through a gateway.
+func HeaderMiddleware(header http.Header) Middleware {
+	return func(next RequestHandler) RequestHandler {
+		return func(req *http.Request) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			for k, v := range header {
+				req.Header[k] = v
+			}
+			return next(req)
+		}
+	}
+}
+
+// StreamEvent is a raw event of a streaming response, seen by observers
+// registered with ObserveStreamEvents.
+type StreamEvent struct {
+	// Event is the Dify event type, such as "message" or "node_finished".
+	Event string
+	ID    string
+	// Data is the JSON payload. It is only valid during the observer call.
+	Data []byte
+}
+
+type streamObserversKey struct{}
+
+// ObserveStreamEvents returns a copy of req whose stream events, if the call
+// is a streaming one, are passed to observe before they are decoded.
+// Middlewares use it to watch streams:
+//
+//	return next(dify.ObserveStreamEvents(req, func(ev dify.StreamEvent) {
+//		...
+//	}))
+func ObserveStreamEvents(req *http.Request, observe func(StreamEvent)) *http.Request {
+	observers := append(streamObservers(req.Context()), observe)
+	return req.WithContext(context.WithValue(req.Context(), streamObserversKey{}, observers))
+}
+
+func streamObservers(ctx context.Context) []func(StreamEvent) {
+	observers, _ := ctx.Value(streamObserversKey{}).([]func(StreamEvent))
+	// Copy on append so that requests derived from the same context do not
+	// share observers.
+	return observers[:len(observers):len(observers)]
+}
+
+// observedStream records the stream observers of a call as they were when
+// the request reached the base transport, after the middlewares and the
+// transports above it, such as the load balancer, registered theirs. They are
+// carried on the response body rather than read from resp.Request, which a
+// custom RoundTripper may leave unset.
+type observedStream struct {
+	observers []func(StreamEvent)
+}
+
+type observedStreamKey struct{}
+
+func withObservedStream(ctx context.Context, o *observedStream) context.Context {
+	return context.WithValue(ctx, observedStreamKey{}, o)
+}
+
+// observingTransport records the stream observers of the requests it passes
+// to base. Attempts are sent one after another, so the last one wins.
+type observingTransport struct {
+	base http.RoundTripper
+}
+
+func (t observingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if o, ok := req.Context().Value(observedStreamKey{}).(*observedStream); ok {
+		o.observers = streamObservers(req.Context())
+	}
+	return t.base.RoundTrip(req)
+}
+
+// streamObserver combines the observers registered on the call of resp, a
+// response from sendRequest.
+func streamObserver(resp *http.Response) func(sseEvent) {
+	body, ok := resp.Body.(*tracedBody)
+	if !ok || body.observed == nil || len(body.observed.observers) == 0 {
+		return nil
+	}
+	observers := body.observed.observers
+	return func(event sseEvent) {
+		ev := StreamEvent{Event: peekEventType(event.Data), ID: event.ID, Data: event.Data}
+		for _, observe := range observers {
+			observe(ev)
+		}
+	}
+}
+
+// chainMiddlewares wraps handler with middlewares, the first one outermost.
+func chainMiddlewares(middlewares []Middleware, handler RequestHandler) RequestHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
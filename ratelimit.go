@@ -0,0 +1,260 @@
+package dify
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit limits the calls made with one API secret. The zero value does
+// not limit anything.
+type RateLimit struct {
+	// RequestsPerSecond and Burst configure a token bucket. Every attempt,
+	// retries included, takes a token. Burst defaults to 1.
+	RequestsPerSecond float64
+	Burst             int
+	// MaxConcurrent caps the calls in flight. A call holds its slot until
+	// its response body is closed, which for a stream is when it ends.
+	MaxConcurrent int
+}
+
+func (l RateLimit) enabled() bool {
+	return l.RequestsPerSecond > 0 || l.MaxConcurrent > 0
+}
+
+// RateLimitWait describes a call that had to wait for the rate limiter or
+// for a concurrency slot.
+type RateLimitWait struct {
+	// Secret is the API secret of the call, redacted to its last characters.
+	Secret    string
+	Streaming bool
+	// Limit is "rate" or "concurrency".
+	Limit string
+	Wait  time.Duration
+	// Err is set when the context ended before the call could proceed.
+	Err error
+}
+
+// rateLimitedTransport applies the blocking and streaming limits, per
+// secret, to every request before passing it on.
+type rateLimitedTransport struct {
+	base      http.RoundTripper
+	blocking  RateLimit
+	streaming RateLimit
+	onWait    func(RateLimitWait)
+
+	mu      sync.Mutex
+	secrets map[string]*secretLimiter
+}
+
+type secretLimiter struct {
+	blocking  *callLimiter
+	streaming *callLimiter
+}
+
+type callLimiter struct {
+	bucket *tokenBucket
+	slots  chan struct{}
+}
+
+type streamingCallKey struct{}
+
+// withStreamingCall marks ctx as belonging to a streaming call.
+func withStreamingCall(ctx context.Context) context.Context {
+	return context.WithValue(ctx, streamingCallKey{}, true)
+}
+
+func isStreamingCall(ctx context.Context) bool {
+	return ctx.Value(streamingCallKey{}) != nil
+}
+
+func newRateLimitedTransport(base http.RoundTripper, c *ClientConfig) *rateLimitedTransport {
+	return &rateLimitedTransport{
+		base:      base,
+		blocking:  c.BlockingRateLimit,
+		streaming: c.StreamingRateLimit,
+		onWait:    c.OnRateLimitWait,
+		secrets:   make(map[string]*secretLimiter),
+	}
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	secret := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	streaming := isStreamingCall(req.Context())
+	limiter := t.limiter(secret, streaming)
+	if limiter == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	ctx := req.Context()
+	if limiter.slots != nil {
+		if err := t.acquire(ctx, limiter.slots, secret, streaming); err != nil {
+			return nil, err
+		}
+	}
+	release := func() {
+		if limiter.slots != nil {
+			<-limiter.slots
+		}
+	}
+
+	if limiter.bucket != nil {
+		if err := t.take(ctx, limiter.bucket, secret, streaming); err != nil {
+			release()
+			return nil, err
+		}
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// limiter returns the limiter of secret for the kind of call, or nil if that
+// kind is not limited.
+func (t *rateLimitedTransport) limiter(secret string, streaming bool) *callLimiter {
+	limit := t.blocking
+	if streaming {
+		limit = t.streaming
+	}
+	if !limit.enabled() {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.secrets[secret]
+	if !ok {
+		s = &secretLimiter{blocking: newCallLimiter(t.blocking), streaming: newCallLimiter(t.streaming)}
+		t.secrets[secret] = s
+	}
+	if streaming {
+		return s.streaming
+	}
+	return s.blocking
+}
+
+func newCallLimiter(limit RateLimit) *callLimiter {
+	l := &callLimiter{}
+	if limit.RequestsPerSecond > 0 {
+		l.bucket = newTokenBucket(limit.RequestsPerSecond, max(limit.Burst, 1))
+	}
+	if limit.MaxConcurrent > 0 {
+		l.slots = make(chan struct{}, limit.MaxConcurrent)
+	}
+	return l
+}
+
+func (t *rateLimitedTransport) acquire(ctx context.Context, slots chan struct{}, secret string, streaming bool) error {
+	select {
+	case slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	start := time.Now()
+	var err error
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	t.reportWait(secret, streaming, "concurrency", time.Since(start), err)
+	return err
+}
+
+func (t *rateLimitedTransport) take(ctx context.Context, bucket *tokenBucket, secret string, streaming bool) error {
+	d := bucket.reserve()
+	if d <= 0 {
+		return nil
+	}
+	err := sleepContext(ctx, d)
+	if err != nil {
+		bucket.cancel()
+	}
+	t.reportWait(secret, streaming, "rate", d, err)
+	return err
+}
+
+func (t *rateLimitedTransport) reportWait(secret string, streaming bool, limit string, wait time.Duration, err error) {
+	if t.onWait == nil {
+		return
+	}
+	t.onWait(RateLimitWait{
+		Secret:    redactSecret(secret),
+		Streaming: streaming,
+		Limit:     limit,
+		Wait:      wait,
+		Err:       err,
+	})
+}
+
+// releasingBody frees a concurrency slot when the response body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// tokenBucket hands out tokens at rate per second, holding at most burst.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// reserve takes a token, possibly going into debt, and returns how long to
+// wait until it is available.
+func (b *tokenBucket) reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel returns a reserved token that was not used.
+func (b *tokenBucket) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.burst, b.tokens+1)
+}
+
+// redactSecret keeps the prefix and the last four characters of an API
+// secret, enough to tell apps apart in logs.
+func redactSecret(secret string) string {
+	prefix, rest, ok := strings.Cut(secret, "-")
+	if !ok {
+		prefix, rest = "", secret
+	} else {
+		prefix += "-"
+	}
+	if len(rest) <= 4 {
+		return prefix + "****"
+	}
+	return prefix + "****" + rest[len(rest)-4:]
+}
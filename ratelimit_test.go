@@ -0,0 +1,37 @@
+package dify
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(10, 2)
+	if d := b.reserve(); d != 0 {
+		t.Errorf("first reserve waits %v", d)
+	}
+	if d := b.reserve(); d != 0 {
+		t.Errorf("second reserve within burst waits %v", d)
+	}
+	if d := b.reserve(); d < 90*time.Millisecond || d > 100*time.Millisecond {
+		t.Errorf("third reserve waits %v, want about 100ms", d)
+	}
+	b.cancel()
+	if d := b.reserve(); d < 90*time.Millisecond || d > 100*time.Millisecond {
+		t.Errorf("reserve after cancel waits %v, want about 100ms", d)
+	}
+}
+
+func TestRedactSecret(t *testing.T) {
+	tests := map[string]string{
+		"app-abcdefgh1234": "app-****1234",
+		"abcdefgh1234":     "****1234",
+		"app-123":          "app-****",
+		"":                 "****",
+	}
+	for secret, want := range tests {
+		if got := redactSecret(secret); got != want {
+			t.Errorf("redactSecret(%q) = %q, want %q", secret, got, want)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package dify
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryErrorClass selects which transport errors a RetryPolicy retries.
+type RetryErrorClass uint
+
+const (
+	// RetryConnectionErrors retries failures to reach Dify before any
+	// response arrived: DNS and dial errors, refused connections, and
+	// connections reset or closed while waiting for the response. Calls
+	// that must not run twice only retry the errors showing that the
+	// connection could not be opened.
+	RetryConnectionErrors RetryErrorClass = 1 << iota
+	// RetryTimeouts retries requests that timed out, such as those hitting
+	// ClientConfig.Timeout.
+	RetryTimeouts
+)
+
+// RetryPolicy retries failed requests with exponential backoff.
+//
+// Blocking calls are retried on the configured status codes and error
+// classes. Streams are retried the same way, but only while they are being
+// opened, so an event is never delivered twice. Blocking workflow runs may
+// have side effects once Dify received them and are only retried when the
+// connection could not be opened, never after the request was sent.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the first one.
+	// Defaults to 3.
+	MaxAttempts int
+	// MinBackoff is the wait before the first retry, doubled for every
+	// further one up to MaxBackoff. They default to 500ms and 10s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Jitter is the fraction of each wait, between 0 and 1, that is
+	// randomised so that clients do not retry in lockstep.
+	Jitter float64
+	// RetryableStatusCodes defaults to 429, 502, 503 and 504.
+	RetryableStatusCodes []int
+	// RetryableErrors defaults to RetryConnectionErrors | RetryTimeouts.
+	RetryableErrors RetryErrorClass
+}
+
+// DefaultRetryPolicy returns the policy used for zero fields, with 20%
+// jitter.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:          3,
+		MinBackoff:           500 * time.Millisecond,
+		MaxBackoff:           10 * time.Second,
+		Jitter:               0.2,
+		RetryableStatusCodes: []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+		RetryableErrors:      RetryConnectionErrors | RetryTimeouts,
+	}
+}
+
+// withDefaults fills the zero fields of p. A nil policy disables retries.
+func (p *RetryPolicy) withDefaults() *RetryPolicy {
+	if p == nil {
+		return &RetryPolicy{MaxAttempts: 1}
+	}
+	def := DefaultRetryPolicy()
+	r := *p
+	if r.MaxAttempts <= 0 {
+		r.MaxAttempts = def.MaxAttempts
+	}
+	if r.MinBackoff <= 0 {
+		r.MinBackoff = def.MinBackoff
+	}
+	if r.MaxBackoff <= 0 {
+		r.MaxBackoff = def.MaxBackoff
+	}
+	if r.MaxBackoff < r.MinBackoff {
+		r.MaxBackoff = r.MinBackoff
+	}
+	r.Jitter = min(max(r.Jitter, 0), 1)
+	if r.RetryableStatusCodes == nil {
+		r.RetryableStatusCodes = def.RetryableStatusCodes
+	}
+	if r.RetryableErrors == 0 {
+		r.RetryableErrors = def.RetryableErrors
+	}
+	return &r
+}
+
+// retryScope narrows the policy for requests that are not safe to repeat.
+type retryScope int
+
+const (
+	retryAll retryScope = iota
+	// retryConnectionOnly retries the errors of connections that could not
+	// be opened only, for requests that must not run twice.
+	retryConnectionOnly
+)
+
+func (p *RetryPolicy) retryableStatus(status int) bool {
+	for _, code := range p.RetryableStatusCodes {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RetryPolicy) retryableError(err error, scope retryScope) bool {
+	if scope == retryConnectionOnly {
+		return unsentError(err) && p.RetryableErrors&RetryConnectionErrors != 0
+	}
+	return retryErrorClass(err)&p.RetryableErrors != 0
+}
+
+// unsentError reports whether err shows that the request never reached Dify,
+// because the connection could not be opened. A reset or an unexpected EOF
+// can happen after Dify received the request.
+func unsentError(err error) bool {
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	return errors.As(err, &opErr) && opErr.Op == "dial" ||
+		errors.As(err, &dnsErr) ||
+		errors.Is(err, syscall.ECONNREFUSED)
+}
+
+func retryErrorClass(err error) RetryErrorClass {
+	switch {
+	case unsentError(err),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return RetryConnectionErrors
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return RetryTimeouts
+	}
+	return 0
+}
+
+// backoff returns the wait before retry n, starting at 1.
+func (p *RetryPolicy) backoff(n int) time.Duration {
+	d := p.MinBackoff
+	for i := 1; i < n && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, p.MaxBackoff)
+	if p.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * p.Jitter * float64(d))
+	}
+	return d
+}
+
+// retryAfter parses the Retry-After header of resp, given in seconds or as
+// an HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// doWithRetry sends req until it succeeds, fails with an error or status the
+// policy does not retry, or runs out of attempts. The last response or error
+// is returned. A Retry-After longer than MaxBackoff is not waited for.
+func (c *Client) doWithRetry(httpClient *http.Client, req *http.Request, scope retryScope, onRetry func(attempt int, delay time.Duration)) (*http.Response, error) {
+	p := c.retry
+	for attempt := 1; ; attempt++ {
+		resp, err := httpClient.Do(req)
+		if attempt >= p.MaxAttempts || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		var delay time.Duration
+		switch {
+		case err != nil:
+			if !p.retryableError(err, scope) {
+				return nil, err
+			}
+			delay = p.backoff(attempt)
+		case scope == retryAll && p.retryableStatus(resp.StatusCode):
+			delay = p.backoff(attempt)
+			if after, ok := retryAfter(resp); ok {
+				if after > p.MaxBackoff {
+					return resp, nil
+				}
+				delay = after
+			}
+		default:
+			return resp, nil
+		}
+
+		next, rewindErr := rewindRequest(req)
+		if rewindErr != nil {
+			// The body cannot be sent again; report the last outcome.
+			return resp, err
+		}
+		if resp != nil {
+			// Drain a little so the connection can be reused.
+			io.CopyN(io.Discard, resp.Body, maxErrorRawSize)
+			resp.Body.Close()
+		}
+		if onRetry != nil {
+			onRetry(attempt, delay)
+		}
+		if err := sleepContext(req.Context(), delay); err != nil {
+			return nil, err
+		}
+		req = next
+	}
+}
+
+// rewindRequest returns a copy of req with a fresh body.
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.GetBody == nil {
+		return nil, errors.New("request body cannot be replayed")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	next := req.Clone(req.Context())
+	next.Body = body
+	return next, nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,168 @@
+package dify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoSecret is returned by the built-in providers when they have no secret
+// to supply.
+var ErrNoSecret = errors.New("dify: no API secret")
+
+// SecretProvider supplies the API secret of every call, for secrets that are
+// rotated while the client runs. When Dify rejects a secret with a 401, the
+// client calls Refresh and, if it returns another secret, sends the call once
+// more with it.
+type SecretProvider interface {
+	// Secret returns the current secret. It is called for every request
+	// and should be cheap.
+	Secret(ctx context.Context) (string, error)
+	// Refresh reloads the secret after Dify rejected it and returns the
+	// new one.
+	Refresh(ctx context.Context) (string, error)
+}
+
+// StaticSecret returns a provider of a fixed secret.
+func StaticSecret(secret string) SecretProvider {
+	return staticSecret(secret)
+}
+
+type staticSecret string
+
+func (s staticSecret) Secret(context.Context) (string, error) {
+	if s == "" {
+		return "", ErrNoSecret
+	}
+	return string(s), nil
+}
+
+func (s staticSecret) Refresh(ctx context.Context) (string, error) {
+	return s.Secret(ctx)
+}
+
+// EnvSecret returns a provider reading the environment variable name on every
+// call.
+func EnvSecret(name string) SecretProvider {
+	return envSecret(name)
+}
+
+type envSecret string
+
+func (e envSecret) Secret(context.Context) (string, error) {
+	secret := strings.TrimSpace(os.Getenv(string(e)))
+	if secret == "" {
+		return "", fmt.Errorf("%w in $%s", ErrNoSecret, string(e))
+	}
+	return secret, nil
+}
+
+func (e envSecret) Refresh(ctx context.Context) (string, error) {
+	return e.Secret(ctx)
+}
+
+// DefaultSecretFileInterval is how often a FileSecret checks its file.
+const DefaultSecretFileInterval = time.Second
+
+// FileSecret provides the secret stored in a file, such as one mounted from a
+// secret manager, without surrounding whitespace. The file is read again when
+// a secret is needed and the last read is older than the interval, and
+// immediately on Refresh. The last secret read is kept while the file is
+// missing or empty, as it can be for a moment during a rotation.
+type FileSecret struct {
+	path     string
+	interval time.Duration
+
+	mu     sync.Mutex
+	secret string
+	read   time.Time
+}
+
+// NewFileSecret returns a provider of the secret in the file at path, checked
+// every DefaultSecretFileInterval.
+func NewFileSecret(path string) *FileSecret {
+	return NewFileSecretWithInterval(path, DefaultSecretFileInterval)
+}
+
+// NewFileSecretWithInterval returns a provider of the secret in the file at
+// path, checked at most once per interval.
+func NewFileSecretWithInterval(path string, interval time.Duration) *FileSecret {
+	return &FileSecret{path: path, interval: interval}
+}
+
+func (f *FileSecret) Secret(context.Context) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.secret != "" && time.Since(f.read) < f.interval {
+		return f.secret, nil
+	}
+	return f.load()
+}
+
+func (f *FileSecret) Refresh(context.Context) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.load()
+}
+
+func (f *FileSecret) load() (string, error) {
+	b, err := os.ReadFile(f.path)
+	if err == nil && len(strings.TrimSpace(string(b))) == 0 {
+		err = fmt.Errorf("%w in %s", ErrNoSecret, f.path)
+	}
+	if err != nil {
+		if f.secret != "" {
+			return f.secret, nil
+		}
+		return "", err
+	}
+	f.secret = strings.TrimSpace(string(b))
+	f.read = time.Now()
+	return f.secret, nil
+}
+
+type secretProviderKey struct{}
+
+// withSecretProvider marks the calls of ctx as using a secret of provider.
+func withSecretProvider(ctx context.Context, provider SecretProvider) context.Context {
+	return context.WithValue(ctx, secretProviderKey{}, provider)
+}
+
+func secretProviderFromContext(ctx context.Context) SecretProvider {
+	provider, _ := ctx.Value(secretProviderKey{}).(SecretProvider)
+	return provider
+}
+
+// doWithSecretRefresh sends req with send and, when Dify rejects the secret
+// of a SecretProvider with a 401, refreshes it and sends req once more. The
+// 401 is returned when the provider has no other secret.
+func (c *Client) doWithSecretRefresh(req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	provider := secretProviderFromContext(req.Context())
+	resp, err := send(req)
+	if provider == nil || err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	secret, refreshErr := provider.Refresh(req.Context())
+	if c.logger != nil {
+		c.logger.onSecretRefresh(req, refreshErr)
+	}
+	if refreshErr != nil || "Bearer "+secret == req.Header.Get("Authorization") {
+		return resp, nil
+	}
+	next, rewindErr := rewindRequest(req)
+	if rewindErr != nil {
+		return resp, nil
+	}
+	next = next.Clone(next.Context())
+	next.Header.Set("Authorization", "Bearer "+secret)
+	io.CopyN(io.Discard, resp.Body, maxErrorRawSize)
+	resp.Body.Close()
+	return send(next)
+}
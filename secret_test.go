@@ -0,0 +1,80 @@
+package dify
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileSecret(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "api-key")
+	if _, err := NewFileSecret(path).Secret(ctx); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(" \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileSecret(path).Secret(ctx); !errors.Is(err, ErrNoSecret) {
+		t.Errorf("empty file: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("app-one\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := NewFileSecretWithInterval(path, time.Hour)
+	if secret, err := s.Secret(ctx); err != nil || secret != "app-one" {
+		t.Fatalf("Secret = %q, %v", secret, err)
+	}
+	if err := os.WriteFile(path, []byte("app-two\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if secret, _ := s.Secret(ctx); secret != "app-one" {
+		t.Errorf("Secret within the interval = %q", secret)
+	}
+	if secret, err := s.Refresh(ctx); err != nil || secret != "app-two" {
+		t.Errorf("Refresh = %q, %v", secret, err)
+	}
+
+	// The last secret is kept while the file is being replaced.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if secret, err := s.Refresh(ctx); err != nil || secret != "app-two" {
+		t.Errorf("Refresh of a missing file = %q, %v", secret, err)
+	}
+}
+
+func TestFileSecretInterval(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "api-key")
+	if err := os.WriteFile(path, []byte("app-one"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := NewFileSecretWithInterval(path, 10*time.Millisecond)
+	s.Secret(ctx)
+	if err := os.WriteFile(path, []byte("app-two"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if secret, _ := s.Secret(ctx); secret != "app-two" {
+		t.Errorf("Secret after the interval = %q", secret)
+	}
+}
+
+func TestEnvAndStaticSecret(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("DIFY_TEST_SECRET", "app-env")
+	if secret, err := EnvSecret("DIFY_TEST_SECRET").Secret(ctx); err != nil || secret != "app-env" {
+		t.Errorf("EnvSecret = %q, %v", secret, err)
+	}
+	if _, err := EnvSecret("DIFY_TEST_UNSET").Secret(ctx); !errors.Is(err, ErrNoSecret) {
+		t.Errorf("EnvSecret of an unset variable: %v", err)
+	}
+	if secret, err := StaticSecret("app-static").Refresh(ctx); err != nil || secret != "app-static" {
+		t.Errorf("StaticSecret = %q, %v", secret, err)
+	}
+}
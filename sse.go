@@ -0,0 +1,219 @@
+package dify
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"time"
+)
+
+const sseInitialBufferSize = 4096
+
+var sseBOM = []byte("\xEF\xBB\xBF")
+
+// sseEvent is one dispatched server-sent event. Data aliases the decoder's
+// internal buffer and is only valid until the next call to Next.
+type sseEvent struct {
+	Type string
+	Data []byte
+	ID   string
+}
+
+// sseDecoder parses a text/event-stream body following the WHATWG
+// "Interpreting an event stream" rules: LF, CR and CRLF line endings,
+// comment lines, multi-line data fields, the event/id/retry fields and
+// dispatch on a blank line. An event left incomplete at EOF is discarded.
+type sseDecoder struct {
+	r   io.Reader
+	buf []byte
+	pos int
+	end int
+	eof bool
+
+	// skipLF is set when a line ended with CR at the end of the buffer, so a
+	// following LF belongs to the same line terminator.
+	skipLF     bool
+	checkedBOM bool
+
+	eventType   string
+	typeCache   string
+	data        []byte
+	hasData     bool
+	lastEventID string
+	retry       time.Duration
+
+	// heartbeat, when set, is called for every event boundary and comment
+	// line, including events that carry no data such as Dify's ping.
+	heartbeat func()
+}
+
+func newSSEDecoder(r io.Reader) *sseDecoder {
+	return &sseDecoder{
+		r:   r,
+		buf: make([]byte, sseInitialBufferSize),
+	}
+}
+
+// Next returns the next dispatched event. It returns io.EOF once the stream
+// is exhausted.
+func (d *sseDecoder) Next() (sseEvent, error) {
+	for {
+		line, err := d.readLine()
+		if err != nil {
+			return sseEvent{}, err
+		}
+		if ev, ok := d.processLine(line); ok {
+			return ev, nil
+		}
+	}
+}
+
+// Retry returns the reconnection time last announced by the server.
+func (d *sseDecoder) Retry() time.Duration {
+	return d.retry
+}
+
+func (d *sseDecoder) processLine(line []byte) (sseEvent, bool) {
+	if len(line) == 0 || line[0] == ':' {
+		if d.heartbeat != nil {
+			d.heartbeat()
+		}
+		if len(line) == 0 {
+			return d.dispatch()
+		}
+		return sseEvent{}, false
+	}
+
+	var field, value []byte
+	if i := bytes.IndexByte(line, ':'); i >= 0 {
+		field, value = line[:i], line[i+1:]
+		if len(value) > 0 && value[0] == ' ' {
+			value = value[1:]
+		}
+	} else {
+		field = line
+	}
+
+	switch string(field) {
+	case "event":
+		// Streams tend to repeat a handful of event types; reuse the last
+		// string instead of allocating one per event.
+		if string(value) != d.typeCache {
+			d.typeCache = string(value)
+		}
+		d.eventType = d.typeCache
+	case "data":
+		d.data = append(d.data, value...)
+		d.data = append(d.data, '\n')
+		d.hasData = true
+	case "id":
+		if bytes.IndexByte(value, 0) < 0 && string(value) != d.lastEventID {
+			d.lastEventID = string(value)
+		}
+	case "retry":
+		if isASCIIDigits(value) {
+			if ms, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+				d.retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+	return sseEvent{}, false
+}
+
+func (d *sseDecoder) dispatch() (sseEvent, bool) {
+	if !d.hasData {
+		d.eventType = ""
+		return sseEvent{}, false
+	}
+
+	ev := sseEvent{
+		Type: d.eventType,
+		Data: d.data[:len(d.data)-1],
+		ID:   d.lastEventID,
+	}
+	if ev.Type == "" {
+		ev.Type = "message"
+	}
+
+	d.eventType = ""
+	d.data = d.data[:0]
+	d.hasData = false
+	return ev, true
+}
+
+// readLine returns the next line without its terminator. The returned slice
+// is only valid until the next call.
+func (d *sseDecoder) readLine() ([]byte, error) {
+	for {
+		if d.skipLF && d.pos < d.end {
+			if d.buf[d.pos] == '\n' {
+				d.pos++
+			}
+			d.skipLF = false
+		}
+
+		if !d.checkedBOM {
+			if d.end-d.pos < len(sseBOM) && !d.eof {
+				if err := d.fill(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if bytes.HasPrefix(d.buf[d.pos:d.end], sseBOM) {
+				d.pos += len(sseBOM)
+			}
+			d.checkedBOM = true
+		}
+
+		if i := bytes.IndexAny(d.buf[d.pos:d.end], "\r\n"); i >= 0 {
+			line := d.buf[d.pos : d.pos+i]
+			if d.buf[d.pos+i] == '\r' {
+				d.skipLF = true
+			}
+			d.pos += i + 1
+			return line, nil
+		}
+
+		if d.eof {
+			// A trailing line without terminator never completes an event.
+			d.pos = d.end
+			return nil, io.EOF
+		}
+		if err := d.fill(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// fill reads more data into the buffer, compacting or growing it as needed.
+func (d *sseDecoder) fill() error {
+	if d.pos > 0 {
+		n := copy(d.buf, d.buf[d.pos:d.end])
+		d.pos, d.end = 0, n
+	}
+	if d.end == len(d.buf) {
+		buf := make([]byte, len(d.buf)*2)
+		copy(buf, d.buf[:d.end])
+		d.buf = buf
+	}
+
+	n, err := d.r.Read(d.buf[d.end:])
+	d.end += n
+	if err == io.EOF {
+		d.eof = true
+		return nil
+	}
+	return err
+}
+
+func isASCIIDigits(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
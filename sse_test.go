@@ -0,0 +1,164 @@
+package dify
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestSSEDecoder(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []sseEvent
+	}{
+		{
+			name:   "data with space",
+			stream: "data: {\"a\":1}\n\n",
+			want:   []sseEvent{{Type: "message", Data: []byte(`{"a":1}`)}},
+		},
+		{
+			name:   "data without space",
+			stream: "data:{\"a\":1}\n\n",
+			want:   []sseEvent{{Type: "message", Data: []byte(`{"a":1}`)}},
+		},
+		{
+			name:   "only one leading space is stripped",
+			stream: "data:  x\n\n",
+			want:   []sseEvent{{Type: "message", Data: []byte(" x")}},
+		},
+		{
+			name:   "multi-line data",
+			stream: "data: first\ndata: second\ndata\n\n",
+			want:   []sseEvent{{Type: "message", Data: []byte("first\nsecond\n")}},
+		},
+		{
+			name:   "CRLF line endings",
+			stream: "event: ping\r\ndata: a\r\n\r\ndata: b\r\n\r\n",
+			want: []sseEvent{
+				{Type: "ping", Data: []byte("a")},
+				{Type: "message", Data: []byte("b")},
+			},
+		},
+		{
+			name:   "CR line endings",
+			stream: "data: a\rdata: b\r\rdata: c\r\r",
+			want: []sseEvent{
+				{Type: "message", Data: []byte("a\nb")},
+				{Type: "message", Data: []byte("c")},
+			},
+		},
+		{
+			name:   "comments are ignored",
+			stream: ": keep-alive\ndata: a\n: in between\n\n:\n\n",
+			want:   []sseEvent{{Type: "message", Data: []byte("a")}},
+		},
+		{
+			name:   "event without data is not dispatched",
+			stream: "event: ping\n\ndata: a\n\n",
+			want:   []sseEvent{{Type: "message", Data: []byte("a")}},
+		},
+		{
+			name:   "id persists across events",
+			stream: "id: 1\ndata: a\n\ndata: b\n\nid\ndata: c\n\n",
+			want: []sseEvent{
+				{Type: "message", Data: []byte("a"), ID: "1"},
+				{Type: "message", Data: []byte("b"), ID: "1"},
+				{Type: "message", Data: []byte("c")},
+			},
+		},
+		{
+			name:   "id containing NULL is ignored",
+			stream: "id: 1\ndata: a\n\nid: 2\x00\ndata: b\n\n",
+			want: []sseEvent{
+				{Type: "message", Data: []byte("a"), ID: "1"},
+				{Type: "message", Data: []byte("b"), ID: "1"},
+			},
+		},
+		{
+			name:   "unknown fields are ignored",
+			stream: "foo: bar\ndata: a\nDATA: b\n\n",
+			want:   []sseEvent{{Type: "message", Data: []byte("a")}},
+		},
+		{
+			name:   "leading BOM is stripped",
+			stream: "\xEF\xBB\xBFdata: a\n\n",
+			want:   []sseEvent{{Type: "message", Data: []byte("a")}},
+		},
+		{
+			name:   "incomplete event at EOF is discarded",
+			stream: "data: a\n\ndata: b\n",
+			want:   []sseEvent{{Type: "message", Data: []byte("a")}},
+		},
+		{
+			name:   "unterminated line at EOF is discarded",
+			stream: "data: a\n\ndata: b",
+			want:   []sseEvent{{Type: "message", Data: []byte("a")}},
+		},
+		{
+			name:   "empty data field dispatches empty event",
+			stream: "data\n\n",
+			want:   []sseEvent{{Type: "message", Data: []byte{}}},
+		},
+		{
+			name:   "long line grows the buffer",
+			stream: "data: " + strings.Repeat("x", 3*sseInitialBufferSize) + "\n\n",
+			want:   []sseEvent{{Type: "message", Data: []byte(strings.Repeat("x", 3*sseInitialBufferSize))}},
+		},
+	}
+
+	readers := map[string]func(string) io.Reader{
+		"whole":    func(s string) io.Reader { return strings.NewReader(s) },
+		"one byte": func(s string) io.Reader { return iotest.OneByteReader(strings.NewReader(s)) },
+	}
+
+	for _, tt := range tests {
+		for readerName, newReader := range readers {
+			t.Run(tt.name+"/"+readerName, func(t *testing.T) {
+				got := decodeAll(t, newSSEDecoder(newReader(tt.stream)))
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("events mismatch\n got: %q\nwant: %q", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestSSEDecoderRetry(t *testing.T) {
+	d := newSSEDecoder(strings.NewReader("retry: 1500\ndata: a\n\nretry: 1x\ndata: b\n\n"))
+	decodeAll(t, d)
+	if d.Retry() != 1500*time.Millisecond {
+		t.Errorf("Retry() = %v, want 1.5s", d.Retry())
+	}
+}
+
+func TestSSEDecoderReadError(t *testing.T) {
+	errBoom := errors.New("boom")
+	d := newSSEDecoder(io.MultiReader(strings.NewReader("data: a\n\n"), iotest.ErrReader(errBoom)))
+	if _, err := d.Next(); err != nil {
+		t.Fatalf("first event: %v", err)
+	}
+	if _, err := d.Next(); !errors.Is(err, errBoom) {
+		t.Fatalf("got %v, want %v", err, errBoom)
+	}
+}
+
+func decodeAll(t *testing.T, d *sseDecoder) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	for {
+		ev, err := d.Next()
+		if err == io.EOF {
+			return events
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		ev.Data = append([]byte{}, ev.Data...)
+		events = append(events, ev)
+	}
+}
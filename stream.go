@@ -0,0 +1,172 @@
+package dify
+
+import (
+	"io"
+	"iter"
+	"sync"
+	"time"
+)
+
+// Stream iterates over the events of a streaming response:
+//
+//	for stream.Next() {
+//		event := stream.Current()
+//	}
+//	if err := stream.Err(); err != nil {
+//		...
+//	}
+//
+// The underlying response body is closed once the stream is exhausted, fails,
+// or Close is called. A Stream is not safe for concurrent use, except that
+// Close may be called from another goroutine to abort a blocked Next.
+type Stream[T any] struct {
+	body      io.ReadCloser
+	decoder   *sseDecoder
+	decode    func(sseEvent) (T, bool, error)
+	options   streamOptions
+	cur       T
+	err       error
+	done      bool
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// StreamOption configures a single streaming call.
+type StreamOption func(*streamOptions)
+
+type streamOptions struct {
+	strict  bool
+	onError func(error)
+	// observe sees every raw event before it is decoded.
+	observe func(sseEvent)
+
+	firstEventTimeout time.Duration
+	idleTimeout       time.Duration
+	totalTimeout      time.Duration
+	watchdog          *streamWatchdog
+}
+
+// WithStrictDecoding makes the stream end on the first malformed event
+// instead of skipping it.
+func WithStrictDecoding(strict bool) StreamOption {
+	return func(o *streamOptions) {
+		o.strict = strict
+	}
+}
+
+// WithStreamErrorHandler receives every malformed event skipped as a
+// *StreamDecodeError or *StreamProtocolError. In strict mode the event ends
+// the stream instead and the handler is not called.
+func WithStreamErrorHandler(f func(error)) StreamOption {
+	return func(o *streamOptions) {
+		o.onError = f
+	}
+}
+
+// newStream wraps body with decode, which turns one server-sent event into a
+// T. decode reports false to skip an event without ending the stream.
+//
+// Malformed events are skipped and passed to the error handler, if any. In
+// strict mode the first one ends the stream with its error. A read failing
+// because a timeout fired ends the stream with the timeout error.
+func newStream[T any](body io.ReadCloser, decode func(sseEvent) (T, bool, error), options streamOptions) *Stream[T] {
+	s := &Stream[T]{
+		body:    body,
+		decoder: newSSEDecoder(body),
+		decode:  decode,
+		options: options,
+	}
+	if options.watchdog != nil {
+		s.decoder.heartbeat = options.watchdog.heartbeat
+	}
+	return s
+}
+
+// Next advances to the next event, which is then available through Current.
+// It returns false when the stream ends or fails; check Err afterwards.
+func (s *Stream[T]) Next() bool {
+	if s.done {
+		return false
+	}
+	for {
+		event, err := s.decoder.Next()
+		if err != nil {
+			if err != io.EOF {
+				s.err = err
+				if timeoutErr := s.options.watchdog.timeoutErr(); timeoutErr != nil {
+					s.err = timeoutErr
+				}
+			}
+			s.finish()
+			return false
+		}
+
+		if s.options.observe != nil {
+			s.options.observe(event)
+		}
+		cur, ok, err := s.decode(event)
+		if err != nil {
+			if !s.options.strict && isMalformedEventError(err) {
+				if s.options.onError != nil {
+					s.options.onError(err)
+				}
+				continue
+			}
+			s.err = err
+			s.finish()
+			return false
+		}
+		if ok {
+			s.cur = cur
+			return true
+		}
+	}
+}
+
+// Current returns the event read by the last successful call to Next.
+func (s *Stream[T]) Current() T {
+	return s.cur
+}
+
+// Err returns the error that ended the stream, or nil if it ended normally.
+func (s *Stream[T]) Err() error {
+	return s.err
+}
+
+// Close releases the underlying response body. It is safe to call more than
+// once.
+func (s *Stream[T]) Close() error {
+	s.closeOnce.Do(func() {
+		s.closeErr = s.body.Close()
+		s.options.watchdog.stop()
+	})
+	return s.closeErr
+}
+
+// All returns an iterator over the remaining events. A failure is yielded
+// once as the final pair, and the stream is closed when the loop ends:
+//
+//	for event, err := range stream.All() {
+//		...
+//	}
+func (s *Stream[T]) All() iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		defer s.Close()
+		for s.Next() {
+			if !yield(s.cur, nil) {
+				return
+			}
+		}
+		if s.err != nil {
+			var zero T
+			yield(zero, s.err)
+		}
+	}
+}
+
+func (s *Stream[T]) finish() {
+	s.done = true
+	var zero T
+	s.cur = zero
+	s.Close()
+}
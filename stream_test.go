@@ -0,0 +1,135 @@
+package dify
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+type trackingBody struct {
+	io.Reader
+	closed int
+}
+
+func (b *trackingBody) Close() error {
+	b.closed++
+	return nil
+}
+
+func decodeString(event sseEvent) (string, bool, error) {
+	switch string(event.Data) {
+	case "skip":
+		return "", false, nil
+	case "bad":
+		return "", false, errors.New("bad event")
+	}
+	return string(event.Data), true, nil
+}
+
+func TestStreamNext(t *testing.T) {
+	body := &trackingBody{Reader: strings.NewReader("data: a\n\ndata: skip\n\ndata: b\n\n")}
+	s := newStream(body, decodeString, streamOptions{})
+
+	var got []string
+	for s.Next() {
+		got = append(got, s.Current())
+	}
+	if err := s.Err(); err != nil {
+		t.Fatalf("Err() = %v", err)
+	}
+	if strings.Join(got, ",") != "a,b" {
+		t.Errorf("got %v, want [a b]", got)
+	}
+	if s.Next() {
+		t.Error("Next after end returned true")
+	}
+	s.Close()
+	if body.closed != 1 {
+		t.Errorf("body closed %d times, want 1", body.closed)
+	}
+}
+
+func TestStreamDecodeError(t *testing.T) {
+	body := &trackingBody{Reader: strings.NewReader("data: a\n\ndata: bad\n\ndata: b\n\n")}
+	s := newStream(body, decodeString, streamOptions{})
+
+	if !s.Next() || s.Current() != "a" {
+		t.Fatalf("first event = %q", s.Current())
+	}
+	if s.Next() {
+		t.Fatalf("Next returned true after decode error, current %q", s.Current())
+	}
+	if s.Err() == nil || s.Err().Error() != "bad event" {
+		t.Errorf("Err() = %v, want bad event", s.Err())
+	}
+	if body.closed != 1 {
+		t.Errorf("body closed %d times, want 1", body.closed)
+	}
+}
+
+func TestStreamSkipsMalformedEvents(t *testing.T) {
+	decode := func(event sseEvent) (string, bool, error) {
+		if string(event.Data) == "bad" {
+			return "", false, newStreamDecodeError(event, "message", errors.New("bad event"))
+		}
+		return string(event.Data), true, nil
+	}
+	const events = "data: a\n\ndata: bad\n\ndata: b\n\n"
+
+	s := newStream(io.NopCloser(strings.NewReader(events)), decode, streamOptions{})
+	var got []string
+	for s.Next() {
+		got = append(got, s.Current())
+	}
+	if s.Err() != nil || strings.Join(got, ",") != "a,b" {
+		t.Errorf("lenient: events %v, err %v", got, s.Err())
+	}
+
+	s = newStream(io.NopCloser(strings.NewReader(events)), decode, streamOptions{strict: true})
+	got = nil
+	for s.Next() {
+		got = append(got, s.Current())
+	}
+	var decodeErr *StreamDecodeError
+	if !errors.As(s.Err(), &decodeErr) || strings.Join(got, ",") != "a" {
+		t.Errorf("strict: events %v, err %v", got, s.Err())
+	}
+}
+
+func TestStreamAll(t *testing.T) {
+	errBoom := errors.New("boom")
+	body := &trackingBody{Reader: io.MultiReader(strings.NewReader("data: a\n\ndata: b\n\n"), iotest.ErrReader(errBoom))}
+	s := newStream(body, decodeString, streamOptions{})
+
+	var (
+		got  []string
+		errs []error
+	)
+	for event, err := range s.All() {
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		got = append(got, event)
+	}
+	if strings.Join(got, ",") != "a,b" {
+		t.Errorf("got %v, want [a b]", got)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], errBoom) {
+		t.Errorf("errors = %v, want [%v]", errs, errBoom)
+	}
+}
+
+func TestStreamAllBreakCloses(t *testing.T) {
+	body := &trackingBody{Reader: strings.NewReader("data: a\n\ndata: b\n\n")}
+	s := newStream(body, decodeString, streamOptions{})
+
+	for range s.All() {
+		break
+	}
+	if body.closed != 1 {
+		t.Errorf("body closed %d times, want 1", body.closed)
+	}
+}
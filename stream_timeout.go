@@ -0,0 +1,204 @@
+package dify
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FirstEventTimeoutError is returned when a stream produced no event, a ping
+// included, within the first-event timeout. The timeout covers connecting
+// and waiting for the response headers.
+type FirstEventTimeoutError struct {
+	Duration time.Duration
+}
+
+func (e *FirstEventTimeoutError) Error() string {
+	return fmt.Sprintf("stream timeout: no event within %v", e.Duration)
+}
+
+// IdleTimeoutError is returned when the gap between two events of a stream,
+// pings included, exceeded the idle timeout.
+type IdleTimeoutError struct {
+	Duration time.Duration
+}
+
+func (e *IdleTimeoutError) Error() string {
+	return fmt.Sprintf("stream timeout: idle for %v", e.Duration)
+}
+
+// StreamTimeoutError is returned when a stream ran longer than its total
+// timeout.
+type StreamTimeoutError struct {
+	Duration time.Duration
+}
+
+func (e *StreamTimeoutError) Error() string {
+	return fmt.Sprintf("stream timeout: not finished within %v", e.Duration)
+}
+
+// The timeout errors report Timeout() like net.Error and match
+// context.DeadlineExceeded with errors.Is.
+func (e *FirstEventTimeoutError) Timeout() bool { return true }
+func (e *IdleTimeoutError) Timeout() bool       { return true }
+func (e *StreamTimeoutError) Timeout() bool     { return true }
+
+func (e *FirstEventTimeoutError) Is(target error) bool { return target == context.DeadlineExceeded }
+func (e *IdleTimeoutError) Is(target error) bool       { return target == context.DeadlineExceeded }
+func (e *StreamTimeoutError) Is(target error) bool     { return target == context.DeadlineExceeded }
+
+// WithFirstEventTimeout limits the time from sending the request to the first
+// event of the stream. Zero disables the limit set on the client.
+func WithFirstEventTimeout(d time.Duration) StreamOption {
+	return func(o *streamOptions) {
+		o.firstEventTimeout = d
+	}
+}
+
+// WithIdleTimeout limits the gap between two events of the stream. Ping
+// events count as activity. Zero disables the limit set on the client.
+func WithIdleTimeout(d time.Duration) StreamOption {
+	return func(o *streamOptions) {
+		o.idleTimeout = d
+	}
+}
+
+// WithStreamTimeout limits the total duration of the stream, from sending the
+// request to its last event. Zero disables the limit set on the client.
+func WithStreamTimeout(d time.Duration) StreamOption {
+	return func(o *streamOptions) {
+		o.totalTimeout = d
+	}
+}
+
+// streamWatchdog enforces the timeouts of one stream by cancelling its
+// request context and remembering which timeout fired.
+type streamWatchdog struct {
+	cancel context.CancelFunc
+	idle   time.Duration
+
+	// lastEvent is the UnixNano time of the last event once the first one
+	// arrived, and zero before.
+	lastEvent atomic.Int64
+
+	mu      sync.Mutex
+	first   *time.Timer
+	idler   *time.Timer
+	total   *time.Timer
+	stopped bool
+	err     error
+}
+
+type streamWatchdogKey struct{}
+
+// watch arms the configured timeouts on ctx. It returns ctx unchanged when
+// no timeout is set.
+func (o *streamOptions) watch(ctx context.Context) context.Context {
+	if o.firstEventTimeout <= 0 && o.idleTimeout <= 0 && o.totalTimeout <= 0 {
+		return ctx
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	w := &streamWatchdog{cancel: cancel, idle: o.idleTimeout}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if d := o.firstEventTimeout; d > 0 {
+		w.first = time.AfterFunc(d, func() { w.expire(&FirstEventTimeoutError{Duration: d}) })
+	}
+	if d := o.totalTimeout; d > 0 {
+		w.total = time.AfterFunc(d, func() { w.expire(&StreamTimeoutError{Duration: d}) })
+	}
+	o.watchdog = w
+	return context.WithValue(ctx, streamWatchdogKey{}, w)
+}
+
+func hasStreamWatchdog(ctx context.Context) bool {
+	return ctx.Value(streamWatchdogKey{}) != nil
+}
+
+// heartbeat records an event. The first one stops the first-event timer and
+// starts the idle timer.
+func (w *streamWatchdog) heartbeat() {
+	now := time.Now().UnixNano()
+	if w.lastEvent.Swap(now) != 0 {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped {
+		return
+	}
+	if w.first != nil {
+		w.first.Stop()
+	}
+	if w.idle > 0 {
+		w.idler = time.AfterFunc(w.idle, w.checkIdle)
+	}
+}
+
+// checkIdle fires the idle timeout, or re-arms the timer for the remainder
+// if an event arrived in the meantime.
+func (w *streamWatchdog) checkIdle() {
+	idle := time.Since(time.Unix(0, w.lastEvent.Load()))
+	if idle >= w.idle {
+		w.expire(&IdleTimeoutError{Duration: w.idle})
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.stopped {
+		w.idler.Reset(w.idle - idle)
+	}
+}
+
+func (w *streamWatchdog) expire(err error) {
+	w.mu.Lock()
+	if !w.stopped && w.err == nil {
+		w.err = err
+	}
+	w.mu.Unlock()
+	w.cancel()
+}
+
+// stop disarms all timers and releases the request context.
+func (w *streamWatchdog) stop() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.stopped = true
+	for _, t := range []*time.Timer{w.first, w.idler, w.total} {
+		if t != nil {
+			t.Stop()
+		}
+	}
+	w.mu.Unlock()
+	w.cancel()
+}
+
+// timeoutErr returns the timeout that fired, if any.
+func (w *streamWatchdog) timeoutErr() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// fail stops the watchdog of a stream that could not be opened and returns
+// the timeout behind err, if one fired.
+func (w *streamWatchdog) fail(err error) error {
+	if w == nil {
+		return err
+	}
+	w.stop()
+	if timeoutErr := w.timeoutErr(); timeoutErr != nil {
+		return timeoutErr
+	}
+	return err
+}
@@ -0,0 +1,357 @@
+package dify
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/zruijie/dify-sdk-go"
+
+// callTrace is the span of one API call. It travels on the response body, so
+// stream decoders can add events and child spans to it.
+type callTrace struct {
+	tracer trace.Tracer
+	span   trace.Span
+	start  time.Time
+	// ctx carries span, as the parent of node spans.
+	ctx context.Context
+
+	mu    sync.Mutex
+	ended bool
+	onEnd []func()
+}
+
+// end runs the registered cleanups and ends the span once.
+func (ct *callTrace) end() {
+	ct.mu.Lock()
+	if ct.ended {
+		ct.mu.Unlock()
+		return
+	}
+	ct.ended = true
+	onEnd := ct.onEnd
+	ct.mu.Unlock()
+
+	for _, f := range onEnd {
+		f()
+	}
+	ct.span.End()
+}
+
+func (ct *callTrace) addOnEnd(f func()) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.onEnd = append(ct.onEnd, f)
+}
+
+// tracedBody ends the call span when the response body is closed. It also
+// carries the stream observers of the call.
+type tracedBody struct {
+	io.ReadCloser
+	ct       *callTrace
+	observed *observedStream
+}
+
+func (b *tracedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.ct.end()
+	return err
+}
+
+// responseTrace returns the call trace of a response from sendRequest, or nil.
+// Unlike resp.Request, which a custom RoundTripper may leave unset, the body
+// is always wrapped by sendRequest.
+func responseTrace(resp *http.Response) *callTrace {
+	if body, ok := resp.Body.(*tracedBody); ok {
+		return body.ct
+	}
+	return nil
+}
+
+// startCallTrace starts the span for req and returns the request carrying it.
+func (c *Client) startCallTrace(req *http.Request) (*http.Request, *callTrace) {
+	endpoint := endpointName(req.URL.Path)
+	attrs := []attribute.KeyValue{
+		attribute.String("http.request.method", req.Method),
+		attribute.String("url.path", endpoint),
+		attribute.String("server.address", req.URL.Host),
+		attribute.String("dify.endpoint", endpoint),
+	}
+	// The app is only known for the calls of a registered app. Without its
+	// declared mode, the mode is taken from the endpoints that a single mode
+	// serves; the others do not tell a chat from an advanced chat.
+	mode := appModeOfEndpoint(endpoint)
+	if app := appFromContext(req.Context()); app != nil {
+		attrs = append(attrs, attribute.String("dify.app", app.name))
+		if app.mode != "" {
+			mode = app.mode
+		}
+	}
+	if mode != "" {
+		attrs = append(attrs, attribute.String("dify.app_mode", string(mode)))
+	}
+
+	ctx, span := c.tracer.Start(req.Context(), "dify "+req.Method+" "+endpoint,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+	ct := &callTrace{tracer: c.tracer, span: span, start: time.Now(), ctx: ctx}
+
+	req = req.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return req, ct
+}
+
+func (ct *callTrace) recordResponse(resp *http.Response) {
+	ct.span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.Request != nil {
+		// The endpoint chosen by the load balancer.
+		ct.span.SetAttributes(attribute.String("server.address", resp.Request.URL.Host))
+	}
+	if resp.StatusCode >= 400 {
+		ct.span.SetStatus(codes.Error, resp.Status)
+	}
+}
+
+func (ct *callTrace) recordError(err error) {
+	ct.span.RecordError(err)
+	ct.span.SetStatus(codes.Error, err.Error())
+}
+
+func (ct *callTrace) recordRetry(attempt int, delay time.Duration) {
+	ct.span.AddEvent("retry", trace.WithAttributes(
+		attribute.Int("dify.retry.attempt", attempt),
+		attribute.Int64("dify.retry.delay_ms", delay.Milliseconds()),
+	))
+}
+
+func (ct *callTrace) recordErrorCode(code string) {
+	if code != "" {
+		ct.span.SetAttributes(attribute.String("dify.error_code", code))
+	}
+}
+
+func (ct *callTrace) recordUsage(usage Usage) {
+	ct.span.SetAttributes(
+		attribute.Int("gen_ai.usage.input_tokens", usage.PromptTokens),
+		attribute.Int("gen_ai.usage.output_tokens", usage.CompletionTokens),
+		attribute.Int("dify.usage.total_tokens", usage.TotalTokens),
+	)
+	if usage.TotalPrice != "" {
+		ct.span.SetAttributes(
+			attribute.String("dify.usage.total_price", usage.TotalPrice),
+			attribute.String("dify.usage.currency", usage.Currency),
+		)
+	}
+}
+
+// tokenUsageReporter is implemented by responses that carry token usage.
+type tokenUsageReporter interface {
+	tokenUsage() (Usage, bool)
+}
+
+// reportedUsage extracts the usage from a decoded response, which may be
+// passed as a pointer to a response pointer.
+func reportedUsage(v interface{}) (Usage, bool) {
+	if r, ok := v.(tokenUsageReporter); ok {
+		return r.tokenUsage()
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return Usage{}, false
+	}
+	if elem := rv.Elem(); elem.Kind() == reflect.Pointer && !elem.IsNil() {
+		if r, ok := elem.Interface().(tokenUsageReporter); ok {
+			return r.tokenUsage()
+		}
+	}
+	return Usage{}, false
+}
+
+// chatStreamTracer records time-to-first-token and the final usage of a chat
+// or completion stream on its call span.
+func chatStreamTracer(ct *callTrace) func(ChatMessageStreamResponse) {
+	if ct == nil || !ct.span.IsRecording() {
+		return nil
+	}
+	var firstToken bool
+	return func(resp ChatMessageStreamResponse) {
+		if !firstToken && resp.Answer != "" {
+			firstToken = true
+			ct.span.AddEvent("first_token", trace.WithAttributes(
+				attribute.Int64("dify.time_to_first_token_ms", time.Since(ct.start).Milliseconds()),
+			))
+		}
+		if resp.Event == EventMessageEnd && resp.Metadata != nil {
+			ct.recordUsage(resp.Metadata.Usage)
+		}
+	}
+}
+
+// workflowStreamTracer creates a child span of the call span for every node,
+// starting when node_started arrives and lasting the elapsed_time reported by
+// node_finished. Nodes still open when the stream ends are ended with it.
+func workflowStreamTracer(ct *callTrace) func(WorkflowStreamEvent) {
+	if ct == nil || !ct.span.IsRecording() {
+		return nil
+	}
+	parent := ct.ctx
+
+	var mu sync.Mutex
+	type nodeSpan struct {
+		span  trace.Span
+		start time.Time
+	}
+	open := make(map[string]nodeSpan)
+	ct.addOnEnd(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for id, ns := range open {
+			ns.span.SetStatus(codes.Error, "stream ended before node finished")
+			ns.span.End()
+			delete(open, id)
+		}
+	})
+
+	return func(ev WorkflowStreamEvent) {
+		resp := ev.Response
+		if resp == nil {
+			return
+		}
+		data := &resp.Data
+
+		mu.Lock()
+		defer mu.Unlock()
+		switch resp.Event {
+		case EventWorkflowStarted:
+			ct.span.SetAttributes(
+				attribute.String("dify.workflow_run_id", resp.WorkflowRunID),
+				attribute.String("dify.workflow_id", data.WorkflowID),
+			)
+		case EventNodeStarted:
+			start := time.Now()
+			_, span := ct.tracer.Start(parent, "dify.node "+nodeSpanName(data.Title, data.NodeType),
+				trace.WithTimestamp(start),
+				trace.WithAttributes(
+					attribute.String("dify.node.id", data.NodeID),
+					attribute.String("dify.node.type", data.NodeType),
+					attribute.String("dify.node.title", data.Title),
+					attribute.Int("dify.node.index", data.Index),
+					attribute.String("dify.node.predecessor_id", data.Predecessor),
+					attribute.Int64("dify.node.created_at", data.CreatedAt),
+				),
+			)
+			open[data.ID] = nodeSpan{span: span, start: start}
+		case EventNodeFinished:
+			ns, ok := open[data.ID]
+			elapsed := time.Duration(data.ElapsedTime * float64(time.Second))
+			if !ok {
+				start := time.Now().Add(-elapsed)
+				_, span := ct.tracer.Start(parent, "dify.node "+nodeSpanName(data.Title, data.NodeType),
+					trace.WithTimestamp(start),
+					trace.WithAttributes(
+						attribute.String("dify.node.id", data.NodeID),
+						attribute.String("dify.node.type", data.NodeType),
+					),
+				)
+				ns = nodeSpan{span: span, start: start}
+			}
+			delete(open, data.ID)
+
+			ns.span.SetAttributes(
+				attribute.String("dify.node.status", data.Status),
+				attribute.Float64("dify.node.elapsed_time", data.ElapsedTime),
+				attribute.Int("dify.usage.total_tokens", data.ExecutionMetadata.TotalTokens),
+				attribute.Float64("dify.usage.total_price", data.ExecutionMetadata.TotalPrice),
+			)
+			if data.Status != "" && data.Status != "succeeded" {
+				ns.span.SetStatus(codes.Error, data.Error)
+			}
+			ns.span.End(trace.WithTimestamp(ns.start.Add(elapsed)))
+		case EventWorkflowFinished:
+			ct.span.SetAttributes(
+				attribute.String("dify.workflow.status", data.Status),
+				attribute.Int("dify.usage.total_tokens", data.TotalTokens),
+				attribute.Int("dify.workflow.total_steps", data.TotalSteps),
+			)
+			if data.Status != "" && data.Status != "succeeded" {
+				ct.span.SetStatus(codes.Error, data.Error)
+			}
+		}
+	}
+}
+
+func nodeSpanName(title, nodeType string) string {
+	if title != "" {
+		return title
+	}
+	return nodeType
+}
+
+// observeDecode calls observe with every event decode produces.
+func observeDecode[T any](decode func(sseEvent) (T, bool, error), observe func(T)) func(sseEvent) (T, bool, error) {
+	if observe == nil {
+		return decode
+	}
+	return func(event sseEvent) (T, bool, error) {
+		v, ok, err := decode(event)
+		if ok && err == nil {
+			observe(v)
+		}
+		return v, ok, err
+	}
+}
+
+// appModeOfEndpoint returns the mode of the apps that endpoint is exclusive
+// to, or "" when apps of several modes serve it.
+func appModeOfEndpoint(endpoint string) AppMode {
+	switch endpoint {
+	case "/v1/completion-messages":
+		return AppModeCompletion
+	case "/v1/workflows/run":
+		return AppModeWorkflow
+	}
+	return ""
+}
+
+// endpointName replaces the ids in an API path with {id}, so it can be used
+// as a span name and metric label.
+func endpointName(path string) string {
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		if looksLikeID(seg) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// looksLikeID reports whether a path segment is a Dify id: a UUID, or a long
+// run of hex digits.
+func looksLikeID(seg string) bool {
+	if len(seg) < 8 {
+		return false
+	}
+	hasDigit := false
+	for _, r := range seg {
+		switch {
+		case r >= '0' && r <= '9':
+			hasDigit = true
+		case r >= 'a' && r <= 'f', r >= 'A' && r <= 'F', r == '-':
+		default:
+			return false
+		}
+	}
+	return hasDigit
+}
@@ -0,0 +1,20 @@
+package dify
+
+import "testing"
+
+func TestEndpointName(t *testing.T) {
+	tests := map[string]string{
+		"/v1/chat-messages": "/v1/chat-messages",
+		"/v1/conversations/6f2c1f0c-0d5c-4bd8-a9d0-4d3b1b0a2f11/name": "/v1/conversations/{id}/name",
+		"/v1/messages/72d3dc0f-a6d5-4b5e-8510-bec0611a6048/feedbacks": "/v1/messages/{id}/feedbacks",
+		"/v1/workflows/run": "/v1/workflows/run",
+		"/v1/workflows/tasks/5ad4cb98-f0c7-4085-b384-88c403be6290/stop": "/v1/workflows/tasks/{id}/stop",
+		"/v1/completion-messages": "/v1/completion-messages",
+		"/v1/parameters":          "/v1/parameters",
+	}
+	for path, want := range tests {
+		if got := endpointName(path); got != want {
+			t.Errorf("endpointName(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
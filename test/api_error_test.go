@@ -0,0 +1,111 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zruijie/dify-sdk-go"
+)
+
+func errorServer(t *testing.T, status int, contentType, body string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestAPIErrorSentinels(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   error
+	}{
+		{"invalid_param", 400, `{"code":"invalid_param","message":"query is required","status":400}`, dify.ErrInvalidParam},
+		{"app_unavailable", 400, `{"code":"app_unavailable","message":"App unavailable","status":400}`, dify.ErrAppUnavailable},
+		{"provider_not_initialize", 400, `{"code":"provider_not_initialize","message":"No valid model provider","status":400}`, dify.ErrProviderNotInitialize},
+		{"provider_quota_exceeded", 400, `{"code":"provider_quota_exceeded","message":"quota","status":400}`, dify.ErrProviderQuotaExceeded},
+		{"model_currently_not_support", 400, `{"code":"model_currently_not_support","message":"not supported","status":400}`, dify.ErrModelCurrentlyNotSupport},
+		{"conversation_not_exists", 404, `{"code":"not_found","message":"Conversation Not Exists.","status":404}`, dify.ErrConversationNotExists},
+		{"unauthorized", 401, `{"code":"unauthorized","message":"Access token is invalid","status":401}`, dify.ErrUnauthorized},
+		{"rate limit", 429, `{"code":"too_many_requests","message":"Too many requests","status":429}`, dify.ErrRateLimited},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := errorServer(t, tt.status, "application/json", tt.body)
+			_, err := newTestClient(t, srv.URL).API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			if errors.Is(err, dify.ErrInvalidParam) != (tt.want == dify.ErrInvalidParam) {
+				t.Errorf("err matches ErrInvalidParam")
+			}
+
+			var apiErr *dify.APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("err = %T, want *dify.APIError", err)
+			}
+			if apiErr.StatusCode != tt.status || apiErr.Method != http.MethodPost || apiErr.Path != "/v1/chat-messages" || string(apiErr.Raw) != tt.body {
+				t.Errorf("APIError = %+v", apiErr)
+			}
+		})
+	}
+}
+
+func TestAPIErrorNonJSONBody(t *testing.T) {
+	page := "<html><body>502 Bad Gateway" + strings.Repeat(" ", 8<<10) + "</body></html>"
+	srv := errorServer(t, http.StatusBadGateway, "text/html", page)
+
+	_, err := newTestClient(t, srv.URL).API().Messages(context.Background(), &dify.MessagesRequest{ConversationID: "c", User: "test"})
+	var apiErr *dify.APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v, want *dify.APIError", err)
+	}
+	if apiErr.StatusCode != http.StatusBadGateway || apiErr.Code != "" || apiErr.Message != "Bad Gateway" {
+		t.Errorf("APIError = %d %q %q", apiErr.StatusCode, apiErr.Code, apiErr.Message)
+	}
+	if len(apiErr.Raw) != 4<<10 || !strings.HasPrefix(string(apiErr.Raw), "<html>") {
+		t.Errorf("Raw has %d bytes, want the first 4KB of the page", len(apiErr.Raw))
+	}
+	if apiErr.Method != http.MethodGet || apiErr.Path != "/v1/messages" {
+		t.Errorf("request = %s %s", apiErr.Method, apiErr.Path)
+	}
+}
+
+func TestAPIErrorWithoutResponseRequest(t *testing.T) {
+	srv := errorServer(t, http.StatusBadRequest, "application/json", `{"code":"invalid_param","message":"bad","status":400}`)
+	api := newTestClient(t, srv.URL, withTransport(requestlessTransport{})).API()
+
+	_, err := api.ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	var apiErr *dify.APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v, want *dify.APIError", err)
+	}
+	if apiErr.Method != http.MethodPost || apiErr.Path != "/v1/chat-messages" {
+		t.Errorf("request = %q %q", apiErr.Method, apiErr.Path)
+	}
+}
+
+func TestRunWorkflowAPIError(t *testing.T) {
+	srv := errorServer(t, http.StatusBadRequest, "application/json", `{"code":"invalid_param","message":"inputs is required","status":400}`)
+	api := newTestClient(t, srv.URL).API()
+
+	_, err := api.RunWorkflow(context.Background(), dify.WorkflowRequest{User: "test"})
+	if !errors.Is(err, dify.ErrInvalidParam) {
+		t.Errorf("RunWorkflow: err = %v, want ErrInvalidParam", err)
+	}
+
+	err = api.RunStreamWorkflow(context.Background(), dify.WorkflowRequest{User: "test"}, func(dify.StreamingResponse) {})
+	if !errors.Is(err, dify.ErrInvalidParam) {
+		t.Errorf("RunStreamWorkflow: err = %v, want ErrInvalidParam", err)
+	}
+}
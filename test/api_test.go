@@ -12,17 +12,8 @@ import (
 	"github.com/zruijie/dify-sdk-go"
 )
 
-var (
-	host         = "这里填写你的host"
-	apiSecretKey = "这里填写你的api secret key"
-)
-
 func TestApi3(t *testing.T) {
-	var c = &dify.ClientConfig{
-		Host:             host,
-		DefaultAPISecret: apiSecretKey,
-	}
-	var client = dify.NewClientWithConfig(c)
+	var client = newTestClient(t, cassetteHost, withCassette(t))
 
 	ctx := context.Background()
 
@@ -74,7 +65,7 @@ func TestMessages(t *testing.T) {
 		User:           "jiuquan AI",
 	}
 
-	var client = dify.NewClient(host, apiSecretKey)
+	var client = newTestClient(t, cassetteHost, withCassette(t))
 
 	var msg *dify.MessagesResponse
 	if msg, err = client.API().Messages(ctx, messageReq); err != nil {
@@ -86,7 +77,7 @@ func TestMessages(t *testing.T) {
 }
 
 func TestMessagesFeedbacks(t *testing.T) {
-	var client = dify.NewClient(host, apiSecretKey)
+	var client = newTestClient(t, cassetteHost, withCassette(t))
 	var err error
 	ctx := context.Background()
 
@@ -107,7 +98,7 @@ func TestMessagesFeedbacks(t *testing.T) {
 }
 
 func TestConversations(t *testing.T) {
-	var client = dify.NewClient(host, apiSecretKey)
+	var client = newTestClient(t, cassetteHost, withCassette(t))
 	var err error
 	ctx := context.Background()
 
@@ -124,7 +115,7 @@ func TestConversations(t *testing.T) {
 }
 
 func TestConversationsRename(t *testing.T) {
-	var client = dify.NewClient(host, apiSecretKey)
+	var client = newTestClient(t, cassetteHost, withCassette(t))
 	var err error
 	ctx := context.Background()
 
@@ -143,7 +134,7 @@ func TestConversationsRename(t *testing.T) {
 }
 
 func TestParameters(t *testing.T) {
-	var client = dify.NewClient(host, apiSecretKey)
+	var client = newTestClient(t, cassetteHost, withCassette(t))
 	var err error
 	ctx := context.Background()
 
@@ -160,8 +151,7 @@ func TestParameters(t *testing.T) {
 }
 
 func TestRunWorkflow(t *testing.T) {
-	client := dify.NewClient(host, apiSecretKey)
-	// client := dify.NewClient("https://dify.zhaokm.org", "app-")
+	client := newTestClient(t, cassetteHost, withCassette(t))
 
 	// 测试带图片的工作流请求
 	workflowReq := dify.WorkflowRequest{
@@ -210,7 +200,7 @@ func TestRunWorkflow(t *testing.T) {
 }
 
 func TestRunWorkflowStreaming(t *testing.T) {
-	client := dify.NewClient(host, apiSecretKey)
+	client := newTestClient(t, cassetteHost, withCassette(t))
 
 	workflowReq := dify.WorkflowRequest{
 		Inputs: map[string]interface{}{
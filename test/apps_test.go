@@ -0,0 +1,182 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/zruijie/dify-sdk-go"
+)
+
+// appsServer answers /v1/info with the mode of the app of each secret and
+// chat messages with the secret they were sent with.
+func appsServer(t *testing.T, modes map[string]dify.AppMode) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		w.Header().Set("Content-Type", "application/json")
+		mode, ok := modes[secret]
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"code":"unauthorized","message":"Access token is invalid","status":401}`)
+			return
+		}
+		if r.URL.Path == "/v1/info" {
+			fmt.Fprintf(w, `{"name":"app","description":"","tags":[],"mode":%q,"author_name":"me"}`, mode)
+			return
+		}
+		fmt.Fprintf(w, `{"answer":%q}`, secret)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestAppRegistry(t *testing.T) {
+	srv := appsServer(t, map[string]dify.AppMode{"app-support": dify.AppModeChat, "app-default": dify.AppModeCompletion})
+	c := dify.NewClientWithConfig(&dify.ClientConfig{
+		Host:             srv.URL,
+		DefaultAPISecret: "app-default",
+		Apps: map[string]dify.AppConfig{
+			"support-bot": {Secret: "app-support", Mode: dify.AppModeChat},
+			"default":     {Mode: dify.AppModeCompletion},
+		},
+	})
+	if err := c.RegisterApp("summarize-workflow", dify.AppConfig{Secret: "app-summarize", Mode: dify.AppModeWorkflow}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RegisterApp("support-bot", dify.AppConfig{Secret: "app-other"}); err == nil {
+		t.Error("registering a name twice succeeded")
+	}
+	if err := c.RegisterApp("no-secret", dify.AppConfig{}); err == nil {
+		t.Error("registering an app without a secret succeeded")
+	}
+
+	_, err := c.App("sales-bot")
+	if !errors.Is(err, dify.ErrUnknownApp) || !strings.Contains(err.Error(), "sales-bot") {
+		t.Errorf("App(unknown) = %v", err)
+	}
+
+	var names []string
+	for _, app := range c.Apps() {
+		names = append(names, app.Name())
+	}
+	if fmt.Sprint(names) != "[default summarize-workflow support-bot]" {
+		t.Errorf("Apps() = %v", names)
+	}
+
+	app, err := c.App("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := app.API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Answer != "app-default" {
+		t.Errorf("app without a secret called with %q", resp.Answer)
+	}
+}
+
+func TestAppHandlesConcurrently(t *testing.T) {
+	secrets := map[string]dify.AppMode{}
+	apps := map[string]dify.AppConfig{}
+	for i := 0; i < 4; i++ {
+		secret := fmt.Sprintf("app-%d", i)
+		secrets[secret] = dify.AppModeChat
+		apps[fmt.Sprintf("bot-%d", i)] = dify.AppConfig{Secret: secret}
+	}
+	srv := appsServer(t, secrets)
+	c := dify.NewClientWithConfig(&dify.ClientConfig{Host: srv.URL, Apps: apps})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		app, err := c.App(fmt.Sprintf("bot-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := fmt.Sprintf("app-%d", i)
+		for j := 0; j < 5; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := app.API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if resp.Answer != want {
+					t.Errorf("%s called with %s", app.Name(), resp.Answer)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+func TestVerifyApps(t *testing.T) {
+	srv := appsServer(t, map[string]dify.AppMode{
+		"app-support":   dify.AppModeAdvancedChat,
+		"app-summarize": dify.AppModeWorkflow,
+		"app-unchecked": dify.AppModeCompletion,
+	})
+	c := dify.NewClientWithConfig(&dify.ClientConfig{
+		Host: srv.URL,
+		Apps: map[string]dify.AppConfig{
+			"summarize-workflow": {Secret: "app-summarize", Mode: dify.AppModeWorkflow},
+			"unchecked":          {Secret: "app-unchecked"},
+		},
+	})
+	if err := c.VerifyApps(context.Background()); err != nil {
+		t.Fatalf("VerifyApps = %v", err)
+	}
+
+	c.RegisterApp("support-bot", dify.AppConfig{Secret: "app-support", Mode: dify.AppModeChat})
+	c.RegisterApp("revoked", dify.AppConfig{Secret: "app-revoked", Mode: dify.AppModeChat})
+	err := c.VerifyApps(context.Background())
+
+	var modeErr *dify.AppModeError
+	if !errors.As(err, &modeErr) {
+		t.Fatalf("VerifyApps = %v, want an *AppModeError", err)
+	}
+	if modeErr.App != "support-bot" || modeErr.Expected != dify.AppModeChat || modeErr.Actual != dify.AppModeAdvancedChat {
+		t.Errorf("AppModeError = %+v", modeErr)
+	}
+	if !errors.Is(err, dify.ErrUnauthorized) || !strings.Contains(err.Error(), `"revoked"`) {
+		t.Errorf("VerifyApps = %v, want the revoked app unauthorized", err)
+	}
+}
+
+func TestInvalidConfiguredApp(t *testing.T) {
+	srv := appsServer(t, map[string]dify.AppMode{"app-support": dify.AppModeChat})
+	cfg := &dify.ClientConfig{
+		Host: srv.URL,
+		Apps: map[string]dify.AppConfig{
+			"support-bot": {Secret: "app-support", Mode: dify.AppModeChat},
+			"sales-bot":   {Mode: dify.AppModeChat},
+		},
+	}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "apps.sales-bot.api_key") {
+		t.Errorf("Validate() = %v, want the app without a secret", err)
+	}
+	c := dify.NewClientWithConfig(cfg)
+
+	_, err := c.App("sales-bot")
+	if err == nil || errors.Is(err, dify.ErrUnknownApp) || !strings.Contains(err.Error(), "no secret") {
+		t.Errorf("App(invalid) = %v, want its registration error", err)
+	}
+	if err := c.VerifyApps(context.Background()); err == nil || !strings.Contains(err.Error(), `"sales-bot" has no secret`) {
+		t.Errorf("VerifyApps() = %v, want the registration error", err)
+	}
+
+	if err := c.RegisterApp("sales-bot", dify.AppConfig{Secret: "app-sales"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.App("sales-bot"); err != nil {
+		t.Errorf("App after RegisterApp = %v", err)
+	}
+}
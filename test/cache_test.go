@@ -0,0 +1,231 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zruijie/dify-sdk-go"
+)
+
+// configServer answers the app configuration endpoints with the key that
+// called them, and counts the calls by path.
+type configServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	calls  map[string]int
+	status atomic.Int32
+	delay  time.Duration
+}
+
+func newConfigServer(t *testing.T) *configServer {
+	s := &configServer{calls: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.calls[r.URL.Path]++
+		s.mu.Unlock()
+		time.Sleep(s.delay)
+		w.Header().Set("Content-Type", "application/json")
+		if status := int(s.status.Load()); status != 0 {
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"code":"error","message":"failed","status":%d}`, status)
+			return
+		}
+		key := r.Header.Get("Authorization")
+		switch r.URL.Path {
+		case "/v1/parameters":
+			fmt.Fprintf(w, `{"opening_statement":%q}`, key)
+		case "/v1/info":
+			fmt.Fprintf(w, `{"name":%q,"mode":"chat"}`, key)
+		case "/v1/meta":
+			fmt.Fprint(w, `{"tool_icons":{"dalle2":"https://example.com/dalle2.png","api_tool":{"background":"#252525","content":"😁"}}}`)
+		case "/v1/site":
+			fmt.Fprintf(w, `{"title":%q,"chat_color_theme":"#ff0000","show_workflow_steps":true}`, key)
+		default:
+			chatAnswer("ok")(w, r)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *configServer) count(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[path]
+}
+
+func parameters(t *testing.T, api *dify.API, user string) string {
+	t.Helper()
+	resp, err := api.Parameters(context.Background(), &dify.ParametersRequest{User: user})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.OpeningStatement
+}
+
+func TestCacheHits(t *testing.T) {
+	srv := newConfigServer(t)
+	c := newTestClient(t, srv.URL, withSecret("app-one"), withCache(&dify.ResponseCache{}))
+	ctx := context.Background()
+
+	for _, user := range []string{"alice", "bob", "alice"} {
+		if got := parameters(t, c.API(), user); got != "Bearer app-one" {
+			t.Errorf("parameters = %q", got)
+		}
+	}
+	for range 2 {
+		if info, err := c.API().Info(ctx); err != nil || info.Name != "Bearer app-one" {
+			t.Fatalf("info = %+v, %v", info, err)
+		}
+		meta, err := c.API().Meta(ctx)
+		if err != nil || meta.ToolIcons["dalle2"] != "https://example.com/dalle2.png" {
+			t.Fatalf("meta = %+v, %v", meta, err)
+		}
+		site, err := c.API().Site(ctx)
+		if err != nil || site.Title != "Bearer app-one" || !site.ShowWorkflowSteps {
+			t.Fatalf("site = %+v, %v", site, err)
+		}
+		if _, err := askChat(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for path, want := range map[string]int{"/v1/parameters": 1, "/v1/info": 1, "/v1/meta": 1, "/v1/site": 1, "/v1/chat-messages": 2} {
+		if got := srv.count(path); got != want {
+			t.Errorf("%s called %d times, want %d", path, got, want)
+		}
+	}
+}
+
+func TestCachePerSecret(t *testing.T) {
+	srv := newConfigServer(t)
+	c := newTestClient(t, srv.URL, withSecret("app-one"), withCache(&dify.ResponseCache{}))
+
+	if got := parameters(t, c.API(), "alice"); got != "Bearer app-one" {
+		t.Errorf("parameters = %q", got)
+	}
+	if got := parameters(t, c.API().WithSecret("app-two"), "alice"); got != "Bearer app-two" {
+		t.Errorf("parameters of another secret = %q", got)
+	}
+	if srv.count("/v1/parameters") != 2 {
+		t.Errorf("calls = %d, want 2", srv.count("/v1/parameters"))
+	}
+}
+
+func TestCacheCollapsesMisses(t *testing.T) {
+	srv := newConfigServer(t)
+	srv.delay = 50 * time.Millisecond
+	c := newTestClient(t, srv.URL, withSecret("app-one"), withCache(&dify.ResponseCache{}))
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.API().Parameters(context.Background(), &dify.ParametersRequest{User: "alice"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if srv.count("/v1/parameters") != 1 {
+		t.Errorf("calls = %d, want 1", srv.count("/v1/parameters"))
+	}
+}
+
+func TestCacheTTLAndErrors(t *testing.T) {
+	srv := newConfigServer(t)
+	c := newTestClient(t, srv.URL, withSecret("app-one"), withCache(&dify.ResponseCache{TTL: 20 * time.Millisecond}))
+
+	srv.status.Store(http.StatusInternalServerError)
+	_, err := c.API().Info(context.Background())
+	var apiErr *dify.APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v", err)
+	}
+	srv.status.Store(0)
+	c.API().Info(context.Background())
+	c.API().Info(context.Background())
+	if srv.count("/v1/info") != 2 {
+		t.Errorf("calls = %d, want 2: errors are not cached", srv.count("/v1/info"))
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	c.API().Info(context.Background())
+	if srv.count("/v1/info") != 3 {
+		t.Errorf("calls = %d, want 3 after the TTL", srv.count("/v1/info"))
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	srv := newConfigServer(t)
+	c := newTestClient(t, srv.URL, withSecret("app-one"), withCache(&dify.ResponseCache{}))
+	two := c.API().WithSecret("app-two")
+
+	parameters(t, c.API(), "alice")
+	parameters(t, two, "alice")
+	if err := c.API().InvalidateCache(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	parameters(t, c.API(), "alice")
+	parameters(t, two, "alice")
+	if srv.count("/v1/parameters") != 3 {
+		t.Errorf("calls = %d, want 3: only app-one was invalidated", srv.count("/v1/parameters"))
+	}
+
+	c.InvalidateCache()
+	parameters(t, c.API(), "alice")
+	parameters(t, two, "alice")
+	if srv.count("/v1/parameters") != 5 {
+		t.Errorf("calls = %d, want 5", srv.count("/v1/parameters"))
+	}
+}
+
+// mapStore is a CacheStore recording the keys it was given.
+type mapStore struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+}
+
+func (s *mapStore) Get(_ context.Context, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.entries[key]
+	return v, ok
+}
+
+func (s *mapStore) Set(_ context.Context, key string, value []byte, _ time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = value
+}
+
+func (s *mapStore) Delete(_ context.Context, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+}
+
+func TestCacheStore(t *testing.T) {
+	srv := newConfigServer(t)
+	store := &mapStore{entries: make(map[string][]byte)}
+	parameters(t, newTestClient(t, srv.URL, withSecret("app-one"), withCache(&dify.ResponseCache{Store: store})).API(), "alice")
+
+	// A second client sharing the store does not call Dify.
+	parameters(t, newTestClient(t, srv.URL, withSecret("app-one"), withCache(&dify.ResponseCache{Store: store})).API(), "bob")
+	if srv.count("/v1/parameters") != 1 {
+		t.Errorf("calls = %d, want 1", srv.count("/v1/parameters"))
+	}
+	for key := range store.entries {
+		if strings.Contains(key, "app-one") {
+			t.Errorf("the secret is part of the key %q", key)
+		}
+	}
+}
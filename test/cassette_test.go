@@ -0,0 +1,29 @@
+package test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/zruijie/dify-sdk-go/cassette"
+)
+
+func TestCassetteMismatch(t *testing.T) {
+	rec, err := cassette.New(cassette.Config{Path: filepath.Join("testdata", "cassettes", "TestParameters.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, cassetteHost, withTransport(rec))
+
+	_, err = askChat(c)
+	var mismatch *cassette.MismatchError
+	if !errors.As(err, &mismatch) || !errors.Is(err, cassette.ErrNoMatch) {
+		t.Fatalf("err = %v", err)
+	}
+	if mismatch.Closest == nil || mismatch.Closest.URL != "/v1/parameters?user=REDACTED" {
+		t.Errorf("closest = %+v", mismatch.Closest)
+	}
+	if len(rec.Unused()) != 1 {
+		t.Errorf("unused = %v", rec.Unused())
+	}
+}
@@ -0,0 +1,126 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zruijie/dify-sdk-go"
+)
+
+// changeRecorder collects circuit state changes.
+type changeRecorder struct {
+	mu      sync.Mutex
+	changes []dify.CircuitStateChange
+}
+
+func (r *changeRecorder) record(change dify.CircuitStateChange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.changes = append(r.changes, change)
+}
+
+func (r *changeRecorder) get() []dify.CircuitStateChange {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]dify.CircuitStateChange(nil), r.changes...)
+}
+
+func TestCircuitBreakerFailsFast(t *testing.T) {
+	var hits atomic.Int32
+	var healthy atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"answer":"hi"}`))
+	}))
+	defer srv.Close()
+
+	var changes changeRecorder
+	c := dify.NewClientWithConfig(&dify.ClientConfig{
+		Host:             srv.URL,
+		DefaultAPISecret: "app-circuittest1234",
+		CircuitBreaker: &dify.CircuitBreaker{
+			ConsecutiveFailures: 3,
+			OpenTimeout:         100 * time.Millisecond,
+			OnStateChange:       changes.record,
+		},
+	})
+	ctx := context.Background()
+	req := &dify.ChatMessageRequest{Query: "hi", User: "test"}
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.API().ChatMessages(ctx, req); errors.Is(err, dify.ErrCircuitOpen) || err == nil {
+			t.Fatalf("call %d: err = %v, want the 503", i, err)
+		}
+	}
+	_, err := c.API().ChatMessages(ctx, req)
+	var openErr *dify.CircuitOpenError
+	if !errors.Is(err, dify.ErrCircuitOpen) || !errors.As(err, &openErr) {
+		t.Fatalf("err = %v, want ErrCircuitOpen", err)
+	}
+	if openErr.Secret != "app-****1234" || openErr.State != dify.CircuitOpen {
+		t.Errorf("CircuitOpenError = %+v", openErr)
+	}
+	if n := hits.Load(); n != 3 {
+		t.Errorf("server got %d calls, want 3", n)
+	}
+
+	// Other secrets have their own circuit.
+	if _, err := c.API().WithSecret("app-other").ChatMessages(ctx, req); errors.Is(err, dify.ErrCircuitOpen) {
+		t.Errorf("circuit of another secret is open")
+	}
+
+	healthy.Store(true)
+	time.Sleep(150 * time.Millisecond)
+	if _, err := c.API().ChatMessages(ctx, req); err != nil {
+		t.Fatalf("probe failed: %v", err)
+	}
+	if _, err := c.API().ChatMessages(ctx, req); err != nil {
+		t.Fatalf("call after the circuit closed failed: %v", err)
+	}
+
+	var got []string
+	for _, change := range changes.get() {
+		if change.Secret == "app-****1234" {
+			got = append(got, change.From.String()+">"+change.To.String())
+		}
+	}
+	want := "[closed>open open>half-open half-open>closed]"
+	if s := fmt.Sprint(got); s != want {
+		t.Errorf("changes = %s, want %s", s, want)
+	}
+}
+
+func TestCircuitBreakerStopsRetries(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	c := dify.NewClientWithConfig(&dify.ClientConfig{
+		Host:             srv.URL,
+		DefaultAPISecret: "app-circuittest1234",
+		Retry:            &dify.RetryPolicy{MaxAttempts: 5, MinBackoff: time.Millisecond},
+		CircuitBreaker:   &dify.CircuitBreaker{ConsecutiveFailures: 2},
+	})
+	_, err := c.API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	if !errors.Is(err, dify.ErrCircuitOpen) {
+		t.Fatalf("err = %v, want ErrCircuitOpen", err)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("server got %d attempts, want 2", n)
+	}
+}
@@ -0,0 +1,204 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zruijie/dify-sdk-go"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigYAML(t *testing.T) {
+	var paths, auths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		auths = append(auths, r.Header.Get("Authorization"))
+		chatAnswer("ok")(w, r)
+	}))
+	defer srv.Close()
+
+	path := writeConfig(t, "dify.yaml", `
+host: `+srv.URL+`/v1/
+api_key: app-default
+timeout: 30s
+stream:
+  idle_timeout: 1m
+retry:
+  max_attempts: 2
+  min_backoff: 10ms
+apps:
+  support-bot: {api_key: app-support, mode: chat}
+datasets:
+  manuals: dataset-manuals
+`)
+	c, err := dify.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Host != srv.URL || c.Timeout != 30*time.Second || c.StreamIdleTimeout != time.Minute {
+		t.Fatalf("config = %+v", c)
+	}
+	if c.Retry == nil || c.Retry.MaxAttempts != 2 || c.Retry.MinBackoff != 10*time.Millisecond {
+		t.Fatalf("retry = %+v", c.Retry)
+	}
+
+	client := dify.NewClientWithConfig(c)
+	if _, err := askChat(client); err != nil {
+		t.Fatal(err)
+	}
+	app, err := client.App("support-bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.Mode() != dify.AppModeChat {
+		t.Errorf("mode = %q", app.Mode())
+	}
+	if _, err := app.API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(paths, " ") != "/v1/chat-messages /v1/chat-messages" {
+		t.Errorf("paths = %v", paths)
+	}
+	if strings.Join(auths, " ") != "Bearer app-default Bearer app-support" {
+		t.Errorf("authorization = %v", auths)
+	}
+
+	if key, err := client.DatasetKey("manuals"); err != nil || key != "dataset-manuals" {
+		t.Errorf("DatasetKey = %q, %v", key, err)
+	}
+	if _, err := client.DatasetKey("faq"); !errors.Is(err, dify.ErrUnknownDataset) {
+		t.Errorf("DatasetKey error = %v", err)
+	}
+}
+
+func TestLoadConfigEnvOverridesJSON(t *testing.T) {
+	path := writeConfig(t, "dify.json", `{
+		"host": "https://file.example.com",
+		"api_key": "app-file",
+		"timeout": "10s",
+		"apps": {"support-bot": {"api_key": "app-file-support", "mode": "chat"}}
+	}`)
+	t.Setenv("DIFY_HOST", "https://env.example.com/v1")
+	t.Setenv("DIFY_HOSTS", "https://west.example.com, https://east.example.com/")
+	t.Setenv("DIFY_TIMEOUT", "20s")
+	t.Setenv("DIFY_RETRY_MAX_ATTEMPTS", "4")
+	t.Setenv("DIFY_APP_SUPPORT_BOT_API_KEY", "app-env-support")
+	t.Setenv("DIFY_APP_REPORTS_API_KEY", "app-reports")
+	t.Setenv("DIFY_APP_REPORTS_MODE", "workflow")
+	t.Setenv("DIFY_DATASET_MANUALS_API_KEY", "dataset-manuals")
+
+	c, err := dify.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Host != "https://env.example.com" || c.DefaultAPISecret != "app-file" || c.Timeout != 20*time.Second {
+		t.Errorf("config = %+v", c)
+	}
+	if strings.Join(c.Hosts, " ") != "https://west.example.com https://east.example.com" {
+		t.Errorf("hosts = %v", c.Hosts)
+	}
+	if c.Retry == nil || c.Retry.MaxAttempts != 4 {
+		t.Errorf("retry = %+v", c.Retry)
+	}
+	want := map[string]dify.AppConfig{
+		"support-bot": {Secret: "app-env-support", Mode: dify.AppModeChat},
+		"reports":     {Secret: "app-reports", Mode: dify.AppModeWorkflow},
+	}
+	if len(c.Apps) != len(want) {
+		t.Errorf("apps = %+v", c.Apps)
+	}
+	for name, app := range want {
+		if c.Apps[name] != app {
+			t.Errorf("apps[%q] = %+v, want %+v", name, c.Apps[name], app)
+		}
+	}
+	if c.Datasets["manuals"] != "dataset-manuals" {
+		t.Errorf("datasets = %v", c.Datasets)
+	}
+}
+
+func TestLoadConfigFromEnv(t *testing.T) {
+	t.Setenv("DIFY_HOST", "unix:///var/run/dify.sock")
+	t.Setenv("DIFY_API_KEY", "app-env")
+
+	c, err := dify.LoadConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Host != "unix:///var/run/dify.sock" || c.DefaultAPISecret != "app-env" {
+		t.Errorf("config = %+v", c)
+	}
+}
+
+func TestLoadConfigReportsEveryProblem(t *testing.T) {
+	path := writeConfig(t, "dify.yaml", `
+host: ftp://dify.example.com
+timeout: soon
+retry: {max_attempts: 0}
+apps:
+  support-bot: {mode: chatbot}
+tls: {cert_file: client.pem}
+`)
+	_, err := dify.LoadConfig(path)
+	if err == nil {
+		t.Fatal("no error")
+	}
+	for _, want := range []string{
+		`timeout: invalid duration "soon"`,
+		"retry.max_attempts: must be a number of at least 1",
+		`host "ftp://dify.example.com": scheme must be http, https or unix`,
+		"apps.support-bot.api_key: not set",
+		`apps.support-bot.mode: unknown mode "chatbot"`,
+		"tls: a client certificate needs both a certificate and a key",
+		"tls.cert_file:",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %q:\n%v", want, err)
+		}
+	}
+}
+
+func TestLoadConfigUnknownField(t *testing.T) {
+	path := writeConfig(t, "dify.yaml", "host: https://dify.example.com\napi_kye: app-test\n")
+	if _, err := dify.LoadConfig(path); err == nil || !strings.Contains(err.Error(), "api_kye") {
+		t.Errorf("error = %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	ok := &dify.ClientConfig{Host: "https://dify.example.com", DefaultAPISecret: "app-test"}
+	if err := ok.Validate(); err != nil {
+		t.Errorf("Validate = %v", err)
+	}
+
+	bad := &dify.ClientConfig{
+		Host:              "https://dify.example.com?x=1",
+		Datasets:          map[string]string{"manuals": ""},
+		StreamIdleTimeout: -time.Second,
+		Retry:             &dify.RetryPolicy{MinBackoff: time.Second, MaxBackoff: time.Millisecond},
+		ProxyURL:          "proxy",
+	}
+	err := bad.Validate()
+	if err == nil {
+		t.Fatal("no error")
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != 6 {
+		t.Errorf("got %d problems, want 6:\n%v", len(lines), err)
+	}
+}
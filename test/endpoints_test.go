@@ -0,0 +1,229 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zruijie/dify-sdk-go"
+)
+
+// regionServer is a Dify endpoint that answers chat messages with its name,
+// streams events carrying a task of its own, and records stop calls.
+type regionServer struct {
+	*httptest.Server
+	name    string
+	calls   atomic.Int32
+	stops   atomic.Int32
+	failing atomic.Bool
+	healthy atomic.Bool
+	// resetting resets the connection of calls once they are received.
+	resetting atomic.Bool
+}
+
+func newRegionServer(t *testing.T, name string) *regionServer {
+	t.Helper()
+	s := &regionServer{name: name}
+	s.healthy.Store(true)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			if !s.healthy.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		case "/v1/chat-messages/task-" + name + "/stop":
+			s.stops.Add(1)
+			fmt.Fprint(w, `{"result":"success"}`)
+			return
+		}
+		s.calls.Add(1)
+		if s.resetting.Load() {
+			io.ReadAll(r.Body)
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+			return
+		}
+		if s.failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var req struct {
+			ResponseMode string `json:"response_mode"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.ResponseMode == "streaming" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprintf(w, "data: {\"event\":\"message\",\"task_id\":\"task-%s\",\"answer\":\"%s\"}\n\n", name, name)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"answer":%q}`, name)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func balancedAnswer(t *testing.T, c *dify.Client) string {
+	t.Helper()
+	resp, err := c.API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Answer
+}
+
+func TestLoadBalancingRoundRobin(t *testing.T) {
+	east, west := newRegionServer(t, "east"), newRegionServer(t, "west")
+	c := newTestClient(t, "", withEndpoints(dify.LoadBalancing{}, east, west))
+
+	var answers []string
+	for i := 0; i < 4; i++ {
+		answers = append(answers, balancedAnswer(t, c))
+	}
+	if fmt.Sprint(answers) != "[east west east west]" {
+		t.Errorf("answers = %v", answers)
+	}
+}
+
+func TestLoadBalancingFailover(t *testing.T) {
+	east, west := newRegionServer(t, "east"), newRegionServer(t, "west")
+	east.Close()
+
+	var mu sync.Mutex
+	var changes []dify.EndpointHealthChange
+	c := newTestClient(t, "", withEndpoints(dify.LoadBalancing{
+		EjectAfter: 2,
+		OnHealthChange: func(change dify.EndpointHealthChange) {
+			mu.Lock()
+			defer mu.Unlock()
+			changes = append(changes, change)
+		},
+	}, east, west))
+
+	for i := 0; i < 6; i++ {
+		if answer := balancedAnswer(t, c); answer != "west" {
+			t.Fatalf("call %d answered by %s", i, answer)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(changes) != 1 || changes[0].Host != east.URL || changes[0].Healthy || changes[0].Err == nil {
+		t.Errorf("changes = %+v, want east ejected once", changes)
+	}
+}
+
+func TestLoadBalancingNoFailoverAfterSend(t *testing.T) {
+	east, west := newRegionServer(t, "east"), newRegionServer(t, "west")
+	east.resetting.Store(true)
+	c := newTestClient(t, "", withEndpoints(dify.LoadBalancing{}, east, west))
+
+	_, err := c.API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	if err == nil || east.calls.Load() != 1 || west.calls.Load() != 0 {
+		t.Errorf("err = %v after %d east and %d west calls, want an error from east only", err, east.calls.Load(), west.calls.Load())
+	}
+}
+
+func TestLoadBalancingEjectsOnServerErrors(t *testing.T) {
+	east, west := newRegionServer(t, "east"), newRegionServer(t, "west")
+	east.failing.Store(true)
+	c := newTestClient(t, "", withEndpoints(dify.LoadBalancing{EjectAfter: 1, EjectFor: time.Minute}, east, west))
+
+	// The first call reaches the failing endpoint, which is then ejected.
+	c.API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	for i := 0; i < 4; i++ {
+		if answer := balancedAnswer(t, c); answer != "west" {
+			t.Fatalf("call %d answered by %s", i, answer)
+		}
+	}
+	if n := east.calls.Load(); n != 1 {
+		t.Errorf("ejected endpoint got %d calls", n)
+	}
+}
+
+func TestLoadBalancingStopsTaskWhereItRuns(t *testing.T) {
+	for name, transport := range map[string]http.RoundTripper{
+		"default": http.DefaultTransport,
+		// The task must be pinned even when resp.Request is unset.
+		"without response request": requestlessTransport{},
+	} {
+		t.Run(name, func(t *testing.T) {
+			east, west := newRegionServer(t, "east"), newRegionServer(t, "west")
+			c := newTestClient(t, "", withEndpoints(dify.LoadBalancing{}, east, west), withTransport(transport))
+
+			for i := 0; i < 4; i++ {
+				stream, err := c.API().StreamChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !stream.Next() {
+					t.Fatalf("no event: %v", stream.Err())
+				}
+				ev := stream.Current()
+				resp, err := c.API().StopChatMessages(context.Background(), &dify.StopRequest{TaskID: ev.TaskID, User: "test"})
+				if err != nil {
+					t.Fatalf("stopping %s: %v", ev.TaskID, err)
+				}
+				if resp.Result != "success" {
+					t.Errorf("Result = %q", resp.Result)
+				}
+				stream.Close()
+			}
+			if east.stops.Load() != 2 || west.stops.Load() != 2 {
+				t.Errorf("stops: east %d, west %d, want 2 each", east.stops.Load(), west.stops.Load())
+			}
+		})
+	}
+}
+
+func TestLoadBalancingProbes(t *testing.T) {
+	east, west := newRegionServer(t, "east"), newRegionServer(t, "west")
+	east.healthy.Store(false)
+
+	healthChanges := make(chan dify.EndpointHealthChange, 10)
+	c := newTestClient(t, "", withEndpoints(dify.LoadBalancing{
+		ProbeInterval:  10 * time.Millisecond,
+		EjectFor:       time.Minute,
+		OnHealthChange: func(change dify.EndpointHealthChange) { healthChanges <- change },
+	}, east, west))
+
+	waitChange := func(healthy bool) {
+		t.Helper()
+		select {
+		case change := <-healthChanges:
+			if change.Host != east.URL || change.Healthy != healthy {
+				t.Fatalf("change = %+v", change)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no health change to %v", healthy)
+		}
+	}
+
+	waitChange(false)
+	for i := 0; i < 4; i++ {
+		if answer := balancedAnswer(t, c); answer != "west" {
+			t.Fatalf("call %d answered by %s", i, answer)
+		}
+	}
+
+	east.healthy.Store(true)
+	waitChange(true)
+	answers := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		answers[balancedAnswer(t, c)] = true
+	}
+	if !answers["east"] {
+		t.Error("restored endpoint got no calls")
+	}
+}
@@ -0,0 +1,184 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zruijie/dify-sdk-go"
+	"github.com/zruijie/dify-sdk-go/cassette"
+	"github.com/zruijie/dify-sdk-go/difytest"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// testSecret is the API secret of the test clients, the one accepted by the
+// difytest servers.
+const testSecret = difytest.DefaultAPIKey
+
+// clientOption changes the configuration of a test client.
+type clientOption func(*dify.ClientConfig)
+
+// newTestServer starts a fake Dify server accepting testSecret, closed with
+// the test.
+func newTestServer(t *testing.T) *difytest.Server {
+	t.Helper()
+	return newTestServerWithConfig(t, difytest.Config{})
+}
+
+// newTestServerWithConfig starts a fake Dify server configured by cfg, closed
+// with the test.
+func newTestServerWithConfig(t *testing.T, cfg difytest.Config) *difytest.Server {
+	t.Helper()
+	srv := difytest.NewServerWithConfig(cfg)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// streamServer starts a fake Dify server answering the chat and workflow
+// calls with events.
+func streamServer(t *testing.T, events ...difytest.Event) *difytest.Server {
+	t.Helper()
+	srv := newTestServer(t)
+	script := func(difytest.Request) difytest.Response { return difytest.Response{Events: events} }
+	srv.Handle(difytest.EndpointChat, script)
+	srv.Handle(difytest.EndpointWorkflow, script)
+	return srv
+}
+
+// newTestClient returns a client of host using testSecret, configured by
+// opts and closed with the test.
+func newTestClient(t *testing.T, host string, opts ...clientOption) *dify.Client {
+	t.Helper()
+	cfg := &dify.ClientConfig{Host: host, DefaultAPISecret: testSecret}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	c := dify.NewClientWithConfig(cfg)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// withoutKeepAlives disables keep-alive connections, which would leave
+// transport goroutines behind and hide leaks from the goroutine count.
+func withoutKeepAlives(cfg *dify.ClientConfig) {
+	cfg.Transport = &http.Transport{DisableKeepAlives: true}
+}
+
+func withSecret(secret string) clientOption {
+	return func(cfg *dify.ClientConfig) { cfg.DefaultAPISecret = secret }
+}
+
+func withTransport(transport http.RoundTripper) clientOption {
+	return func(cfg *dify.ClientConfig) { cfg.Transport = transport }
+}
+
+func withRetry(policy *dify.RetryPolicy) clientOption {
+	return func(cfg *dify.ClientConfig) { cfg.Retry = policy }
+}
+
+func withMetrics(metrics dify.MetricsSink) clientOption {
+	return func(cfg *dify.ClientConfig) { cfg.Metrics = metrics }
+}
+
+func withCache(cache *dify.ResponseCache) clientOption {
+	return func(cfg *dify.ClientConfig) { cfg.Cache = cache }
+}
+
+// withLogs logs every call of the client as JSON into logs, down to the
+// debug level.
+func withLogs(logs *logBuffer) clientOption {
+	return func(cfg *dify.ClientConfig) {
+		cfg.Logger = slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+}
+
+// withTracing exports the spans of the client to exporter.
+func withTracing(t *testing.T, exporter *tracetest.InMemoryExporter) clientOption {
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+	return func(cfg *dify.ClientConfig) { cfg.TracerProvider = tp }
+}
+
+// withEndpoints balances the calls of the client across servers.
+func withEndpoints(balancing dify.LoadBalancing, servers ...*regionServer) clientOption {
+	return func(cfg *dify.ClientConfig) {
+		cfg.Host = ""
+		cfg.Hosts = nil
+		for _, s := range servers {
+			cfg.Hosts = append(cfg.Hosts, s.URL)
+		}
+		cfg.LoadBalancing = balancing
+	}
+}
+
+// cassetteHost is the host of replayed calls, which never leave the process.
+const cassetteHost = "https://dify.test"
+
+// withCassette replays the calls recorded in testdata/cassettes/<test
+// name>.json against cassetteHost. With DIFY_TEST_RECORD=1, the calls go to
+// the Dify server of DIFY_TEST_HOST with the key of DIFY_TEST_API_KEY and the
+// cassette is recorded again.
+func withCassette(t *testing.T) clientOption {
+	t.Helper()
+	cfg := cassette.Config{Path: filepath.Join("testdata", "cassettes", t.Name()+".json")}
+	host, key := cassetteHost, "app-replay"
+	if os.Getenv("DIFY_TEST_RECORD") == "1" {
+		cfg.Mode = cassette.ModeRecord
+		host, key = os.Getenv("DIFY_TEST_HOST"), os.Getenv("DIFY_TEST_API_KEY")
+		if host == "" || key == "" {
+			t.Fatal("recording needs DIFY_TEST_HOST and DIFY_TEST_API_KEY")
+		}
+	}
+	rec, err := cassette.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := rec.Close(); err != nil {
+			t.Error(err)
+		}
+		for _, req := range rec.Unused() {
+			t.Errorf("recorded request not replayed: %s %s", req.Method, req.URL)
+		}
+	})
+	return func(c *dify.ClientConfig) {
+		c.Host = host
+		c.DefaultAPISecret = key
+		c.Transport = rec
+	}
+}
+
+// requestlessTransport sends requests with http.DefaultTransport and leaves
+// Response.Request unset, as some RoundTrippers do.
+type requestlessTransport struct{}
+
+func (requestlessTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if resp != nil {
+		resp.Request = nil
+	}
+	return resp, err
+}
+
+// chatAnswer answers a blocking chat message with answer, for the servers
+// that are not difytest servers.
+func chatAnswer(answer string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"answer":%q}`, answer)
+	}
+}
+
+// askChat sends a blocking chat message with c and returns the answer.
+func askChat(c *dify.Client) (string, error) {
+	resp, err := c.API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	if err != nil {
+		return "", err
+	}
+	return resp.Answer, nil
+}
@@ -0,0 +1,185 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zruijie/dify-sdk-go"
+	"github.com/zruijie/dify-sdk-go/difytest"
+)
+
+const loggingTestSecret = "app-supersecrettoken1234"
+
+// logBuffer collects JSON log records.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *logBuffer) records(t *testing.T) []map[string]any {
+	t.Helper()
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		var r map[string]any
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func (b *logBuffer) find(t *testing.T, msg string) map[string]any {
+	t.Helper()
+	for _, r := range b.records(t) {
+		if r["msg"] == msg {
+			return r
+		}
+	}
+	t.Fatalf("no %q record in\n%s", msg, b.String())
+	return nil
+}
+
+// loggingServer starts a fake Dify server accepting loggingTestSecret.
+func loggingServer(t *testing.T) *difytest.Server {
+	t.Helper()
+	return newTestServerWithConfig(t, difytest.Config{APIKey: loggingTestSecret})
+}
+
+func TestLoggingBlockingCall(t *testing.T) {
+	srv := loggingServer(t)
+	srv.Enqueue(difytest.EndpointChat, difytest.Response{Answer: "the password is hunter2"})
+
+	var logs logBuffer
+	c := newTestClient(t, srv.URL, withSecret(loggingTestSecret), withLogs(&logs), func(c *dify.ClientConfig) {
+		c.LogBodies = true
+		c.LogRedactFields = []string{"query", "Answer", "password"}
+	})
+	resp, err := c.API().ChatMessages(context.Background(), &dify.ChatMessageRequest{
+		Query:  "my secret question",
+		Inputs: map[string]interface{}{"password": "hunter2", "topic": "cats"},
+		User:   "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Answer != "the password is hunter2" {
+		t.Errorf("answer = %q, the logged body was not restored", resp.Answer)
+	}
+
+	out := logs.String()
+	for _, leak := range []string{"supersecrettoken", "my secret question", "hunter2"} {
+		if strings.Contains(out, leak) {
+			t.Errorf("log contains %q:\n%s", leak, out)
+		}
+	}
+
+	start := logs.find(t, "dify request")
+	if start["level"] != "DEBUG" || start["app"] != "app-****1234" || start["path"] != "/v1/chat-messages" || !strings.Contains(start["body"].(string), `"topic":"cats"`) {
+		t.Errorf("start record = %v", start)
+	}
+	finish := logs.find(t, "dify request finished")
+	if finish["level"] != "INFO" || finish["status"] != float64(200) || finish["latency"] == nil || !strings.Contains(finish["body"].(string), `"answer":"[REDACTED]"`) {
+		t.Errorf("finish record = %v", finish)
+	}
+}
+
+func TestLoggingErrorsAndRetries(t *testing.T) {
+	srv := loggingServer(t)
+	srv.Enqueue(difytest.EndpointChat,
+		difytest.Error(http.StatusServiceUnavailable, "", ""),
+		difytest.Error(http.StatusBadRequest, "invalid_param", "query is required"),
+	)
+
+	var logs logBuffer
+	c := newTestClient(t, srv.URL, withSecret(loggingTestSecret), withLogs(&logs), withRetry(&dify.RetryPolicy{MinBackoff: time.Millisecond}))
+	_, err := c.API().ChatMessages(context.Background(), &dify.ChatMessageRequest{User: "test"})
+	if !errors.Is(err, dify.ErrInvalidParam) {
+		t.Fatalf("err = %v, want ErrInvalidParam", err)
+	}
+
+	retry := logs.find(t, "dify request retry")
+	if retry["level"] != "WARN" || retry["attempt"] != float64(1) {
+		t.Errorf("retry record = %v", retry)
+	}
+	failed := logs.find(t, "dify request error")
+	if failed["level"] != "WARN" || failed["status"] != float64(400) || failed["code"] != "invalid_param" {
+		t.Errorf("error record = %v", failed)
+	}
+}
+
+func TestLoggingStreamLifecycle(t *testing.T) {
+	for name, transport := range map[string]http.RoundTripper{
+		"default": http.DefaultTransport,
+		// The stream events must be logged even when resp.Request is unset.
+		"without response request": requestlessTransport{},
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv := loggingServer(t)
+			srv.Enqueue(difytest.EndpointChat, difytest.Response{Events: []difytest.Event{
+				difytest.MessageEvent("a"),
+				difytest.MessageEvent("b"),
+				difytest.ErrorEvent(http.StatusBadRequest, "invalid_param", "bad"),
+			}})
+
+			var logs logBuffer
+			c := newTestClient(t, srv.URL, withSecret(loggingTestSecret), withLogs(&logs), withTransport(transport))
+			stream, err := c.API().StreamChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for stream.Next() {
+			}
+
+			opened := logs.find(t, "dify stream opened")
+			if opened["level"] != "DEBUG" || opened["streaming"] != true {
+				t.Errorf("opened record = %v", opened)
+			}
+			closed := logs.find(t, "dify stream closed")
+			if closed["level"] != "WARN" || closed["events"] != float64(3) || closed["last_event"] != "error" || !strings.Contains(closed["error_event"].(string), "invalid_param") {
+				t.Errorf("closed record = %v", closed)
+			}
+		})
+	}
+}
+
+func TestLoggingBodyLimit(t *testing.T) {
+	srv := loggingServer(t)
+	srv.Enqueue(difytest.EndpointChat, difytest.Response{Answer: strings.Repeat("x", 100)})
+
+	var logs logBuffer
+	c := newTestClient(t, srv.URL, withSecret(loggingTestSecret), withLogs(&logs), func(c *dify.ClientConfig) {
+		c.LogBodies = true
+		c.LogBodyLimit = 16
+	})
+	resp, err := c.API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 100 {
+		t.Errorf("answer has %d bytes, want 100", len(resp.Answer))
+	}
+	finish := logs.find(t, "dify request finished")
+	if body := finish["body"].(string); body != `{"answer":"xxxxx...[TRUNCATED]` {
+		t.Errorf("body = %q", body)
+	}
+}
@@ -0,0 +1,247 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zruijie/dify-sdk-go"
+	"github.com/zruijie/dify-sdk-go/difytest"
+)
+
+// metricsTestSecret ends with the characters left by the redaction of the app
+// label.
+const metricsTestSecret = "app-metricstest1234"
+
+// metricsServer starts a fake Dify server accepting metricsTestSecret.
+func metricsServer(t *testing.T) *difytest.Server {
+	t.Helper()
+	return newTestServerWithConfig(t, difytest.Config{APIKey: metricsTestSecret})
+}
+
+// scrape fetches the Prometheus exposition of metrics over HTTP.
+func scrape(t *testing.T, metrics *dify.MemoryMetrics) string {
+	t.Helper()
+	srv := httptest.NewServer(metrics)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func assertMetrics(t *testing.T, out string, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		if !strings.Contains(out, w+"\n") {
+			t.Errorf("missing %q in\n%s", w, out)
+		}
+	}
+}
+
+func TestMetricsBlockingCall(t *testing.T) {
+	// difytest counts a token per word.
+	srv := metricsServer(t)
+	srv.Enqueue(difytest.EndpointChat, difytest.Response{Answer: "hi there"})
+
+	metrics := dify.NewMemoryMetrics()
+	c := newTestClient(t, srv.URL, withSecret(metricsTestSecret), withMetrics(metrics))
+	resp, err := c.API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "one two three four five", User: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Answer != "hi there" {
+		t.Errorf("Answer = %q, the body must be left intact", resp.Answer)
+	}
+
+	labels := `endpoint="/v1/chat-messages",app="app-****1234"`
+	assertMetrics(t, scrape(t, metrics),
+		`dify_requests_total{`+labels+`,status="200"} 1`,
+		`dify_request_duration_seconds_count{`+labels+`} 1`,
+		`dify_tokens_total{`+labels+`,kind="prompt"} 5`,
+		`dify_tokens_total{`+labels+`,kind="completion"} 2`,
+		`dify_tokens_total{`+labels+`,kind="total"} 7`,
+		`dify_price_total{`+labels+`,currency="USD"} 0`,
+	)
+}
+
+func TestMetricsAppLabel(t *testing.T) {
+	srv := metricsServer(t)
+	metrics := dify.NewMemoryMetrics()
+	c := newTestClient(t, srv.URL, withSecret(metricsTestSecret), withMetrics(metrics))
+	// The apps share a secret, and only their names tell their calls apart.
+	for _, name := range []string{"support", "sales"} {
+		if err := c.RegisterApp(name, dify.AppConfig{Secret: metricsTestSecret}); err != nil {
+			t.Fatal(err)
+		}
+		app, err := c.App(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := app.API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertMetrics(t, scrape(t, metrics),
+		`dify_requests_total{endpoint="/v1/chat-messages",app="support",status="200"} 1`,
+		`dify_requests_total{endpoint="/v1/chat-messages",app="sales",status="200"} 1`,
+		`dify_requests_total{endpoint="/v1/chat-messages",app="app-****1234",status="200"} 1`,
+	)
+}
+
+func TestMetricsErrorCodes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/parameters" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"code":"invalid_param","message":"bad","status":400}`)
+	}))
+	defer srv.Close()
+
+	metrics := dify.NewMemoryMetrics()
+	api := newTestClient(t, srv.URL, withSecret(metricsTestSecret), withMetrics(metrics)).API()
+	_, err := api.ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	if !errors.Is(err, dify.ErrInvalidParam) {
+		t.Errorf("err = %v, want ErrInvalidParam", err)
+	}
+	if _, err := api.Parameters(context.Background(), &dify.ParametersRequest{User: "test"}); err == nil {
+		t.Error("Parameters succeeded on a 502")
+	}
+
+	out := scrape(t, metrics)
+	assertMetrics(t, out,
+		`dify_requests_total{endpoint="/v1/chat-messages",app="app-****1234",status="400"} 1`,
+		`dify_errors_total{endpoint="/v1/chat-messages",app="app-****1234",code="invalid_param"} 1`,
+		`dify_errors_total{endpoint="/v1/parameters",app="app-****1234",code="http_502"} 1`,
+	)
+}
+
+func TestMetricsTransportError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	metrics := dify.NewMemoryMetrics()
+	_, err := newTestClient(t, srv.URL, withSecret(metricsTestSecret), withMetrics(metrics)).API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	if err == nil {
+		t.Fatal("call to a closed server succeeded")
+	}
+	assertMetrics(t, scrape(t, metrics),
+		`dify_errors_total{endpoint="/v1/chat-messages",app="app-****1234",code="transport"} 1`,
+	)
+}
+
+func TestMetricsChatStream(t *testing.T) {
+	for name, transport := range map[string]http.RoundTripper{
+		"default": http.DefaultTransport,
+		// The stream metrics must not depend on resp.Request.
+		"without response request": requestlessTransport{},
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv := metricsServer(t)
+			srv.Enqueue(difytest.EndpointChat, difytest.Response{Events: []difytest.Event{
+				difytest.MessageEvent(""),
+				difytest.MessageEvent("hel"),
+				difytest.MessageEvent("lo"),
+				{Name: "message_end", Data: map[string]any{"metadata": map[string]any{"usage": map[string]any{
+					"prompt_tokens": 4, "completion_tokens": 2, "total_tokens": 6, "total_price": "0.002", "currency": "USD",
+				}}}},
+			}})
+
+			metrics := dify.NewMemoryMetrics()
+			c := newTestClient(t, srv.URL, withSecret(metricsTestSecret), withMetrics(metrics), withTransport(transport))
+			stream, err := c.API().StreamChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for stream.Next() {
+			}
+			if err := stream.Err(); err != nil {
+				t.Fatal(err)
+			}
+			stream.Close()
+
+			labels := `endpoint="/v1/chat-messages",app="app-****1234"`
+			out := scrape(t, metrics)
+			assertMetrics(t, out,
+				`dify_requests_total{`+labels+`,status="200"} 1`,
+				`dify_time_to_first_token_seconds_count{`+labels+`} 1`,
+				`dify_stream_duration_seconds_count{`+labels+`} 1`,
+				`dify_tokens_total{`+labels+`,kind="total"} 6`,
+				`dify_price_total{`+labels+`,currency="USD"} 0.002`,
+			)
+			if strings.Contains(out, "dify_errors_total{") {
+				t.Errorf("unexpected errors in\n%s", out)
+			}
+		})
+	}
+}
+
+func TestMetricsStreamErrorEvent(t *testing.T) {
+	srv := metricsServer(t)
+	srv.Enqueue(difytest.EndpointChat, difytest.Response{Events: []difytest.Event{
+		difytest.MessageEvent("hi"),
+		difytest.ErrorEvent(429, "provider_quota_exceeded", "quota"),
+	}})
+
+	metrics := dify.NewMemoryMetrics()
+	stream, err := newTestClient(t, srv.URL, withSecret(metricsTestSecret), withMetrics(metrics)).API().StreamChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for stream.Next() {
+	}
+	stream.Close()
+
+	assertMetrics(t, scrape(t, metrics),
+		`dify_errors_total{endpoint="/v1/chat-messages",app="app-****1234",code="provider_quota_exceeded"} 1`,
+	)
+}
+
+func TestMetricsWorkflowStream(t *testing.T) {
+	srv := metricsServer(t)
+	srv.Enqueue(difytest.EndpointWorkflow, difytest.Response{Events: []difytest.Event{
+		difytest.WorkflowEvent("workflow_started", map[string]any{"id": "r"}),
+		difytest.WorkflowEvent("text_chunk", map[string]any{"text": "hi"}),
+		difytest.WorkflowEvent("workflow_finished", map[string]any{"id": "r", "status": "succeeded", "total_tokens": 42}),
+	}})
+
+	metrics := dify.NewMemoryMetrics()
+	stream, err := newTestClient(t, srv.URL, withSecret(metricsTestSecret), withMetrics(metrics)).API().StreamWorkflow(context.Background(), dify.WorkflowRequest{User: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for stream.Next() {
+	}
+	if err := stream.Err(); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+
+	labels := `endpoint="/v1/workflows/run",app="app-****1234"`
+	assertMetrics(t, scrape(t, metrics),
+		`dify_time_to_first_token_seconds_count{`+labels+`} 1`,
+		`dify_stream_duration_seconds_count{`+labels+`} 1`,
+		`dify_tokens_total{`+labels+`,kind="total"} 42`,
+	)
+}
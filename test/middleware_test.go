@@ -0,0 +1,111 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zruijie/dify-sdk-go"
+	"github.com/zruijie/dify-sdk-go/difytest"
+)
+
+func TestMiddlewareChain(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"answer":%q}`, r.Header.Get("X-Tenant")+","+r.Header.Get("X-Audit"))
+	}))
+	defer srv.Close()
+
+	var log []string
+	trace := func(name string) dify.Middleware {
+		return func(next dify.RequestHandler) dify.RequestHandler {
+			return func(req *http.Request) (*http.Response, error) {
+				log = append(log, name+" "+req.URL.Path)
+				resp, err := next(req)
+				if err == nil {
+					log = append(log, fmt.Sprintf("%s %d", name, resp.StatusCode))
+				}
+				return resp, err
+			}
+		}
+	}
+	audit := func(next dify.RequestHandler) dify.RequestHandler {
+		return func(req *http.Request) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			req.Header.Set("X-Audit", "seen")
+			return next(req)
+		}
+	}
+
+	c := dify.NewClientWithConfig(&dify.ClientConfig{
+		Host:             srv.URL,
+		DefaultAPISecret: "app-test",
+		Retry:            &dify.RetryPolicy{MinBackoff: time.Millisecond},
+		Middlewares: []dify.Middleware{
+			trace("outer"),
+			dify.HeaderMiddleware(http.Header{"X-Tenant": {"acme"}}),
+			audit,
+			trace("inner"),
+		},
+	})
+
+	resp, err := c.API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Answer != "acme,seen" {
+		t.Errorf("server saw headers %q, want acme,seen", resp.Answer)
+	}
+	// Middlewares run once per call, around the retry.
+	want := "outer /v1/chat-messages|inner /v1/chat-messages|inner 200|outer 200"
+	if got := strings.Join(log, "|"); got != want || calls.Load() != 2 {
+		t.Errorf("log = %s after %d calls, want %s after 2", got, calls.Load(), want)
+	}
+}
+
+func TestMiddlewareObservesStreamEvents(t *testing.T) {
+	srv := streamServer(t,
+		difytest.WorkflowEvent("workflow_started", map[string]any{"id": "r"}),
+		difytest.WorkflowEvent("node_started", map[string]any{"id": "n", "node_id": "llm"}),
+		difytest.WorkflowEvent("workflow_finished", map[string]any{"id": "r", "status": "succeeded"}),
+	)
+
+	for name, transport := range map[string]http.RoundTripper{
+		"default": http.DefaultTransport,
+		// The observers must not be looked up on resp.Request.
+		"without response request": requestlessTransport{},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var observed []string
+			observe := func(next dify.RequestHandler) dify.RequestHandler {
+				return func(req *http.Request) (*http.Response, error) {
+					return next(dify.ObserveStreamEvents(req, func(ev dify.StreamEvent) {
+						observed = append(observed, ev.Event)
+					}))
+				}
+			}
+			c := newTestClient(t, srv.URL, withTransport(transport), func(cfg *dify.ClientConfig) {
+				cfg.Middlewares = []dify.Middleware{observe}
+			})
+
+			var handled int
+			err := c.API().RunStreamWorkflow(context.Background(), dify.WorkflowRequest{User: "test"}, func(dify.StreamingResponse) { handled++ })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "workflow_started,node_started,workflow_finished"; strings.Join(observed, ",") != want || handled != 3 {
+				t.Errorf("observed %v and handled %d events, want %s and 3", observed, handled, want)
+			}
+		})
+	}
+}
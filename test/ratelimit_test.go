@@ -0,0 +1,155 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zruijie/dify-sdk-go"
+)
+
+type waitRecorder struct {
+	mu    sync.Mutex
+	waits []dify.RateLimitWait
+}
+
+func (r *waitRecorder) record(w dify.RateLimitWait) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.waits = append(r.waits, w)
+}
+
+func (r *waitRecorder) all() []dify.RateLimitWait {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]dify.RateLimitWait(nil), r.waits...)
+}
+
+func TestStreamingConcurrencyLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"event\":\"message\",\"answer\":\"a\"}\n\n")
+	}))
+	defer srv.Close()
+
+	var waits waitRecorder
+	c := dify.NewClientWithConfig(&dify.ClientConfig{
+		Host:               srv.URL,
+		DefaultAPISecret:   "app-first-secret",
+		StreamingRateLimit: dify.RateLimit{MaxConcurrent: 1},
+		OnRateLimitWait:    waits.record,
+	})
+	req := func() *dify.ChatMessageRequest { return &dify.ChatMessageRequest{Query: "hi", User: "test"} }
+
+	first, err := c.API().StreamChatMessages(context.Background(), req())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another app and blocking calls are not held up by the open stream.
+	other, err := c.API().WithSecret("app-other-secret").StreamChatMessages(context.Background(), req())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+
+	// A second stream of the same app waits for the first to be closed.
+	opened := make(chan error, 1)
+	go func() {
+		second, err := c.API().StreamChatMessages(context.Background(), req())
+		if err == nil {
+			second.Close()
+		}
+		opened <- err
+	}()
+	select {
+	case err := <-opened:
+		t.Fatalf("second stream opened while the first was open: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	first.Close()
+	if err := <-opened; err != nil {
+		t.Fatal(err)
+	}
+
+	got := waits.all()
+	if len(got) != 1 || got[0].Limit != "concurrency" || !got[0].Streaming || got[0].Secret != "app-****cret" || got[0].Wait <= 0 {
+		t.Errorf("waits = %+v", got)
+	}
+}
+
+func TestConcurrencyLimitContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"event\":\"message\",\"answer\":\"a\"}\n\n")
+	}))
+	defer srv.Close()
+
+	var waits waitRecorder
+	c := dify.NewClientWithConfig(&dify.ClientConfig{
+		Host:               srv.URL,
+		DefaultAPISecret:   "app-test",
+		StreamingRateLimit: dify.RateLimit{MaxConcurrent: 1},
+		OnRateLimitWait:    waits.record,
+	})
+	first, err := c.API().StreamChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, err = c.API().StreamChatMessages(ctx, &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if got := waits.all(); len(got) != 1 || !errors.Is(got[0].Err, context.DeadlineExceeded) {
+		t.Errorf("waits = %+v", got)
+	}
+}
+
+func TestBlockingRateLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"answer":"ok"}`)
+	}))
+	defer srv.Close()
+
+	var waits waitRecorder
+	c := dify.NewClientWithConfig(&dify.ClientConfig{
+		Host:              srv.URL,
+		DefaultAPISecret:  "app-test",
+		BlockingRateLimit: dify.RateLimit{RequestsPerSecond: 20, Burst: 1},
+		OnRateLimitWait:   waits.record,
+	})
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := c.API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("3 calls at 20/s took %v, want at least 100ms", elapsed)
+	}
+
+	// Another secret has a bucket of its own.
+	start = time.Now()
+	if _, err := c.API().WithSecret("app-other").ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Errorf("call with another secret waited %v", elapsed)
+	}
+
+	got := waits.all()
+	if len(got) != 2 || got[0].Limit != "rate" || got[0].Streaming {
+		t.Errorf("waits = %+v", got)
+	}
+}
@@ -0,0 +1,166 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/zruijie/dify-sdk-go"
+	"github.com/zruijie/dify-sdk-go/difytest"
+)
+
+var testRetryPolicy = &dify.RetryPolicy{
+	MaxAttempts: 3,
+	MinBackoff:  time.Millisecond,
+	MaxBackoff:  10 * time.Millisecond,
+}
+
+// flakyServer starts a fake Dify server answering the first failures calls of
+// e with status and header.
+func flakyServer(t *testing.T, e difytest.Endpoint, failures, status int, header http.Header) *difytest.Server {
+	t.Helper()
+	srv := newTestServer(t)
+	for i := 0; i < failures; i++ {
+		srv.Enqueue(e, difytest.Response{Status: status, Code: "unavailable", Message: "try again", Header: header})
+	}
+	return srv
+}
+
+func TestRetryOnStatus(t *testing.T) {
+	srv := flakyServer(t, difytest.EndpointChat, 2, http.StatusServiceUnavailable, nil)
+
+	resp, err := newTestClient(t, srv.URL, withRetry(testRetryPolicy)).API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := srv.RequestsTo(difytest.EndpointChat)
+	if resp.Answer != "hi" || len(calls) != 3 {
+		t.Errorf("answer %q after %d calls, want hi after 3", resp.Answer, len(calls))
+	}
+	for i, call := range calls {
+		if string(call.Body) != string(calls[0].Body) || len(call.Body) == 0 {
+			t.Errorf("body of attempt %d = %q, want %q", i+1, call.Body, calls[0].Body)
+		}
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	srv := flakyServer(t, difytest.EndpointChat, 10, http.StatusBadGateway, nil)
+
+	_, err := newTestClient(t, srv.URL, withRetry(testRetryPolicy)).API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	var apiErr *dify.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("err = %v, want *APIError with status 502", err)
+	}
+	if calls := len(srv.RequestsTo(difytest.EndpointChat)); calls != 3 {
+		t.Errorf("%d calls, want 3", calls)
+	}
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	t.Run("honored", func(t *testing.T) {
+		srv := flakyServer(t, difytest.EndpointChat, 1, http.StatusTooManyRequests, http.Header{"Retry-After": {"0"}})
+		if _, err := newTestClient(t, srv.URL, withRetry(testRetryPolicy)).API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"}); err != nil {
+			t.Fatal(err)
+		}
+		if calls := len(srv.RequestsTo(difytest.EndpointChat)); calls != 2 {
+			t.Errorf("%d calls, want 2", calls)
+		}
+	})
+
+	t.Run("longer than MaxBackoff", func(t *testing.T) {
+		srv := flakyServer(t, difytest.EndpointChat, 1, http.StatusTooManyRequests, http.Header{"Retry-After": {"120"}})
+		_, err := newTestClient(t, srv.URL, withRetry(testRetryPolicy)).API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+		if !errors.Is(err, dify.ErrRateLimited) {
+			t.Fatalf("err = %v, want ErrRateLimited", err)
+		}
+		if calls := len(srv.RequestsTo(difytest.EndpointChat)); calls != 1 {
+			t.Errorf("%d calls, want 1", calls)
+		}
+	})
+}
+
+func TestRetryStreamBeforeFirstEvent(t *testing.T) {
+	srv := flakyServer(t, difytest.EndpointChat, 1, http.StatusServiceUnavailable, nil)
+	srv.Enqueue(difytest.EndpointChat, difytest.Response{Events: []difytest.Event{difytest.MessageEvent("a"), difytest.MessageEvent("b")}})
+
+	stream, err := newTestClient(t, srv.URL, withRetry(testRetryPolicy)).API().StreamChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var answers string
+	for stream.Next() {
+		answers += stream.Current().Answer
+	}
+	if calls := len(srv.RequestsTo(difytest.EndpointChat)); stream.Err() != nil || answers != "ab" || calls != 2 {
+		t.Errorf("answers %q, err %v after %d calls", answers, stream.Err(), calls)
+	}
+}
+
+func TestRetryWorkflowRun(t *testing.T) {
+	t.Run("not on status", func(t *testing.T) {
+		srv := flakyServer(t, difytest.EndpointWorkflow, 1, http.StatusServiceUnavailable, nil)
+		_, err := newTestClient(t, srv.URL, withRetry(testRetryPolicy)).API().RunWorkflow(context.Background(), dify.WorkflowRequest{User: "test"})
+		var apiErr *dify.APIError
+		if calls := len(srv.RequestsTo(difytest.EndpointWorkflow)); !errors.As(err, &apiErr) || calls != 1 {
+			t.Errorf("err = %v after %d calls, want *APIError after 1", err, calls)
+		}
+	})
+
+	t.Run("on connection error", func(t *testing.T) {
+		srv := newTestServer(t)
+		var dials atomic.Int32
+		dialer := &net.Dialer{}
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if dials.Add(1) == 1 {
+					return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+				}
+				return dialer.DialContext(ctx, network, addr)
+			},
+		}
+		resp, err := newTestClient(t, srv.URL, withRetry(testRetryPolicy), withTransport(transport)).API().RunWorkflow(context.Background(), dify.WorkflowRequest{User: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calls := len(srv.RequestsTo(difytest.EndpointWorkflow)); resp.WorkflowRunID == "" || dials.Load() != 2 || calls != 1 {
+			t.Errorf("run %q after %d dials and %d calls", resp.WorkflowRunID, dials.Load(), calls)
+		}
+	})
+
+	t.Run("not on reset after the request was sent", func(t *testing.T) {
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			io.ReadAll(r.Body)
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+		}))
+		defer srv.Close()
+		_, err := newTestClient(t, srv.URL, withRetry(testRetryPolicy)).API().RunWorkflow(context.Background(), dify.WorkflowRequest{User: "test"})
+		if err == nil || calls.Load() != 1 {
+			t.Errorf("err = %v after %d calls, want an error after 1", err, calls.Load())
+		}
+	})
+}
+
+func TestNoRetryWithoutPolicy(t *testing.T) {
+	srv := flakyServer(t, difytest.EndpointChat, 1, http.StatusServiceUnavailable, nil)
+
+	_, err := newTestClient(t, srv.URL).API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	if calls := len(srv.RequestsTo(difytest.EndpointChat)); err == nil || calls != 1 {
+		t.Errorf("err = %v after %d calls, want an error after 1", err, calls)
+	}
+}
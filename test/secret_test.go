@@ -0,0 +1,222 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zruijie/dify-sdk-go"
+)
+
+// rotatingServer accepts only its current key and records the query of every
+// request it receives.
+type rotatingServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	key     string
+	queries []string
+	calls   atomic.Int32
+}
+
+func newRotatingServer(t *testing.T, key string) *rotatingServer {
+	s := &rotatingServer{key: key}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.calls.Add(1)
+		var req dify.ChatMessageRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		s.mu.Lock()
+		s.queries = append(s.queries, req.Query)
+		ok := r.Header.Get("Authorization") == "Bearer "+s.key
+		s.mu.Unlock()
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"code":"unauthorized","message":"Access token is invalid","status":401}`)
+			return
+		}
+		if req.ResponseMode == "streaming" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "data: {\"event\":\"message\",\"answer\":\"streamed\"}\n\n")
+			return
+		}
+		chatAnswer("ok")(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *rotatingServer) rotate(key string) {
+	s.mu.Lock()
+	s.key = key
+	s.mu.Unlock()
+}
+
+func writeSecret(t *testing.T, path, secret string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(secret+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSecretRotationFromFile(t *testing.T) {
+	srv := newRotatingServer(t, "app-one")
+	path := filepath.Join(t.TempDir(), "api-key")
+	writeSecret(t, path, "app-one")
+
+	c := dify.NewClientWithConfig(&dify.ClientConfig{
+		Host:           srv.URL,
+		SecretProvider: dify.NewFileSecretWithInterval(path, time.Hour),
+	})
+	if _, err := askChat(c); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key is rotated before the provider looks at the file again.
+	writeSecret(t, path, "app-two")
+	srv.rotate("app-two")
+	if _, err := askChat(c); err != nil {
+		t.Fatal(err)
+	}
+	if srv.calls.Load() != 3 {
+		t.Errorf("calls = %d, want 3", srv.calls.Load())
+	}
+	if fmt.Sprint(srv.queries) != "[hi hi hi]" {
+		t.Errorf("the body was not replayed: %q", srv.queries)
+	}
+
+	stream, err := c.API().StreamChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if !stream.Next() || stream.Current().Answer != "streamed" {
+		t.Errorf("stream: %v", stream.Err())
+	}
+}
+
+func TestSecretRotationStream(t *testing.T) {
+	srv := newRotatingServer(t, "app-two")
+	path := filepath.Join(t.TempDir(), "api-key")
+	writeSecret(t, path, "app-one")
+	provider := dify.NewFileSecretWithInterval(path, time.Hour)
+	provider.Secret(context.Background())
+	writeSecret(t, path, "app-two")
+
+	c := dify.NewClientWithConfig(&dify.ClientConfig{Host: srv.URL, SecretProvider: provider})
+	stream, err := c.API().StreamChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if !stream.Next() || stream.Current().Answer != "streamed" {
+		t.Errorf("stream: %v", stream.Err())
+	}
+	if srv.calls.Load() != 2 {
+		t.Errorf("calls = %d, want 2", srv.calls.Load())
+	}
+}
+
+// countingProvider returns a new key on every refresh.
+type countingProvider struct {
+	refreshes atomic.Int32
+}
+
+func (p *countingProvider) Secret(context.Context) (string, error) {
+	return fmt.Sprintf("app-%d", p.refreshes.Load()), nil
+}
+
+func (p *countingProvider) Refresh(ctx context.Context) (string, error) {
+	p.refreshes.Add(1)
+	return p.Secret(ctx)
+}
+
+func TestSecretRefreshRetriesOnce(t *testing.T) {
+	srv := newRotatingServer(t, "app-never")
+	provider := &countingProvider{}
+	c := dify.NewClientWithConfig(&dify.ClientConfig{Host: srv.URL, SecretProvider: provider})
+
+	_, err := askChat(c)
+	var apiErr *dify.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("err = %v", err)
+	}
+	if srv.calls.Load() != 2 || provider.refreshes.Load() != 1 {
+		t.Errorf("calls = %d, refreshes = %d, want 2 and 1", srv.calls.Load(), provider.refreshes.Load())
+	}
+}
+
+func TestSecretRefreshWithoutNewKey(t *testing.T) {
+	srv := newRotatingServer(t, "app-two")
+	var logs logBuffer
+	c := newTestClient(t, srv.URL, withLogs(&logs), func(c *dify.ClientConfig) {
+		c.SecretProvider = dify.StaticSecret("app-one")
+	})
+
+	if _, err := askChat(c); err == nil {
+		t.Fatal("no error")
+	}
+	if srv.calls.Load() != 1 {
+		t.Errorf("calls = %d, want 1", srv.calls.Load())
+	}
+	logs.find(t, "dify secret refreshed")
+}
+
+func TestSecretNotRefreshedForFixedSecret(t *testing.T) {
+	srv := newRotatingServer(t, "app-two")
+	provider := &countingProvider{}
+	c := dify.NewClientWithConfig(&dify.ClientConfig{Host: srv.URL, SecretProvider: provider})
+
+	if _, err := c.API().WithSecret("app-one").ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"}); err == nil {
+		t.Fatal("no error")
+	}
+	if srv.calls.Load() != 1 || provider.refreshes.Load() != 0 {
+		t.Errorf("calls = %d, refreshes = %d, want 1 and 0", srv.calls.Load(), provider.refreshes.Load())
+	}
+}
+
+func TestSecretProviderError(t *testing.T) {
+	srv := newRotatingServer(t, "app-one")
+	c := dify.NewClientWithConfig(&dify.ClientConfig{Host: srv.URL, SecretProvider: dify.EnvSecret("DIFY_TEST_UNSET_SECRET")})
+
+	if _, err := askChat(c); !errors.Is(err, dify.ErrNoSecret) {
+		t.Errorf("err = %v", err)
+	}
+	if srv.calls.Load() != 0 {
+		t.Errorf("calls = %d, want 0", srv.calls.Load())
+	}
+}
+
+func TestAppSecretProvider(t *testing.T) {
+	srv := newRotatingServer(t, "app-reports-two")
+	path := filepath.Join(t.TempDir(), "reports-key")
+	writeSecret(t, path, "app-reports-two")
+	t.Setenv("DIFY_HOST", srv.URL)
+	t.Setenv("DIFY_API_KEY", "app-default")
+	t.Setenv("DIFY_APP_REPORTS_API_KEY_FILE", path)
+
+	cfg, err := dify.LoadConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := dify.NewClientWithConfig(cfg).App("reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("DIFY_APP_REPORTS_API_KEY_FILE", filepath.Join(t.TempDir(), "missing"))
+	if _, err := dify.LoadConfigFromEnv(); err == nil {
+		t.Error("no error for a missing key file")
+	}
+}
@@ -0,0 +1,98 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/zruijie/dify-sdk-go"
+	"github.com/zruijie/dify-sdk-go/difytest"
+)
+
+func TestStreamChatMessagesErrorEvent(t *testing.T) {
+	srv := streamServer(t,
+		difytest.MessageEvent("hi"),
+		difytest.ErrorEvent(429, "provider_quota_exceeded", "quota"),
+	)
+
+	stream, err := newTestClient(t, srv.URL).API().StreamChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var answers []string
+	var messageID string
+	for stream.Next() {
+		answers = append(answers, stream.Current().Answer)
+		messageID = stream.Current().MessageID
+	}
+
+	var streamErr *dify.StreamError
+	if !errors.As(stream.Err(), &streamErr) {
+		t.Fatalf("Err() = %v, want *StreamError", stream.Err())
+	}
+	if streamErr.Status != 429 || streamErr.Code != "provider_quota_exceeded" || streamErr.MessageID == "" || streamErr.MessageID != messageID {
+		t.Errorf("StreamError = %+v", streamErr)
+	}
+	if strings.Join(answers, "") != "hi" {
+		t.Errorf("answers = %v", answers)
+	}
+}
+
+func TestChatMessagesStreamMalformedEvent(t *testing.T) {
+	malformed := `{"event":"message","answer":`
+	events := []difytest.Event{
+		difytest.MessageEvent("a"),
+		difytest.RawEvent("data: " + malformed + "\n\n"),
+		difytest.MessageEvent("b"),
+	}
+
+	t.Run("lenient", func(t *testing.T) {
+		srv := streamServer(t, events...)
+		ch, err := newTestClient(t, srv.URL).API().ChatMessagesStream(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var answers []string
+		var errs []error
+		for resp := range ch {
+			if resp.Err != nil {
+				errs = append(errs, resp.Err)
+				continue
+			}
+			answers = append(answers, resp.Answer)
+		}
+		if strings.Join(answers, ",") != "a,b" {
+			t.Errorf("answers = %v, want [a b]", answers)
+		}
+		var decodeErr *dify.StreamDecodeError
+		if len(errs) != 1 || !errors.As(errs[0], &decodeErr) || string(decodeErr.Raw) != malformed {
+			t.Errorf("errs = %v", errs)
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		srv := streamServer(t, events...)
+		ch, err := newTestClient(t, srv.URL).API().ChatMessagesStream(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"},
+			dify.WithStrictDecoding(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var answers []string
+		var errs []error
+		for resp := range ch {
+			if resp.Err != nil {
+				errs = append(errs, resp.Err)
+				continue
+			}
+			answers = append(answers, resp.Answer)
+		}
+		if strings.Join(answers, ",") != "a" {
+			t.Errorf("answers = %v, want [a]", answers)
+		}
+		var decodeErr *dify.StreamDecodeError
+		if len(errs) != 1 || !errors.As(errs[0], &decodeErr) {
+			t.Errorf("errs = %v", errs)
+		}
+	})
+}
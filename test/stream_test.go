@@ -0,0 +1,139 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/zruijie/dify-sdk-go"
+	"github.com/zruijie/dify-sdk-go/difytest"
+)
+
+// endlessStreamServer streams a message event every 5ms until the client goes
+// away.
+func endlessStreamServer(t *testing.T) *difytest.Server {
+	t.Helper()
+	events := make([]difytest.Event, 2000)
+	for i := range events {
+		events[i] = difytest.MessageEvent(strconv.Itoa(i)).After(5 * time.Millisecond)
+	}
+	srv := newTestServer(t)
+	srv.Handle(difytest.EndpointChat, func(difytest.Request) difytest.Response {
+		return difytest.Response{Events: events}
+	})
+	return srv
+}
+
+// waitForGoroutines fails the test unless the goroutine count drops back to
+// at most want before the deadline.
+func waitForGoroutines(t *testing.T, want int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n := runtime.NumGoroutine()
+		if n <= want {
+			return
+		}
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Fatalf("goroutines leaked: have %d, want <= %d\n%s", n, want, buf)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestChatMessagesStreamStatusError(t *testing.T) {
+	srv := newTestServer(t)
+
+	_, err := newTestClient(t, srv.URL, withSecret("app-wrong")).API().ChatMessagesStream(context.Background(), &dify.ChatMessageRequest{
+		Query: "hi",
+		User:  "test",
+	})
+
+	var apiErr *dify.APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("got %v, want *dify.APIError", err)
+	}
+	if apiErr.StatusCode != http.StatusUnauthorized || apiErr.Code != "unauthorized" {
+		t.Errorf("got status %d code %q", apiErr.StatusCode, apiErr.Code)
+	}
+}
+
+func TestChatMessagesStreamNonJSONStatusError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, "<html><body>502 Bad Gateway</body></html>")
+	}))
+	defer srv.Close()
+
+	_, err := newTestClient(t, srv.URL).API().StreamChatMessages(context.Background(), &dify.ChatMessageRequest{
+		Query: "hi",
+		User:  "test",
+	})
+
+	var apiErr *dify.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("got %v, want *dify.APIError with status 502", err)
+	}
+}
+
+func TestChatMessagesStreamCancelDoesNotLeak(t *testing.T) {
+	srv := endlessStreamServer(t)
+	client := newTestClient(t, srv.URL, withoutKeepAlives)
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := client.API().ChatMessagesStream(ctx, &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-ch
+	// Stop reading without draining the channel, and give the stream time to
+	// block on sending the next event.
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	waitForGoroutines(t, before)
+}
+
+func TestChatMessagesStreamDrainAfterCancel(t *testing.T) {
+	srv := endlessStreamServer(t)
+	client := newTestClient(t, srv.URL, withoutKeepAlives)
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := client.API().ChatMessagesStream(ctx, &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-ch
+	cancel()
+	for range ch {
+	}
+
+	waitForGoroutines(t, before)
+}
+
+func TestStreamCloseDoesNotLeak(t *testing.T) {
+	srv := endlessStreamServer(t)
+	client := newTestClient(t, srv.URL, withoutKeepAlives)
+	before := runtime.NumGoroutine()
+
+	stream, err := client.API().StreamChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3 && stream.Next(); i++ {
+	}
+	stream.Close()
+
+	waitForGoroutines(t, before)
+}
@@ -0,0 +1,139 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zruijie/dify-sdk-go"
+	"github.com/zruijie/dify-sdk-go/difytest"
+)
+
+// pacedStreamServer sends the headers after headerDelay, then a message event,
+// or workflow_started for workflows, followed by a ping every pingEvery for
+// pings times. With hang set it then stays silent until the client goes away,
+// otherwise it ends the stream.
+func pacedStreamServer(t *testing.T, headerDelay, pingEvery time.Duration, pings int, hang bool) *difytest.Server {
+	t.Helper()
+	var events []difytest.Event
+	for i := 0; i < pings; i++ {
+		events = append(events, difytest.PingEvent().After(pingEvery))
+	}
+	if hang {
+		events = append(events, difytest.PingEvent().After(time.Hour))
+	}
+	srv := newTestServer(t)
+	srv.Handle(difytest.EndpointChat, func(difytest.Request) difytest.Response {
+		return difytest.Response{Delay: headerDelay, Events: append([]difytest.Event{difytest.MessageEvent("hi")}, events...)}
+	})
+	srv.Handle(difytest.EndpointWorkflow, func(difytest.Request) difytest.Response {
+		started := difytest.WorkflowEvent("workflow_started", map[string]any{"id": "r"})
+		return difytest.Response{Delay: headerDelay, Events: append([]difytest.Event{started}, events...)}
+	})
+	return srv
+}
+
+func drainChatStream(t *testing.T, c *dify.Client, opts ...dify.StreamOption) ([]string, error) {
+	t.Helper()
+	stream, err := c.API().StreamChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "test"}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	var answers []string
+	for stream.Next() {
+		answers = append(answers, stream.Current().Answer)
+	}
+	return answers, stream.Err()
+}
+
+func TestStreamFirstEventTimeout(t *testing.T) {
+	t.Run("before headers", func(t *testing.T) {
+		srv := pacedStreamServer(t, time.Second, 0, 0, false)
+		_, err := drainChatStream(t, newTestClient(t, srv.URL), dify.WithFirstEventTimeout(50*time.Millisecond))
+		var timeoutErr *dify.FirstEventTimeoutError
+		if !errors.As(err, &timeoutErr) || timeoutErr.Duration != 50*time.Millisecond {
+			t.Fatalf("err = %v, want *FirstEventTimeoutError", err)
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Error("timeout error does not match context.DeadlineExceeded")
+		}
+	})
+
+	t.Run("met", func(t *testing.T) {
+		srv := pacedStreamServer(t, 0, 0, 0, false)
+		answers, err := drainChatStream(t, newTestClient(t, srv.URL), dify.WithFirstEventTimeout(time.Second))
+		if err != nil || len(answers) != 1 {
+			t.Fatalf("answers = %v, err = %v", answers, err)
+		}
+	})
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	// Pings every 20ms keep the stream alive for 200ms, well past the idle
+	// timeout, before the server stalls.
+	srv := pacedStreamServer(t, 0, 20*time.Millisecond, 10, true)
+
+	start := time.Now()
+	answers, err := drainChatStream(t, newTestClient(t, srv.URL), dify.WithIdleTimeout(100*time.Millisecond))
+	var timeoutErr *dify.IdleTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("err = %v, want *IdleTimeoutError", err)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("stream ended after %v, pings did not count as activity", elapsed)
+	}
+	if len(answers) != 1 {
+		t.Errorf("answers = %v", answers)
+	}
+}
+
+func TestStreamTotalTimeout(t *testing.T) {
+	srv := pacedStreamServer(t, 0, 10*time.Millisecond, 100, true)
+
+	_, err := drainChatStream(t, newTestClient(t, srv.URL),
+		dify.WithIdleTimeout(time.Second),
+		dify.WithStreamTimeout(100*time.Millisecond),
+	)
+	var timeoutErr *dify.StreamTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("err = %v, want *StreamTimeoutError", err)
+	}
+}
+
+func TestStreamTimeoutClientDefaults(t *testing.T) {
+	srv := pacedStreamServer(t, 0, 20*time.Millisecond, 7, false)
+	c := newTestClient(t, srv.URL, func(cfg *dify.ClientConfig) {
+		// Timeout alone would end the stream after 50ms.
+		cfg.Timeout = 50 * time.Millisecond
+		cfg.StreamIdleTimeout = 100 * time.Millisecond
+	})
+
+	if answers, err := drainChatStream(t, c); err != nil || len(answers) != 1 {
+		t.Fatalf("answers = %v, err = %v", answers, err)
+	}
+
+	_, err := drainChatStream(t, c, dify.WithStreamTimeout(80*time.Millisecond))
+	var timeoutErr *dify.StreamTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("per-call timeout: err = %v, want *StreamTimeoutError", err)
+	}
+}
+
+func TestRunStreamWorkflowIdleTimeout(t *testing.T) {
+	srv := pacedStreamServer(t, 0, 0, 0, true)
+
+	var events []string
+	err := newTestClient(t, srv.URL).API().RunStreamWorkflow(context.Background(), dify.WorkflowRequest{User: "test"},
+		func(resp dify.StreamingResponse) { events = append(events, resp.Event) },
+		dify.WithIdleTimeout(50*time.Millisecond),
+	)
+	var timeoutErr *dify.IdleTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("err = %v, want *IdleTimeoutError", err)
+	}
+	if len(events) != 1 || events[0] != dify.EventWorkflowStarted {
+		t.Errorf("events = %v", events)
+	}
+}
@@ -0,0 +1,273 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/zruijie/dify-sdk-go"
+	"github.com/zruijie/dify-sdk-go/difytest"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func spanAttr(span tracetest.SpanStub, key string) attribute.Value {
+	for _, kv := range span.Attributes {
+		if string(kv.Key) == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracingBlockingChat(t *testing.T) {
+	// difytest counts a token per word.
+	srv := newTestServer(t)
+	srv.Enqueue(difytest.EndpointChat, difytest.Response{Answer: "fine thanks"})
+	exporter := tracetest.NewInMemoryExporter()
+	client := newTestClient(t, srv.URL, withTracing(t, exporter))
+
+	if _, err := client.API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "how are you", User: "u"}); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	span := spans[0]
+	if span.Name != "dify POST /v1/chat-messages" {
+		t.Errorf("span name = %q", span.Name)
+	}
+	checks := map[string]attribute.Value{
+		"http.response.status_code":  attribute.IntValue(200),
+		"gen_ai.usage.input_tokens":  attribute.IntValue(3),
+		"gen_ai.usage.output_tokens": attribute.IntValue(2),
+		"dify.usage.total_tokens":    attribute.IntValue(5),
+	}
+	for key, want := range checks {
+		if got := spanAttr(span, key); got != want {
+			t.Errorf("%s = %v, want %v", key, got.Emit(), want.Emit())
+		}
+	}
+}
+
+func TestTracingAppMode(t *testing.T) {
+	srv := newTestServer(t)
+	exporter := tracetest.NewInMemoryExporter()
+	client := newTestClient(t, srv.URL, withTracing(t, exporter))
+	if err := client.RegisterApp("support", dify.AppConfig{Secret: testSecret, Mode: dify.AppModeAdvancedChat}); err != nil {
+		t.Fatal(err)
+	}
+	app, err := client.App("support")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &dify.ChatMessageRequest{Query: "hi", User: "u"}
+	if _, err := app.API().ChatMessages(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	api := client.API()
+	if _, err := api.ChatMessages(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.CompletionMessages(context.Background(), &dify.CompletionMessageRequest{User: "u"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.RunWorkflow(context.Background(), dify.WorkflowRequest{User: "u"}); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 4 {
+		t.Fatalf("got %d spans, want 4", len(spans))
+	}
+	if got := spanAttr(spans[0], "dify.app"); got != attribute.StringValue("support") {
+		t.Errorf("dify.app = %v", got.Emit())
+	}
+	if got := spanAttr(spans[0], "dify.app_mode"); got != attribute.StringValue("advanced-chat") {
+		t.Errorf("dify.app_mode = %v", got.Emit())
+	}
+	// The mode of the default secret is not known, and not guessed from an
+	// endpoint that apps of several modes serve.
+	for _, key := range []string{"dify.app", "dify.app_mode"} {
+		if got := spanAttr(spans[1], key); got.Type() != attribute.INVALID {
+			t.Errorf("%s = %v without an app", key, got.Emit())
+		}
+	}
+	for i, want := range map[int]string{2: "completion", 3: "workflow"} {
+		if got := spanAttr(spans[i], "dify.app_mode"); got != attribute.StringValue(want) {
+			t.Errorf("dify.app_mode of %s = %v, want %s", spans[i].Name, got.Emit(), want)
+		}
+		if got := spanAttr(spans[i], "dify.app"); got.Type() != attribute.INVALID {
+			t.Errorf("dify.app of %s = %v without an app", spans[i].Name, got.Emit())
+		}
+	}
+}
+
+func TestTracingErrorCode(t *testing.T) {
+	srv := newTestServer(t)
+	srv.Enqueue(difytest.EndpointRenameConversation, difytest.Error(http.StatusNotFound, "conversation_not_exists", "Conversation Not Exists."))
+	exporter := tracetest.NewInMemoryExporter()
+	client := newTestClient(t, srv.URL, withTracing(t, exporter))
+
+	_, err := client.API().ConversationsRenaming(context.Background(), &dify.ConversationsRenamingRequest{
+		ConversationID: "6f2c1f0c-0d5c-4bd8-a9d0-4d3b1b0a2f11",
+		Name:           "x",
+		User:           "u",
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	span := exporter.GetSpans()[0]
+	if span.Name != "dify POST /v1/conversations/{id}/name" {
+		t.Errorf("span name = %q", span.Name)
+	}
+	if got := spanAttr(span, "dify.error_code").AsString(); got != "conversation_not_exists" {
+		t.Errorf("dify.error_code = %q", got)
+	}
+	if span.Status.Code.String() != "Error" {
+		t.Errorf("status = %v, want Error", span.Status)
+	}
+}
+
+func TestTracingChatStreamFirstToken(t *testing.T) {
+	srv := streamServer(t, difytest.MessageEvent("he"), difytest.MessageEvent("llo"), difytest.MessageEndEvent(3, 4))
+	exporter := tracetest.NewInMemoryExporter()
+	client := newTestClient(t, srv.URL, withTracing(t, exporter))
+
+	stream, err := client.API().StreamChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "u"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range stream.All() {
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	var firstToken int
+	for _, ev := range spans[0].Events {
+		if ev.Name == "first_token" {
+			firstToken++
+		}
+	}
+	if firstToken != 1 {
+		t.Errorf("got %d first_token events, want 1", firstToken)
+	}
+	if got := spanAttr(spans[0], "dify.usage.total_tokens").AsInt64(); got != 7 {
+		t.Errorf("dify.usage.total_tokens = %d, want 7", got)
+	}
+}
+
+func TestTracingWorkflowNodeSpans(t *testing.T) {
+	run := func(name string, data map[string]any) difytest.Event {
+		e := difytest.WorkflowEvent(name, data)
+		e.Data["workflow_run_id"] = "run1"
+		return e
+	}
+	srv := streamServer(t,
+		run("workflow_started", map[string]any{"id": "run1", "workflow_id": "wf1"}),
+		run("node_started", map[string]any{"id": "e1", "node_id": "start", "node_type": "start", "title": "Start"}),
+		run("node_finished", map[string]any{"id": "e1", "node_id": "start", "status": "succeeded", "elapsed_time": 0.5}),
+		run("node_started", map[string]any{"id": "e2", "node_id": "llm", "node_type": "llm", "title": "LLM"}),
+		run("node_finished", map[string]any{"id": "e2", "node_id": "llm", "status": "failed", "error": "boom", "elapsed_time": 1.25, "execution_metadata": map[string]any{"total_tokens": 42}}),
+		run("workflow_finished", map[string]any{"id": "run1", "status": "failed", "total_tokens": 42}),
+	)
+	exporter := tracetest.NewInMemoryExporter()
+	client := newTestClient(t, srv.URL, withTracing(t, exporter))
+
+	err := client.API().RunStreamWorkflow(context.Background(), dify.WorkflowRequest{User: "u"}, func(dify.StreamingResponse) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("got %d spans, want 3", len(spans))
+	}
+	byName := make(map[string]tracetest.SpanStub)
+	for _, span := range spans {
+		byName[span.Name] = span
+	}
+	parent, ok := byName["dify POST /v1/workflows/run"]
+	if !ok {
+		t.Fatalf("missing call span in %v", byName)
+	}
+	llm := byName["dify.node LLM"]
+	if llm.Parent.SpanID() != parent.SpanContext.SpanID() {
+		t.Error("node span is not a child of the call span")
+	}
+	if d := llm.EndTime.Sub(llm.StartTime); d.Seconds() != 1.25 {
+		t.Errorf("node span duration = %v, want 1.25s", d)
+	}
+	if got := spanAttr(llm, "dify.usage.total_tokens").AsInt64(); got != 42 {
+		t.Errorf("node tokens = %d", got)
+	}
+	if llm.Status.Code.String() != "Error" {
+		t.Errorf("failed node status = %v", llm.Status)
+	}
+	if got := spanAttr(parent, "dify.workflow_run_id").AsString(); got != "run1" {
+		t.Errorf("dify.workflow_run_id = %q", got)
+	}
+}
+
+// bareTransport answers every request with status and body, leaving
+// Response.Request unset as some RoundTrippers do.
+type bareTransport struct {
+	status int
+	body   string
+}
+
+func (t bareTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: t.status,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(t.body)),
+	}, nil
+}
+
+func TestTracingResponseWithoutRequest(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tracing := withTracing(t, exporter)
+	newClient := func(transport http.RoundTripper) *dify.Client {
+		return newTestClient(t, "https://dify.test", withTransport(transport), tracing)
+	}
+
+	c := newClient(bareTransport{http.StatusOK, `{"id":"m1","answer":"hi","metadata":{"usage":{"total_tokens":15}}}`})
+	if _, err := c.API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "u"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := spanAttr(exporter.GetSpans()[0], "dify.usage.total_tokens"); got != attribute.IntValue(15) {
+		t.Errorf("total tokens = %v, want 15", got.Emit())
+	}
+
+	c = newClient(bareTransport{http.StatusOK, "data: {\"event\":\"message\",\"answer\":\"hi\"}\n\n"})
+	stream, err := c.API().StreamChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "u"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for stream.Next() {
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTracingErrorWithoutRequest(t *testing.T) {
+	c := newTestClient(t, "https://dify.test",
+		withTransport(bareTransport{http.StatusBadRequest, `{"code":"invalid_param","message":"bad"}`}),
+		withRetry(&dify.RetryPolicy{}),
+	)
+	_, err := c.API().ChatMessages(context.Background(), &dify.ChatMessageRequest{Query: "hi", User: "u"})
+	var apiErr *dify.APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != "invalid_param" {
+		t.Fatalf("err = %v, want the *APIError", err)
+	}
+}
@@ -0,0 +1,219 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zruijie/dify-sdk-go"
+)
+
+type countingTransport struct {
+	calls atomic.Int32
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.calls.Add(1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestCustomRoundTripper(t *testing.T) {
+	srv := newTestServer(t)
+
+	transport := &countingTransport{}
+	c := newTestClient(t, srv.URL, withTransport(transport), withRetry(&dify.RetryPolicy{}))
+	if _, err := askChat(c); err != nil {
+		t.Fatal(err)
+	}
+	if n := transport.calls.Load(); n != 1 {
+		t.Errorf("transport got %d calls", n)
+	}
+}
+
+func TestSharedHTTPClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		chatAnswer("slow")(w, r)
+	}))
+	defer srv.Close()
+
+	transport := &countingTransport{}
+	shared := &http.Client{Transport: transport, Timeout: 20 * time.Millisecond}
+	c := newTestClient(t, srv.URL, func(cfg *dify.ClientConfig) {
+		cfg.HTTPClient = shared
+		cfg.BlockingRateLimit = dify.RateLimit{MaxConcurrent: 1}
+	})
+	if _, err := askChat(c); err == nil {
+		t.Error("the timeout of the shared client was not applied")
+	}
+	if transport.calls.Load() != 1 {
+		t.Errorf("the transport of the shared client got %d calls", transport.calls.Load())
+	}
+	if shared.Transport != transport || shared.Timeout != 20*time.Millisecond {
+		t.Error("the shared client was modified")
+	}
+}
+
+func TestProxyURL(t *testing.T) {
+	var proxied atomic.Value
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Store(r.URL.String())
+		chatAnswer("via proxy")(w, r)
+	}))
+	defer proxy.Close()
+
+	c := newTestClient(t, "http://dify.invalid", func(cfg *dify.ClientConfig) { cfg.ProxyURL = proxy.URL })
+	answer, err := askChat(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer != "via proxy" || proxied.Load() != "http://dify.invalid/v1/chat-messages" {
+		t.Errorf("answer %q, proxy saw %v", answer, proxied.Load())
+	}
+}
+
+// newCert returns a self-signed certificate usable by servers and clients,
+// PEM encoded.
+func newCert(t *testing.T, name string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestMutualTLS(t *testing.T) {
+	serverCert, serverKey := newCert(t, "dify.internal")
+	clientCert, clientKey := newCert(t, "sdk-client")
+
+	cert, err := tls.X509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientCert)
+	srv := httptest.NewUnstartedServer(chatAnswer("mtls"))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client.key")
+	for name, data := range map[string][]byte{caFile: serverCert, certFile: clientCert, keyFile: clientKey} {
+		if err := os.WriteFile(name, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newClient := func(opts *dify.TLSOptions) *dify.Client {
+		return newTestClient(t, srv.URL, func(cfg *dify.ClientConfig) { cfg.TLS = opts })
+	}
+
+	if _, err := askChat(newClient(&dify.TLSOptions{CAFile: caFile})); err == nil {
+		t.Error("call without a client certificate succeeded")
+	}
+	answer, err := askChat(newClient(&dify.TLSOptions{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "dify.internal"}))
+	if err != nil || answer != "mtls" {
+		t.Errorf("with files: %q, %v", answer, err)
+	}
+	answer, err = askChat(newClient(&dify.TLSOptions{CAPEM: serverCert, CertPEM: clientCert, KeyPEM: clientKey}))
+	if err != nil || answer != "mtls" {
+		t.Errorf("with PEM data: %q, %v", answer, err)
+	}
+
+	_, err = askChat(newClient(&dify.TLSOptions{CAFile: filepath.Join(dir, "missing.pem")}))
+	if err == nil || !strings.Contains(err.Error(), "CA file") {
+		t.Errorf("missing CA file: %v", err)
+	}
+}
+
+func TestUnixSocketHost(t *testing.T) {
+	dir, err := os.MkdirTemp("", "dify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "dify.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	srv := &http.Server{Handler: chatAnswer("sidecar")}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	c := newTestClient(t, "unix://"+socket, func(cfg *dify.ClientConfig) {
+		// A proxy must not be used for sockets.
+		cfg.ProxyURL = "http://127.0.0.1:1"
+	})
+	answer, err := askChat(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer != "sidecar" {
+		t.Errorf("answer = %q", answer)
+	}
+}
+
+func TestTransportOptionsNeedHTTPTransport(t *testing.T) {
+	transport := &countingTransport{}
+	cfg := &dify.ClientConfig{
+		Host:             "https://dify.test",
+		DefaultAPISecret: "app-test",
+		Transport:        transport,
+		TLS:              &dify.TLSOptions{ServerName: "dify.internal"},
+	}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "cannot be applied") {
+		t.Errorf("Validate() = %v, want the transport problem", err)
+	}
+	_, err := askChat(dify.NewClientWithConfig(cfg))
+	if !errors.Is(err, dify.ErrTransportOptions) {
+		t.Errorf("err = %v, want ErrTransportOptions", err)
+	}
+	if n := transport.calls.Load(); n != 0 {
+		t.Errorf("transport got %d calls without the TLS options", n)
+	}
+}
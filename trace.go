@@ -0,0 +1,420 @@
+package dify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RunTrace is the executed graph of one workflow run, rebuilt from its
+// workflow and node events.
+type RunTrace struct {
+	WorkflowRunID string       `json:"workflow_run_id"`
+	WorkflowID    string       `json:"workflow_id,omitempty"`
+	TaskID        string       `json:"task_id,omitempty"`
+	Status        string       `json:"status,omitempty"`
+	Error         string       `json:"error,omitempty"`
+	ElapsedTime   float64      `json:"elapsed_time"`
+	TotalTokens   int          `json:"total_tokens"`
+	TotalSteps    int          `json:"total_steps"`
+	Nodes         []*TraceNode `json:"nodes"`
+	Edges         []TraceEdge  `json:"edges"`
+}
+
+// TraceNode is one execution of a workflow node. Nodes inside an iteration or
+// loop run once per round, so the same NodeID can appear several times.
+type TraceNode struct {
+	ID                string  `json:"id"`
+	NodeID            string  `json:"node_id"`
+	NodeType          string  `json:"node_type"`
+	Title             string  `json:"title"`
+	Index             int     `json:"index"`
+	PredecessorNodeID string  `json:"predecessor_node_id,omitempty"`
+	IterationID       string  `json:"iteration_id,omitempty"`
+	IterationIndex    int     `json:"iteration_index,omitempty"`
+	LoopID            string  `json:"loop_id,omitempty"`
+	LoopIndex         int     `json:"loop_index,omitempty"`
+	ParallelID        string  `json:"parallel_id,omitempty"`
+	ParentParallelID  string  `json:"parent_parallel_id,omitempty"`
+	Status            string  `json:"status"`
+	Error             string  `json:"error,omitempty"`
+	ElapsedTime       float64 `json:"elapsed_time"`
+	TotalTokens       int     `json:"total_tokens"`
+	TotalPrice        float64 `json:"total_price"`
+	Currency          string  `json:"currency,omitempty"`
+
+	// StartOffset is the time from workflow start until the node started,
+	// measured on arrival of the events.
+	StartOffset time.Duration `json:"start_offset"`
+}
+
+// TraceEdge links a predecessor node to the node that ran after it.
+type TraceEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// RunTraceCollector is an EventHandler that records workflow and node events
+// into a RunTrace:
+//
+//	collector := dify.NewRunTraceCollector()
+//	err := api.RunStreamWorkflowWithHandler(ctx, req, collector)
+//	collector.Trace().WriteGantt(os.Stdout)
+type RunTraceCollector struct {
+	mu      sync.Mutex
+	trace   RunTrace
+	byID    map[string]*TraceNode
+	edges   map[TraceEdge]bool
+	started time.Time
+	now     func() time.Time
+}
+
+func NewRunTraceCollector() *RunTraceCollector {
+	return &RunTraceCollector{
+		byID:  make(map[string]*TraceNode),
+		edges: make(map[TraceEdge]bool),
+		now:   time.Now,
+	}
+}
+
+func (c *RunTraceCollector) HandleStreamingResponse(resp StreamingResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if c.started.IsZero() {
+		c.started = now
+	}
+	if c.trace.WorkflowRunID == "" {
+		c.trace.WorkflowRunID = resp.WorkflowRunID
+	}
+	if c.trace.TaskID == "" {
+		c.trace.TaskID = resp.TaskID
+	}
+
+	data := &resp.Data
+	switch resp.Event {
+	case EventWorkflowStarted:
+		c.trace.WorkflowID = data.WorkflowID
+		c.trace.Status = "running"
+	case EventWorkflowFinished:
+		c.trace.WorkflowID = data.WorkflowID
+		c.trace.Status = data.Status
+		c.trace.Error = data.Error
+		c.trace.ElapsedTime = data.ElapsedTime
+		c.trace.TotalTokens = data.TotalTokens
+		c.trace.TotalSteps = data.TotalSteps
+	case EventNodeStarted:
+		node := c.node(data.ID)
+		node.StartOffset = now.Sub(c.started)
+		node.Status = "running"
+		c.fill(node, &resp)
+	case EventNodeFinished:
+		node, ok := c.byID[data.ID]
+		if !ok {
+			node = c.node(data.ID)
+			node.StartOffset = now.Sub(c.started) - time.Duration(data.ElapsedTime*float64(time.Second))
+		}
+		c.fill(node, &resp)
+		node.Status = data.Status
+		node.Error = data.Error
+		node.ElapsedTime = data.ElapsedTime
+		node.TotalTokens = data.ExecutionMetadata.TotalTokens
+		node.TotalPrice = data.ExecutionMetadata.TotalPrice
+		node.Currency = data.ExecutionMetadata.Currency
+	}
+}
+
+func (c *RunTraceCollector) HandleTTSMessage(TTSMessage) {}
+
+// Trace returns a snapshot of the trace collected so far.
+func (c *RunTraceCollector) Trace() *RunTrace {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	trace := c.trace
+	trace.Nodes = make([]*TraceNode, len(c.trace.Nodes))
+	for i, node := range c.trace.Nodes {
+		n := *node
+		trace.Nodes[i] = &n
+	}
+	trace.Edges = make([]TraceEdge, 0, len(c.edges))
+	for edge := range c.edges {
+		trace.Edges = append(trace.Edges, edge)
+	}
+	sort.Slice(trace.Edges, func(i, j int) bool {
+		if trace.Edges[i].From != trace.Edges[j].From {
+			return trace.Edges[i].From < trace.Edges[j].From
+		}
+		return trace.Edges[i].To < trace.Edges[j].To
+	})
+	return &trace
+}
+
+func (c *RunTraceCollector) node(id string) *TraceNode {
+	node := &TraceNode{ID: id}
+	c.byID[id] = node
+	c.trace.Nodes = append(c.trace.Nodes, node)
+	return node
+}
+
+// fill copies the node identity and nesting from an event, keeping values a
+// previous event already set when this one leaves them empty.
+func (c *RunTraceCollector) fill(node *TraceNode, resp *StreamingResponse) {
+	data := &resp.Data
+	meta := &data.ExecutionMetadata
+	setString(&node.NodeID, data.NodeID)
+	setString(&node.NodeType, data.NodeType)
+	setString(&node.Title, data.Title)
+	setString(&node.PredecessorNodeID, data.Predecessor)
+	setString(&node.IterationID, data.IterationID, meta.IterationID)
+	setString(&node.LoopID, data.LoopID, meta.LoopID)
+	setString(&node.ParallelID, data.ParallelID, meta.ParallelID)
+	setString(&node.ParentParallelID, data.ParentParallelID)
+	if data.Index != 0 {
+		node.Index = data.Index
+	}
+	if meta.IterationIndex != 0 {
+		node.IterationIndex = meta.IterationIndex
+	}
+	if meta.LoopIndex != 0 {
+		node.LoopIndex = meta.LoopIndex
+	}
+	if node.PredecessorNodeID != "" && node.NodeID != "" {
+		c.edges[TraceEdge{From: node.PredecessorNodeID, To: node.NodeID}] = true
+	}
+}
+
+func setString(dst *string, values ...string) {
+	for _, v := range values {
+		if v != "" {
+			*dst = v
+			return
+		}
+	}
+}
+
+// WriteJSON writes the trace as indented JSON.
+func (t *RunTrace) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(t)
+}
+
+// traceGroup is a node definition aggregated over all of its executions.
+type traceGroup struct {
+	first       *TraceNode
+	runs        int
+	status      string
+	elapsedTime float64
+	totalTokens int
+}
+
+// container returns the iteration, loop or parallel branch a node runs in.
+func (n *TraceNode) container() string {
+	switch {
+	case n.ParallelID != "":
+		return "parallel:" + n.ParallelID
+	case n.IterationID != "":
+		return "node:" + n.IterationID
+	case n.LoopID != "":
+		return "node:" + n.LoopID
+	}
+	return ""
+}
+
+// WriteMermaid writes the executed graph as a Mermaid flowchart. Nodes that
+// ran several times are drawn once with their accumulated time and tokens;
+// iterations, loops and parallel branches become nested subgraphs.
+func (t *RunTrace) WriteMermaid(w io.Writer) error {
+	groups := make(map[string]*traceGroup)
+	var order []string
+	parallelParent := make(map[string]string)
+	for _, node := range t.Nodes {
+		g, ok := groups[node.NodeID]
+		if !ok {
+			g = &traceGroup{first: node}
+			groups[node.NodeID] = g
+			order = append(order, node.NodeID)
+		}
+		g.runs++
+		g.elapsedTime += node.ElapsedTime
+		g.totalTokens += node.TotalTokens
+		if g.status == "" || node.Status != "succeeded" {
+			g.status = node.Status
+		}
+		if node.ParallelID != "" {
+			parent := parallelParent[node.ParallelID]
+			switch {
+			case node.ParentParallelID != "":
+				parent = "parallel:" + node.ParentParallelID
+			case node.IterationID != "":
+				parent = "node:" + node.IterationID
+			case node.LoopID != "":
+				parent = "node:" + node.LoopID
+			}
+			parallelParent[node.ParallelID] = parent
+		}
+	}
+
+	// children maps a container to the nodes and parallel branches inside it.
+	children := make(map[string][]string)
+	for _, id := range order {
+		container := groups[id].first.container()
+		children[container] = append(children[container], "node:"+id)
+	}
+	parallels := make([]string, 0, len(parallelParent))
+	for parallelID := range parallelParent {
+		parallels = append(parallels, parallelID)
+	}
+	sort.Strings(parallels)
+	for _, parallelID := range parallels {
+		parent := parallelParent[parallelID]
+		children[parent] = append(children[parent], "parallel:"+parallelID)
+	}
+
+	var b strings.Builder
+	b.WriteString("flowchart TD\n")
+
+	var render func(key, indent string)
+	render = func(key, indent string) {
+		for _, child := range children[key] {
+			if parallelID, ok := strings.CutPrefix(child, "parallel:"); ok {
+				fmt.Fprintf(&b, "%ssubgraph %s[\"parallel %s\"]\n", indent, mermaidID("p_"+parallelID), mermaidLabel(parallelID))
+				render(child, indent+"    ")
+				fmt.Fprintf(&b, "%send\n", indent)
+				continue
+			}
+
+			nodeID := strings.TrimPrefix(child, "node:")
+			g := groups[nodeID]
+			label := fmt.Sprintf("%s<br/>%s · %.2fs", mermaidLabel(nodeTitle(g.first)), g.status, g.elapsedTime)
+			if g.totalTokens > 0 {
+				label += fmt.Sprintf(" · %d tokens", g.totalTokens)
+			}
+			if g.runs > 1 {
+				label += fmt.Sprintf(" · %d runs", g.runs)
+			}
+
+			if len(children[child]) > 0 {
+				fmt.Fprintf(&b, "%ssubgraph %s[\"%s\"]\n", indent, mermaidID("g_"+nodeID), label)
+				fmt.Fprintf(&b, "%s    %s[\"%s\"]\n", indent, mermaidID(nodeID), mermaidLabel(nodeTitle(g.first)))
+				render(child, indent+"    ")
+				fmt.Fprintf(&b, "%send\n", indent)
+			} else {
+				fmt.Fprintf(&b, "%s%s[\"%s\"]\n", indent, mermaidID(nodeID), label)
+			}
+		}
+	}
+	render("", "    ")
+
+	for _, edge := range t.Edges {
+		fmt.Fprintf(&b, "    %s --> %s\n", mermaidID(edge.From), mermaidID(edge.To))
+	}
+	for _, id := range order {
+		switch groups[id].status {
+		case "failed", "exception":
+			fmt.Fprintf(&b, "    style %s stroke:#d33,stroke-width:2px\n", mermaidID(id))
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteGantt writes a text timeline of every node execution, one bar per line,
+// so the slow parts of a run stand out.
+func (t *RunTrace) WriteGantt(w io.Writer) error {
+	const width = 50
+
+	var total time.Duration
+	for _, node := range t.Nodes {
+		if end := node.StartOffset + node.elapsed(); end > total {
+			total = end
+		}
+	}
+	if run := time.Duration(t.ElapsedTime * float64(time.Second)); run > total {
+		total = run
+	}
+
+	depth := make(map[string]int)
+	labels := make([]string, len(t.Nodes))
+	labelWidth := 0
+	for i, node := range t.Nodes {
+		d := 0
+		if node.IterationID != "" {
+			d = depth[node.IterationID] + 1
+		} else if node.LoopID != "" {
+			d = depth[node.LoopID] + 1
+		}
+		if _, ok := depth[node.NodeID]; !ok {
+			depth[node.NodeID] = d
+		}
+		label := strings.Repeat("  ", d) + nodeTitle(node)
+		switch {
+		case node.IterationID != "":
+			label += fmt.Sprintf(" [%d]", node.IterationIndex)
+		case node.LoopID != "":
+			label += fmt.Sprintf(" [%d]", node.LoopIndex)
+		}
+		labels[i] = label
+		if n := len([]rune(label)); n > labelWidth {
+			labelWidth = n
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "workflow run %s: %s, %.2fs, %d tokens\n", t.WorkflowRunID, t.Status, total.Seconds(), t.TotalTokens)
+	for i, node := range t.Nodes {
+		start, length := 0, 1
+		if total > 0 {
+			start = int(float64(node.StartOffset) / float64(total) * width)
+			length = int(float64(node.elapsed()) / float64(total) * width)
+		}
+		start = min(max(start, 0), width-1)
+		length = min(max(length, 1), width-start)
+
+		bar := strings.Repeat(" ", start) + strings.Repeat("█", length) + strings.Repeat(" ", width-start-length)
+		pad := strings.Repeat(" ", labelWidth-len([]rune(labels[i])))
+		fmt.Fprintf(&b, "%s%s |%s| %7.2fs +%.2fs %s\n", labels[i], pad, bar, node.StartOffset.Seconds(), node.ElapsedTime, node.Status)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (n *TraceNode) elapsed() time.Duration {
+	return time.Duration(n.ElapsedTime * float64(time.Second))
+}
+
+func nodeTitle(n *TraceNode) string {
+	if n.Title != "" {
+		return n.Title
+	}
+	if n.NodeType != "" {
+		return n.NodeType
+	}
+	return n.NodeID
+}
+
+// mermaidID turns a Dify node id into a valid Mermaid identifier.
+func mermaidID(id string) string {
+	var b strings.Builder
+	b.WriteString("n_")
+	for _, r := range id {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+func mermaidLabel(s string) string {
+	return strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;").Replace(s)
+}
@@ -0,0 +1,138 @@
+package dify
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// traceTestEvents describes a run with a parallel pair of LLM calls followed by
+// an iteration over a code node. Offsets are arrival times in milliseconds.
+var traceTestEvents = []struct {
+	offset int
+	event  string
+}{
+	{0, `{"event":"workflow_started","task_id":"t1","workflow_run_id":"run1","data":{"id":"run1","workflow_id":"wf1"}}`},
+	{0, `{"event":"node_started","workflow_run_id":"run1","data":{"id":"e1","node_id":"start","node_type":"start","title":"Start","index":1}}`},
+	{10, `{"event":"node_finished","workflow_run_id":"run1","data":{"id":"e1","node_id":"start","node_type":"start","title":"Start","index":1,"status":"succeeded","elapsed_time":0.01}}`},
+	{10, `{"event":"node_started","workflow_run_id":"run1","data":{"id":"e2","node_id":"llm_a","node_type":"llm","title":"Draft \"A\"","index":2,"predecessor_node_id":"start","parallel_id":"p1","parallel_start_node_id":"llm_a"}}`},
+	{10, `{"event":"node_started","workflow_run_id":"run1","data":{"id":"e3","node_id":"llm_b","node_type":"llm","title":"Draft B","index":3,"predecessor_node_id":"start","parallel_id":"p1","parallel_start_node_id":"llm_b"}}`},
+	{1210, `{"event":"node_finished","workflow_run_id":"run1","data":{"id":"e3","node_id":"llm_b","status":"succeeded","elapsed_time":1.2,"execution_metadata":{"total_tokens":80,"total_price":0.002,"currency":"USD","parallel_id":"p1"}}}`},
+	{2010, `{"event":"node_finished","workflow_run_id":"run1","data":{"id":"e2","node_id":"llm_a","status":"succeeded","elapsed_time":2.0,"execution_metadata":{"total_tokens":120,"total_price":0.003,"currency":"USD","parallel_id":"p1"}}}`},
+	{2010, `{"event":"node_started","workflow_run_id":"run1","data":{"id":"e4","node_id":"iter","node_type":"iteration","title":"Each","index":4,"predecessor_node_id":"llm_a"}}`},
+	{2010, `{"event":"node_started","workflow_run_id":"run1","data":{"id":"e5","node_id":"code","node_type":"code","title":"Code","index":5,"iteration_id":"iter"}}`},
+	{2110, `{"event":"node_finished","workflow_run_id":"run1","data":{"id":"e5","node_id":"code","status":"succeeded","elapsed_time":0.1,"execution_metadata":{"iteration_id":"iter","iteration_index":0}}}`},
+	{2110, `{"event":"node_started","workflow_run_id":"run1","data":{"id":"e6","node_id":"code","node_type":"code","title":"Code","index":6,"iteration_id":"iter"}}`},
+	{2310, `{"event":"node_finished","workflow_run_id":"run1","data":{"id":"e6","node_id":"code","status":"failed","error":"boom","elapsed_time":0.2,"execution_metadata":{"iteration_id":"iter","iteration_index":1}}}`},
+	{2310, `{"event":"node_finished","workflow_run_id":"run1","data":{"id":"e4","node_id":"iter","status":"failed","elapsed_time":0.3}}`},
+	{2310, `{"event":"workflow_finished","workflow_run_id":"run1","data":{"id":"run1","workflow_id":"wf1","status":"failed","error":"boom","elapsed_time":2.31,"total_tokens":200,"total_steps":6}}`},
+}
+
+func collectTestTrace(t *testing.T) *RunTrace {
+	t.Helper()
+	start := time.Unix(1700000000, 0)
+	var now time.Time
+	c := NewRunTraceCollector()
+	c.now = func() time.Time { return now }
+
+	for _, e := range traceTestEvents {
+		now = start.Add(time.Duration(e.offset) * time.Millisecond)
+		var resp StreamingResponse
+		if err := json.Unmarshal([]byte(e.event), &resp); err != nil {
+			t.Fatal(err)
+		}
+		c.HandleStreamingResponse(resp)
+	}
+	return c.Trace()
+}
+
+func TestRunTraceCollector(t *testing.T) {
+	trace := collectTestTrace(t)
+
+	if trace.WorkflowRunID != "run1" || trace.Status != "failed" || trace.TotalTokens != 200 || trace.TotalSteps != 6 {
+		t.Errorf("trace summary = %+v", trace)
+	}
+	if len(trace.Nodes) != 6 {
+		t.Fatalf("got %d nodes, want 6", len(trace.Nodes))
+	}
+
+	llmA := trace.Nodes[1]
+	if llmA.NodeID != "llm_a" || llmA.ParallelID != "p1" || llmA.TotalTokens != 120 || llmA.TotalPrice != 0.003 ||
+		llmA.StartOffset != 10*time.Millisecond || llmA.ElapsedTime != 2.0 || llmA.Status != "succeeded" {
+		t.Errorf("llm_a = %+v", llmA)
+	}
+	code := trace.Nodes[5]
+	if code.IterationID != "iter" || code.IterationIndex != 1 || code.Status != "failed" || code.Error != "boom" {
+		t.Errorf("second code run = %+v", code)
+	}
+
+	want := []TraceEdge{{"llm_a", "iter"}, {"start", "llm_a"}, {"start", "llm_b"}}
+	if len(trace.Edges) != len(want) {
+		t.Fatalf("edges = %v, want %v", trace.Edges, want)
+	}
+	for i := range want {
+		if trace.Edges[i] != want[i] {
+			t.Errorf("edges = %v, want %v", trace.Edges, want)
+		}
+	}
+}
+
+func TestRunTraceWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := collectTestTrace(t).WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var decoded RunTrace
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Nodes) != 6 || decoded.Nodes[1].StartOffset != 10*time.Millisecond {
+		t.Errorf("round-tripped trace = %+v", decoded)
+	}
+}
+
+func TestRunTraceWriteMermaid(t *testing.T) {
+	var buf bytes.Buffer
+	if err := collectTestTrace(t).WriteMermaid(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+
+	for _, want := range []string{
+		"flowchart TD\n",
+		`    subgraph n_p_p1["parallel p1"]`,
+		`        n_llm_a["Draft #quot;A#quot;<br/>succeeded · 2.00s · 120 tokens"]`,
+		`    subgraph n_g_iter["Each<br/>failed · 0.30s"]`,
+		`        n_code["Code<br/>failed · 0.30s · 2 runs"]`,
+		"    n_start --> n_llm_a\n",
+		"    n_llm_a --> n_iter\n",
+		"    style n_code stroke:#d33,stroke-width:2px\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("mermaid output missing %q\n%s", want, got)
+		}
+	}
+}
+
+func TestRunTraceWriteGantt(t *testing.T) {
+	var buf bytes.Buffer
+	if err := collectTestTrace(t).WriteGantt(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 7 {
+		t.Fatalf("got %d lines, want 7\n%s", len(lines), buf.String())
+	}
+	if !strings.HasPrefix(lines[0], "workflow run run1: failed, 2.31s, 200 tokens") {
+		t.Errorf("header = %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[6], "  Code [1]") || !strings.HasSuffix(lines[6], "+0.20s failed") {
+		t.Errorf("nested iteration line = %q", lines[6])
+	}
+	// Draft "A" runs for most of the workflow, so its bar is the longest.
+	if strings.Count(lines[2], "█") <= strings.Count(lines[3], "█") {
+		t.Errorf("expected llm_a bar to be longer than llm_b\n%s", buf.String())
+	}
+}
@@ -0,0 +1,211 @@
+package dify
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// TLSOptions configures the TLS connections to Dify, for servers signed by a
+// private CA or fronted by mutual TLS. PEM contents and files can be mixed.
+type TLSOptions struct {
+	// CAFile and CAPEM hold CA certificates trusted on top of the system
+	// ones.
+	CAFile string
+	CAPEM  []byte
+	// CertFile and KeyFile, or CertPEM and KeyPEM, hold the client
+	// certificate presented to servers that ask for one.
+	CertFile string
+	KeyFile  string
+	CertPEM  []byte
+	KeyPEM   []byte
+	// ServerName overrides the name the server certificate is checked
+	// against.
+	ServerName string
+}
+
+// config applies the options on top of base, which may be nil.
+func (o *TLSOptions) config(base *tls.Config) (*tls.Config, error) {
+	cfg := base.Clone()
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	if o.ServerName != "" {
+		cfg.ServerName = o.ServerName
+	}
+
+	caPEM := o.CAPEM
+	if o.CAFile != "" {
+		b, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("dify: reading CA file: %w", err)
+		}
+		caPEM = append(append([]byte(nil), caPEM...), b...)
+	}
+	if len(caPEM) > 0 {
+		pool := cfg.RootCAs
+		if pool == nil {
+			var err error
+			if pool, err = x509.SystemCertPool(); err != nil {
+				pool = x509.NewCertPool()
+			}
+		} else {
+			pool = pool.Clone()
+		}
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("dify: no CA certificate found in the PEM data")
+		}
+		cfg.RootCAs = pool
+	}
+
+	certPEM, keyPEM := o.CertPEM, o.KeyPEM
+	if o.CertFile != "" || o.KeyFile != "" {
+		var err error
+		if certPEM, err = os.ReadFile(o.CertFile); err != nil {
+			return nil, fmt.Errorf("dify: reading client certificate: %w", err)
+		}
+		if keyPEM, err = os.ReadFile(o.KeyFile); err != nil {
+			return nil, fmt.Errorf("dify: reading client key: %w", err)
+		}
+	}
+	if len(certPEM) > 0 || len(keyPEM) > 0 {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("dify: loading client certificate: %w", err)
+		}
+		cfg.Certificates = append(cfg.Certificates, cert)
+	}
+	return cfg, nil
+}
+
+// unixHostPrefix marks hosts reached over a Unix socket, such as
+// "unix:///var/run/dify.sock".
+const unixHostPrefix = "unix://"
+
+// unixSocketHosts replaces the Unix socket hosts among hosts by HTTP base
+// URLs with a name of their own, and returns the sockets by those names.
+func unixSocketHosts(hosts []string) ([]string, map[string]string) {
+	var sockets map[string]string
+	out := make([]string, len(hosts))
+	for i, h := range hosts {
+		path, ok := strings.CutPrefix(h, unixHostPrefix)
+		if !ok {
+			out[i] = h
+			continue
+		}
+		name := unixSocketName(path)
+		if sockets == nil {
+			sockets = make(map[string]string)
+		}
+		sockets[name] = path
+		out[i] = "http://" + name
+	}
+	return out, sockets
+}
+
+// unixSocketName turns a socket path into a host name, such as
+// "var-run-dify.sock" for "/var/run/dify.sock".
+func unixSocketName(path string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return '-'
+	}, strings.Trim(path, "/"))
+	if name == "" {
+		name = "unix"
+	}
+	return name
+}
+
+// ErrTransportOptions is the error of calls of a client whose proxy, TLS or
+// Unix socket options cannot be applied, because its round tripper is not an
+// *http.Transport.
+var ErrTransportOptions = errors.New("dify: proxy, TLS and Unix socket options need an *http.Transport")
+
+// buildTransport returns the transport every call goes through before the
+// client's own layers: the configured one, with the proxy, TLS and Unix
+// socket options applied. Calls fail with the error of options that cannot
+// be loaded, or with ErrTransportOptions when the configured round tripper
+// is not an *http.Transport, rather than being sent without them.
+func buildTransport(c *ClientConfig, sockets map[string]string) http.RoundTripper {
+	var base = c.Transport
+	if base == nil && c.HTTPClient != nil {
+		base = c.HTTPClient.Transport
+	}
+	if c.ProxyURL == "" && c.TLS == nil && len(sockets) == 0 {
+		if base == nil {
+			return http.DefaultTransport
+		}
+		return base
+	}
+
+	var t *http.Transport
+	switch b := base.(type) {
+	case nil:
+		t = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		t = b.Clone()
+	default:
+		return failingTransport{fmt.Errorf("%w, not %T", ErrTransportOptions, base)}
+	}
+
+	if c.ProxyURL != "" {
+		proxy, err := url.Parse(c.ProxyURL)
+		if err != nil {
+			return failingTransport{fmt.Errorf("dify: invalid proxy URL: %w", err)}
+		}
+		t.Proxy = http.ProxyURL(proxy)
+	}
+	if c.TLS != nil {
+		cfg, err := c.TLS.config(t.TLSClientConfig)
+		if err != nil {
+			return failingTransport{err}
+		}
+		t.TLSClientConfig = cfg
+	}
+	if len(sockets) > 0 {
+		// Unix sockets are dialed directly, never through a proxy.
+		proxy := t.Proxy
+		t.Proxy = func(req *http.Request) (*url.URL, error) {
+			if _, ok := sockets[req.URL.Hostname()]; ok || proxy == nil {
+				return nil, nil
+			}
+			return proxy(req)
+		}
+		dial := t.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(addr)
+			if err == nil {
+				if path, ok := sockets[host]; ok {
+					return dial(ctx, "unix", path)
+				}
+			}
+			return dial(ctx, network, addr)
+		}
+	}
+	return t
+}
+
+// failingTransport fails every request with err.
+type failingTransport struct {
+	err error
+}
+
+func (t failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	return nil, t.err
+}
@@ -0,0 +1,234 @@
+package dify
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// TTSError reports a tts_message chunk that could not be decoded or written.
+type TTSError struct {
+	MessageID string
+	Err       error
+}
+
+func (e *TTSError) Error() string {
+	return fmt.Sprintf("tts message %s: %v", e.MessageID, e.Err)
+}
+
+func (e *TTSError) Unwrap() error {
+	return e.Err
+}
+
+// TTSSink assembles the base64 audio chunks of tts_message events into audio,
+// writing each chunk as soon as it arrives so playback can start while the
+// text is still streaming. Chunks are kept in order per message_id and a
+// message is finalized on tts_message_end.
+//
+// For workflow streams, pass HandleTTSMessage as DefaultEventHandler.TTSHandler
+// or call it from your own EventHandler. For chat streams, call
+// HandleChatMessage with every event.
+type TTSSink struct {
+	// OnError is called for every chunk that fails to decode or write.
+	OnError func(err error)
+	// OnComplete is called once a message has been finalized.
+	OnComplete func(messageID string)
+
+	open func(messageID string) (io.WriteCloser, error)
+
+	mu       sync.Mutex
+	messages map[string]*ttsMessageWriter
+	err      error
+}
+
+type ttsMessageWriter struct {
+	w     io.WriteCloser
+	carry []byte
+	buf   []byte
+}
+
+// NewTTSSink writes the audio of every message to w.
+func NewTTSSink(w io.Writer) *TTSSink {
+	return NewTTSSinkFunc(func(string) (io.WriteCloser, error) {
+		return nopWriteCloser{w}, nil
+	})
+}
+
+// NewTTSFileSink writes the audio of each message to dir/<message_id>.mp3,
+// the default audio format of Dify.
+func NewTTSFileSink(dir string) *TTSSink {
+	return NewTTSFileSinkWithExtension(dir, "mp3")
+}
+
+// NewTTSFileSinkWithExtension writes the audio of each message to
+// dir/<message_id>.<ext>, for apps whose TTS model produces another format.
+//
+// A message whose id is empty or not a plain file name, such as one holding a
+// path separator, is not written and reported as a *TTSError. The file of a
+// message is truncated when it is opened, so the audio of a message id seen
+// again, by this sink or another one writing to dir, replaces the earlier one.
+func NewTTSFileSinkWithExtension(dir, ext string) *TTSSink {
+	ext = "." + strings.TrimPrefix(ext, ".")
+	return NewTTSSinkFunc(func(messageID string) (io.WriteCloser, error) {
+		if messageID == "" || messageID == "." || messageID == ".." || filepath.Base(messageID) != messageID {
+			return nil, fmt.Errorf("message id %q is not a file name", messageID)
+		}
+		return os.Create(filepath.Join(dir, messageID+ext))
+	})
+}
+
+// NewTTSSinkFunc calls open for the first chunk of every message and closes
+// the returned writer when the message ends.
+func NewTTSSinkFunc(open func(messageID string) (io.WriteCloser, error)) *TTSSink {
+	return &TTSSink{
+		open:     open,
+		messages: make(map[string]*ttsMessageWriter),
+	}
+}
+
+// HandleTTSMessage consumes a tts_message or tts_message_end event.
+func (s *TTSSink) HandleTTSMessage(msg TTSMessage) {
+	switch msg.Event {
+	case EventTTSMessage:
+		s.write(msg.MessageID, msg.Audio)
+	case EventTTSMessageEnd:
+		s.write(msg.MessageID, msg.Audio)
+		s.finish(msg.MessageID)
+	}
+}
+
+// HandleChatMessage consumes the TTS events of a chat or completion stream
+// and ignores all others.
+func (s *TTSSink) HandleChatMessage(resp ChatMessageStreamResponse) {
+	switch resp.Event {
+	case EventTTSMessage, EventTTSMessageEnd:
+		s.HandleTTSMessage(TTSMessage{
+			Event:     resp.Event,
+			TaskID:    resp.TaskID,
+			MessageID: resp.MessageID,
+			Audio:     resp.Audio,
+			CreatedAt: resp.CreatedAt,
+		})
+	}
+}
+
+// Err returns the first error the sink ran into.
+func (s *TTSSink) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close finalizes messages that never received tts_message_end, for example
+// because the stream was cancelled, and returns the first error.
+func (s *TTSSink) Close() error {
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.messages))
+	for id := range s.messages {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+
+	for _, id := range ids {
+		s.finish(id)
+	}
+	return s.Err()
+}
+
+func (s *TTSSink) write(messageID, audio string) {
+	s.mu.Lock()
+	err := s.writeLocked(messageID, strings.TrimSpace(audio))
+	s.mu.Unlock()
+	s.report(messageID, err)
+}
+
+func (s *TTSSink) writeLocked(messageID, audio string) error {
+	if audio == "" {
+		return nil
+	}
+	m, ok := s.messages[messageID]
+	if !ok {
+		w, err := s.open(messageID)
+		if err != nil {
+			return err
+		}
+		m = &ttsMessageWriter{w: w}
+		s.messages[messageID] = m
+	}
+
+	// Chunks are usually padded base64 strings of their own, but a chunk cut
+	// at an arbitrary position is carried over until the next one completes
+	// the last quantum. A padded chunk ends a base64 string, so bytes still
+	// carried before it can never be completed and are dropped.
+	var dropped error
+	padded := strings.HasSuffix(audio, "=")
+	if padded && len(m.carry) > 0 && (len(m.carry)+len(audio))%4 != 0 {
+		dropped = fmt.Errorf("dropped %d bytes of an incomplete base64 chunk", len(m.carry))
+		m.carry = m.carry[:0]
+	}
+	data := append(m.carry, audio...)
+	n := len(data) - len(data)%4
+	if padded && n < len(data) {
+		// The padding is misaligned: start afresh with the next chunk.
+		m.carry = m.carry[:0]
+		return errors.Join(dropped, errors.New("padded base64 chunk of a wrong length"))
+	}
+	if need := base64.StdEncoding.DecodedLen(n); cap(m.buf) < need {
+		m.buf = make([]byte, need)
+	}
+	decoded, err := base64.StdEncoding.Decode(m.buf[:cap(m.buf)], data[:n])
+	if err != nil {
+		m.carry = m.carry[:0]
+		return errors.Join(dropped, err)
+	}
+	m.carry = append(m.carry[:0], data[n:]...)
+
+	_, err = m.w.Write(m.buf[:decoded])
+	return errors.Join(dropped, err)
+}
+
+func (s *TTSSink) finish(messageID string) {
+	s.mu.Lock()
+	m, ok := s.messages[messageID]
+	delete(s.messages, messageID)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if len(m.carry) > 0 {
+		s.report(messageID, errors.New("audio ends with an incomplete base64 chunk"))
+	}
+	s.report(messageID, m.w.Close())
+	if s.OnComplete != nil {
+		s.OnComplete(messageID)
+	}
+}
+
+func (s *TTSSink) report(messageID string, err error) {
+	if err == nil {
+		return
+	}
+	err = &TTSError{MessageID: messageID, Err: err}
+
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+
+	if s.OnError != nil {
+		s.OnError(err)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
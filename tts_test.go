@@ -0,0 +1,197 @@
+package dify
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *bufferCloser) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestTTSSinkAssemblesMessages(t *testing.T) {
+	outputs := make(map[string]*bufferCloser)
+	sink := NewTTSSinkFunc(func(messageID string) (io.WriteCloser, error) {
+		outputs[messageID] = &bufferCloser{}
+		return outputs[messageID], nil
+	})
+	var completed []string
+	sink.OnComplete = func(messageID string) { completed = append(completed, messageID) }
+
+	audioA := []byte("first message audio bytes")
+	encodedA := base64.StdEncoding.EncodeToString(audioA)
+	// Message b is sent as independently encoded chunks, message a as one
+	// encoding cut at arbitrary positions.
+	events := []TTSMessage{
+		{Event: EventTTSMessage, MessageID: "a", Audio: encodedA[:5]},
+		{Event: EventTTSMessage, MessageID: "b", Audio: base64.StdEncoding.EncodeToString([]byte("he"))},
+		{Event: EventTTSMessage, MessageID: "a", Audio: encodedA[5:13]},
+		{Event: EventTTSMessage, MessageID: "b", Audio: base64.StdEncoding.EncodeToString([]byte("llo"))},
+		{Event: EventTTSMessage, MessageID: "a", Audio: encodedA[13:]},
+		{Event: EventTTSMessageEnd, MessageID: "b"},
+		{Event: EventTTSMessageEnd, MessageID: "a"},
+	}
+	for _, ev := range events {
+		sink.HandleTTSMessage(ev)
+	}
+
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := outputs["a"].String(); got != string(audioA) || !outputs["a"].closed {
+		t.Errorf("message a = %q, closed %v", got, outputs["a"].closed)
+	}
+	if got := outputs["b"].String(); got != "hello" || !outputs["b"].closed {
+		t.Errorf("message b = %q, closed %v", got, outputs["b"].closed)
+	}
+	if strings.Join(completed, ",") != "b,a" {
+		t.Errorf("completed = %v", completed)
+	}
+}
+
+func TestTTSSinkWritesIncrementally(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewTTSSink(&buf)
+
+	sink.HandleTTSMessage(TTSMessage{Event: EventTTSMessage, MessageID: "m", Audio: base64.StdEncoding.EncodeToString([]byte("abc"))})
+	if buf.String() != "abc" {
+		t.Fatalf("after first chunk got %q", buf.String())
+	}
+	sink.HandleTTSMessage(TTSMessage{Event: EventTTSMessage, MessageID: "m", Audio: base64.StdEncoding.EncodeToString([]byte("def"))})
+	if buf.String() != "abcdef" {
+		t.Fatalf("after second chunk got %q", buf.String())
+	}
+}
+
+func TestTTSSinkReportsDecodeErrors(t *testing.T) {
+	var reported []error
+	sink := NewTTSSink(io.Discard)
+	sink.OnError = func(err error) { reported = append(reported, err) }
+
+	sink.HandleTTSMessage(TTSMessage{Event: EventTTSMessage, MessageID: "m", Audio: "!!!!"})
+	sink.HandleTTSMessage(TTSMessage{Event: EventTTSMessage, MessageID: "m", Audio: "YWJ"})
+	sink.HandleTTSMessage(TTSMessage{Event: EventTTSMessageEnd, MessageID: "m"})
+
+	if len(reported) != 2 {
+		t.Fatalf("reported %v, want 2 errors", reported)
+	}
+	var ttsErr *TTSError
+	if !errors.As(sink.Err(), &ttsErr) || ttsErr.MessageID != "m" {
+		t.Errorf("Err() = %v", sink.Err())
+	}
+}
+
+func TestTTSSinkRecoversFromMisalignedPadding(t *testing.T) {
+	var out bytes.Buffer
+	var reported []error
+	sink := NewTTSSink(&out)
+	sink.OnError = func(err error) { reported = append(reported, err) }
+	enc := base64.StdEncoding.EncodeToString
+
+	// "YW" is half a quantum that the padded chunk after it cannot complete.
+	sink.HandleTTSMessage(TTSMessage{Event: EventTTSMessage, MessageID: "m", Audio: enc([]byte("abc")) + "YW"})
+	sink.HandleTTSMessage(TTSMessage{Event: EventTTSMessage, MessageID: "m", Audio: enc([]byte("de"))})
+	sink.HandleTTSMessage(TTSMessage{Event: EventTTSMessage, MessageID: "m", Audio: enc([]byte("fgh"))})
+	sink.HandleTTSMessage(TTSMessage{Event: EventTTSMessageEnd, MessageID: "m"})
+
+	if out.String() != "abcdefgh" {
+		t.Errorf("audio = %q, want the chunks around the dropped bytes", out.String())
+	}
+	if len(reported) != 1 || !strings.Contains(reported[0].Error(), "dropped 2 bytes") {
+		t.Errorf("reported %v, want the dropped bytes once", reported)
+	}
+}
+
+func TestTTSFileSink(t *testing.T) {
+	dir := t.TempDir()
+	sink := NewTTSFileSink(dir)
+	sink.HandleTTSMessage(TTSMessage{Event: EventTTSMessage, MessageID: "m1", Audio: base64.StdEncoding.EncodeToString([]byte("mp3"))})
+	sink.HandleTTSMessage(TTSMessage{Event: EventTTSMessageEnd, MessageID: "m1"})
+
+	got, err := os.ReadFile(filepath.Join(dir, "m1.mp3"))
+	if err != nil || string(got) != "mp3" {
+		t.Errorf("file = %q, %v", got, err)
+	}
+
+	sink = NewTTSFileSinkWithExtension(dir, ".wav")
+	sink.HandleTTSMessage(TTSMessage{Event: EventTTSMessage, MessageID: "m2", Audio: base64.StdEncoding.EncodeToString([]byte("wav"))})
+	sink.HandleTTSMessage(TTSMessage{Event: EventTTSMessageEnd, MessageID: "m2"})
+	if got, err := os.ReadFile(filepath.Join(dir, "m2.wav")); err != nil || string(got) != "wav" {
+		t.Errorf("file = %q, %v", got, err)
+	}
+}
+
+func TestTTSFileSinkRejectsUnsafeIDs(t *testing.T) {
+	dir := t.TempDir()
+	ids := []string{"", ".", "..", "a/b", "../b"}
+	var rejected []string
+	sink := NewTTSFileSink(dir)
+	sink.OnError = func(err error) {
+		var ttsErr *TTSError
+		if errors.As(err, &ttsErr) {
+			rejected = append(rejected, ttsErr.MessageID)
+		}
+	}
+	for _, id := range ids {
+		sink.HandleTTSMessage(TTSMessage{Event: EventTTSMessage, MessageID: id, Audio: base64.StdEncoding.EncodeToString([]byte("mp3"))})
+		sink.HandleTTSMessage(TTSMessage{Event: EventTTSMessageEnd, MessageID: id})
+	}
+
+	if fmt.Sprint(rejected) != fmt.Sprint(ids) {
+		t.Errorf("rejected %q, want %q", rejected, ids)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("unexpected file %s", e.Name())
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "b.mp3")); err == nil {
+		t.Error("audio written outside of dir")
+	}
+}
+
+func TestTTSSinkWorkflowAndChatStreams(t *testing.T) {
+	chunk := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	var workflowAudio bytes.Buffer
+	sink := NewTTSSink(&workflowAudio)
+	stream := fmt.Sprintf("data: {\"event\":\"tts_message\",\"message_id\":\"m\",\"audio\":%q}\n\n"+
+		"data: {\"event\":\"text_chunk\",\"data\":{\"text\":\"x\"}}\n\n"+
+		"data: {\"event\":\"tts_message\",\"message_id\":\"m\",\"audio\":%q}\n\n"+
+		"data: {\"event\":\"tts_message_end\",\"message_id\":\"m\",\"audio\":\"\"}\n\n", chunk("wf "), chunk("audio"))
+	handler := &DefaultEventHandler{TTSHandler: sink.HandleTTSMessage}
+	if err := decodeWorkflowStream(strings.NewReader(stream), handler); err != nil {
+		t.Fatal(err)
+	}
+	if workflowAudio.String() != "wf audio" {
+		t.Errorf("workflow audio = %q", workflowAudio.String())
+	}
+
+	var chatAudio bytes.Buffer
+	sink = NewTTSSink(&chatAudio)
+	for _, resp := range []ChatMessageStreamResponse{
+		{Event: EventMessage, Answer: "hi"},
+		{Event: EventTTSMessage, MessageID: "m", Audio: chunk("chat")},
+		{Event: EventTTSMessageEnd, MessageID: "m"},
+	} {
+		sink.HandleChatMessage(resp)
+	}
+	if chatAudio.String() != "chat" {
+		t.Errorf("chat audio = %q", chatAudio.String())
+	}
+}